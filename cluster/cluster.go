@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"log"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,20 +10,21 @@ import (
 )
 
 const (
-	MaxNodeNumber = 128
-	Active        = "ACTIVE"
-	Inactive      = "INACTIVE"
+	Active   = "ACTIVE"
+	Inactive = "INACTIVE"
+	Syncing  = "SYNCING" // the node is copying the data it replicates, it does not own slots yet
 )
 
 // Node configuration informations
 type OvoNode struct {
-	Name      string
-	HashRange []int
-	Host      string
-	Port      int
-	APIHost   string
-	APIPort   int
-	State     string
+	Name        string
+	HashRange   []int
+	FailedRange []int // the slots owned by an inactive node when it failed, they are served by a twin
+	Host        string
+	Port        int
+	APIHost     string
+	APIPort     int
+	State       string
 }
 
 // The cluster node struct
@@ -31,16 +33,39 @@ type ClusterTopologyNode struct {
 	StartDate    time.Time
 	Twins        []string
 	Stepbrothers []string
+	AutoTwins    []string
 	UpdateDate   time.Time
+	Secret       string `json:"-"` // cluster secret sent with the registration requests
 }
 
 // The cluster topology that contains the list of nodes
 type ClusterTopology struct {
-	Nodes []*ClusterTopologyNode
+	Nodes  []*ClusterTopologyNode
+	Secret string `json:"-"` // cluster secret sent with the update requests
 }
 
 var currentNode *ClusterTopologyNode
 var mux *sync.RWMutex = new(sync.RWMutex)
+var replicationFactor int = 1
+
+// Set the number of copies of the data (the node and its twins) used to choose the twins automatically.
+func SetReplicationFactor(factor int) {
+	if factor > 0 {
+		replicationFactor = factor
+	}
+}
+
+// Get the names of the nodes that replicate the data of the node.
+// The twins configured manually override the twins chosen automatically.
+func (node *ClusterTopologyNode) Replicas() []string {
+	if len(node.Twins) > 0 {
+		return node.Twins
+	}
+	if node.AutoTwins == nil {
+		return make([]string, 0)
+	}
+	return node.AutoTwins
+}
 
 // Set the current node
 func SetCurrentNode(node *ClusterTopologyNode, ct *ClusterTopology) {
@@ -53,14 +78,14 @@ func GetCurrentNode() *ClusterTopologyNode {
 	return currentNode
 }
 
-// Get the active twin nodes
+// Get the active twin nodes (the syncing twins included)
 func (ct *ClusterTopology) GetTwins(names []string) (nodes []*ClusterTopologyNode) {
 	nodes = make([]*ClusterTopologyNode, 0)
 	mux.RLock()
 	defer mux.RUnlock()
 	for _, nd := range ct.Nodes {
 		for _, s := range names {
-			if nd.Node.Name == s && Active == nd.Node.State {
+			if nd.Node.Name == s && Inactive != nd.Node.State {
 				nodes = append(nodes, nd)
 			}
 		}
@@ -87,20 +112,38 @@ func (ct *ClusterTopology) GetInactiveNodes() (nodes []*ClusterTopologyNode) {
 	mux.RLock()
 	defer mux.RUnlock()
 	for _, nd := range ct.Nodes {
-		if Active != nd.Node.State {
+		if Inactive == nd.Node.State {
 			nodes = append(nodes, nd)
 		}
 	}
 	return nodes
 }
 
-// Get the all active cluster nodes except current
+// Get the all active (or syncing) cluster nodes except current
 func (ct *ClusterTopology) GetClusterNodes() (nodes []*ClusterTopologyNode) {
 	nodes = make([]*ClusterTopologyNode, 0)
 	mux.RLock()
 	defer mux.RUnlock()
 	for _, nd := range ct.Nodes {
-		if nd.Node.Name != currentNode.Node.Name && Active == nd.Node.State {
+		if nd.Node.Name != currentNode.Node.Name && Inactive != nd.Node.State {
+			nodes = append(nodes, nd)
+		}
+	}
+	return nodes
+}
+
+// Get all the other nodes of the cluster, whatever their state
+func (ct *ClusterTopology) GetOtherNodes() (nodes []*ClusterTopologyNode) {
+	return ct.GetNodesExcept(currentNode.Node.Name)
+}
+
+// Get all the nodes of the cluster except the named one, whatever their state
+func (ct *ClusterTopology) GetNodesExcept(name string) (nodes []*ClusterTopologyNode) {
+	nodes = make([]*ClusterTopologyNode, 0)
+	mux.RLock()
+	defer mux.RUnlock()
+	for _, nd := range ct.Nodes {
+		if nd.Node.Name != name {
 			nodes = append(nodes, nd)
 		}
 	}
@@ -114,8 +157,8 @@ func (ct *ClusterTopology) GetRelatives() (nodes []*ClusterTopologyNode) {
 	mux.RLock()
 	defer mux.RUnlock()
 	for _, nd := range ct.Nodes {
-		if util.ContainsString(currentNode.Twins, nd.Node.Name) || util.ContainsString(currentNode.Stepbrothers, nd.Node.Name) {
-			if Active == nd.Node.State {
+		if util.ContainsString(currentNode.Replicas(), nd.Node.Name) || util.ContainsString(currentNode.Stepbrothers, nd.Node.Name) || util.ContainsString(nd.Replicas(), currentNode.Node.Name) {
+			if Inactive != nd.Node.State {
 				nodemap[nd.Node.Name] = nd
 			}
 		}
@@ -126,12 +169,12 @@ func (ct *ClusterTopology) GetRelatives() (nodes []*ClusterTopologyNode) {
 	return nodes
 }
 
-// Get the node that contains the hashcode
+// Get the node that contains the hashcode (the inactive nodes own no slots)
 func (ct *ClusterTopology) GetNodeByHash(hash int) (node *ClusterTopologyNode) {
 	mux.RLock()
 	defer mux.RUnlock()
 	for _, nd := range ct.Nodes {
-		if util.Contains(nd.Node.HashRange, hash) {
+		if Inactive != nd.Node.State && util.Contains(nd.Node.HashRange, hash) {
 			return nd
 		}
 	}
@@ -252,59 +295,84 @@ func (ct *ClusterTopology) addNode(node *ClusterTopologyNode) {
 }
 
 // Generate and assign the hashcode range to all nodes.
+// The slots are assigned by a consistent hash ring, so adding or removing a node moves only a fraction of the slots.
 func (ct *ClusterTopology) buildHashcode() {
 	mux.RLock()
 	defer mux.RUnlock()
-	count := 0
+	active := make([]*ClusterTopologyNode, 0)
 	for _, node := range ct.Nodes {
 		if Active == node.Node.State {
-			count++
+			active = append(active, node)
 		}
 	}
 	log.Println("Partitioning hashcode...")
-	var r int = MaxNodeNumber
-	var q int = 0
-	if count > 0 {
-		r = MaxNodeNumber / count
-		q = MaxNodeNumber % count
-		log.Printf("Range len = %d - Remnant = %d\r\n", r, q)
-	}
-	//log.Printf(" r = %d \r\n",r)
-	var hashrange []int = make([]int, MaxNodeNumber)
-	for i := 0; i < MaxNodeNumber; i++ {
-		hashrange[i] = i
+	owners := make(map[int]*ClusterTopologyNode, slotCount)
+	ring := newHashRing(active)
+	for slot := 0; slot < slotCount; slot++ {
+		if node := ring.owner(slot); node != nil {
+			owners[slot] = node
+		}
 	}
-	var start int = 0
-	var end int = r - 1
+	// failover: the slots of a failed node are given to a twin that holds its data,
+	// the failed node keeps them only as failed range so every slot has a single owner
 	for _, node := range ct.Nodes {
-		if Active == node.Node.State {
-
-			if end < (len(hashrange) - 1) {
-				if q > 0 {
-					end++
-					q--
+		if Inactive == node.Node.State {
+			if len(node.Node.HashRange) > 0 {
+				node.Node.FailedRange = node.Node.HashRange
+				node.Node.HashRange = make([]int, 0)
+			}
+			if twin := ct.failoverTwin(node); twin != nil {
+				log.Printf(" node = %s : slots of failed node %s = %d\r\n", twin.Node.Name, node.Node.Name, len(node.Node.FailedRange))
+				for _, slot := range node.Node.FailedRange {
+					owners[slot] = twin
 				}
-				node.Node.HashRange = hashrange[start : end+1]
-				log.Printf(" node = %s : start = %d - end = %d\r\n", node.Node.Name, start, end)
-				start = end + 1
-				end += r
-			} else {
-				node.Node.HashRange = hashrange[start:]
-				log.Printf(" node = %s : start = %d - end = %d\r\n", node.Node.Name, start, end)
 			}
 		}
 	}
-	/* *
-	for ind, node := range ct.Nodes {
+	ranges := make(map[string][]int)
+	for slot := 0; slot < slotCount; slot++ {
+		if node, ok := owners[slot]; ok {
+			ranges[node.Node.Name] = append(ranges[node.Node.Name], slot)
+		}
+	}
+	for _, node := range ct.Nodes {
 		if Active == node.Node.State {
-			if ind < (len(ct.Nodes) -1) {
-				log.Printf(" node = %s : start = %d - end = %d\r\n", node.Node.Name, ind*r, (ind*(r)+r)-1)
-				node.Node.HashRange = hashrange[ind*r:(ind*(r)+r)-1]
-			} else {
-				log.Printf(" node = %s : start = %d - end = %d\r\n", node.Node.Name, ind*r, len(hashrange)-1)
-				node.Node.HashRange = hashrange[ind*r:]
+			node.Node.HashRange = ranges[node.Node.Name]
+			if node.Node.HashRange == nil {
+				node.Node.HashRange = make([]int, 0)
 			}
+			node.Node.FailedRange = nil
+			log.Printf(" node = %s : slots = %d\r\n", node.Node.Name, len(node.Node.HashRange))
+		} else if Syncing == node.Node.State {
+			node.Node.HashRange = make([]int, 0)
+		}
+	}
+	assignTwins(active)
+}
+
+// Get the first active twin of a failed node, the syncing twins are skipped because they may miss some data.
+// It must be called holding the lock.
+func (ct *ClusterTopology) failoverTwin(failed *ClusterTopologyNode) *ClusterTopologyNode {
+	for _, name := range failed.Replicas() {
+		if twin, _ := ct.getNodeByName(name); twin != nil && Active == twin.Node.State {
+			return twin
+		}
+	}
+	return nil
+}
+
+// Choose the twins of the active nodes: the twins of a node are the nodes that follow it on the ring.
+func assignTwins(active []*ClusterTopologyNode) {
+	ordered := make([]*ClusterTopologyNode, len(active))
+	copy(ordered, active)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ringPosition(ordered[i].Node.Name) < ringPosition(ordered[j].Node.Name)
+	})
+	for ind, node := range ordered {
+		twins := make([]string, 0)
+		for i := 1; i < replicationFactor && i < len(ordered); i++ {
+			twins = append(twins, ordered[(ind+i)%len(ordered)].Node.Name)
 		}
+		node.AutoTwins = twins
 	}
-	* */
 }
@@ -0,0 +1,22 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"strings"
+)
+
+// Compute the hashcode of a key (CRC32 modulo the number of slots).
+// If the key contains a non empty {hashtag} only the hashtag is hashed, so related keys can be placed on the same node.
+func HashKey(key string) int {
+	return int(crc32.ChecksumIEEE([]byte(HashTag(key))) % uint32(slotCount))
+}
+
+// Get the part of the key used to compute the hashcode.
+func HashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
@@ -0,0 +1,34 @@
+package cluster
+
+import (
+	"testing"
+)
+
+func TestHashTag(t *testing.T) {
+	t.Log("TestHashTag started")
+	cases := map[string]string{
+		"user:1000":           "user:1000",
+		"{user:1000}:name":    "user:1000",
+		"session:{user:1000}": "user:1000",
+		"{}:name":             "{}:name",
+		"open{brace":          "open{brace",
+		"a{b}{c}":             "b",
+	}
+	for key, tag := range cases {
+		if res := HashTag(key); res != tag {
+			t.Fatalf("HashTag(%s) = %s, expected %s", key, res, tag)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	t.Log("TestHashKey started")
+	if HashKey("{user:1000}:name") != HashKey("{user:1000}:email") {
+		t.Fatal("keys with the same hashtag have different hashcodes")
+	}
+	for _, key := range []string{"", "a", "user:1000", "tenant:42:session:abc"} {
+		if hash := HashKey(key); hash < 0 || hash >= SlotCount() {
+			t.Fatalf("HashKey(%s) = %d out of range", key, hash)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+const (
+	DefaultSlotCount    = 128
+	DefaultVirtualNodes = 64
+)
+
+var slotCount int = DefaultSlotCount
+var virtualNodes int = DefaultVirtualNodes
+
+// Set the number of hash slots and the number of virtual nodes of every node on the hash ring.
+// It must be called before the topology is built.
+func Configure(slots int, vnodes int) {
+	if slots > 0 {
+		slotCount = slots
+	}
+	if vnodes > 0 {
+		virtualNodes = vnodes
+	}
+}
+
+// Get the number of hash slots.
+func SlotCount() int {
+	return slotCount
+}
+
+// Get the number of virtual nodes of every node.
+func VirtualNodes() int {
+	return virtualNodes
+}
+
+// A virtual node on the hash ring.
+type ringPoint struct {
+	position uint32
+	node     *ClusterTopologyNode
+}
+
+// The consistent hash ring of the nodes.
+type hashRing []ringPoint
+
+// Build the hash ring placing the virtual nodes of every node.
+func newHashRing(nodes []*ClusterTopologyNode) hashRing {
+	ring := make(hashRing, 0, len(nodes)*virtualNodes)
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, ringPoint{position: ringPosition(node.Node.Name + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].position == ring[j].position {
+			return ring[i].node.Node.Name < ring[j].node.Node.Name
+		}
+		return ring[i].position < ring[j].position
+	})
+	return ring
+}
+
+// Get the node that owns the slot: the first virtual node that follows the slot on the ring.
+func (ring hashRing) owner(slot int) *ClusterTopologyNode {
+	if len(ring) == 0 {
+		return nil
+	}
+	position := ringPosition("slot-" + strconv.Itoa(slot))
+	ind := sort.Search(len(ring), func(i int) bool { return ring[i].position >= position })
+	if ind == len(ring) {
+		ind = 0
+	}
+	return ring[ind].node
+}
+
+// Position of a name on the ring (CRC32 mixed with the murmur3 finalizer to spread similar names).
+func ringPosition(name string) uint32 {
+	h := crc32.ChecksumIEEE([]byte(name))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
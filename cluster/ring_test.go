@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maxzerbini/ovo/util"
+)
+
+func newTestNode(name string) *ClusterTopologyNode {
+	return &ClusterTopologyNode{Node: &OvoNode{Name: name, State: Active}, StartDate: time.Now(), UpdateDate: time.Now()}
+}
+
+func slotOwners(ct *ClusterTopology) map[int]string {
+	owners := make(map[int]string)
+	for _, node := range ct.Nodes {
+		for _, slot := range node.Node.HashRange {
+			owners[slot] = node.Node.Name
+		}
+	}
+	return owners
+}
+
+func TestRingAssignsEverySlot(t *testing.T) {
+	t.Log("TestRingAssignsEverySlot started")
+	ct := &ClusterTopology{}
+	for i := 0; i < 5; i++ {
+		ct.AddNode(newTestNode("node-" + strconv.Itoa(i)))
+	}
+	count := 0
+	for _, node := range ct.Nodes {
+		if len(node.Node.HashRange) == 0 {
+			t.Fatalf("node %s has no slots", node.Node.Name)
+		}
+		count += len(node.Node.HashRange)
+	}
+	if count != SlotCount() || len(slotOwners(ct)) != SlotCount() {
+		t.Fatal("Incorrect slot assignment " + strconv.Itoa(count))
+	}
+}
+
+func TestRingMovesFewSlots(t *testing.T) {
+	t.Log("TestRingMovesFewSlots started")
+	ct := &ClusterTopology{}
+	for i := 0; i < 4; i++ {
+		ct.AddNode(newTestNode("node-" + strconv.Itoa(i)))
+	}
+	before := slotOwners(ct)
+	ct.AddNode(newTestNode("node-new"))
+	after := slotOwners(ct)
+	moved := 0
+	for slot, owner := range after {
+		if before[slot] != owner {
+			if owner != "node-new" {
+				t.Fatalf("slot %d moved between old nodes", slot)
+			}
+			moved++
+		}
+	}
+	t.Logf("Moved slots: %d", moved)
+	if moved == 0 || moved > SlotCount()/2 {
+		t.Fatal("Incorrect number of moved slots " + strconv.Itoa(moved))
+	}
+}
+
+func TestAutoTwins(t *testing.T) {
+	t.Log("TestAutoTwins started")
+	SetReplicationFactor(3)
+	defer SetReplicationFactor(1)
+	ct := &ClusterTopology{}
+	for i := 0; i < 4; i++ {
+		ct.AddNode(newTestNode("node-" + strconv.Itoa(i)))
+	}
+	ct.Nodes[0].Twins = []string{"manual"}
+	replicated := make(map[string]int)
+	for _, node := range ct.Nodes {
+		if len(node.AutoTwins) != 2 {
+			t.Fatalf("node %s has %d twins", node.Node.Name, len(node.AutoTwins))
+		}
+		for _, twin := range node.AutoTwins {
+			if twin == node.Node.Name {
+				t.Fatalf("node %s is twin of itself", twin)
+			}
+			replicated[twin]++
+		}
+	}
+	for name, count := range replicated {
+		if count != 2 {
+			t.Fatalf("node %s replicates %d nodes", name, count)
+		}
+	}
+	if replicas := ct.Nodes[0].Replicas(); len(replicas) != 1 || replicas[0] != "manual" {
+		t.Fatal("manual twins not honored")
+	}
+}
+
+func TestSyncingNodeOwnsNoSlots(t *testing.T) {
+	t.Log("TestSyncingNodeOwnsNoSlots started")
+	ct := &ClusterTopology{}
+	for i := 0; i < 3; i++ {
+		ct.AddNode(newTestNode("node-" + strconv.Itoa(i)))
+	}
+	syncing := newTestNode("node-syncing")
+	syncing.Node.State = Syncing
+	ct.AddNode(syncing)
+	if len(syncing.Node.HashRange) != 0 {
+		t.Fatal("syncing node owns slots")
+	}
+	if len(slotOwners(ct)) != SlotCount() {
+		t.Fatal("slots not assigned to the active nodes")
+	}
+	if twins := ct.GetTwins([]string{"node-syncing"}); len(twins) != 1 {
+		t.Fatal("syncing twin not replicated")
+	}
+}
+
+func TestFailoverToTwin(t *testing.T) {
+	t.Log("TestFailoverToTwin started")
+	ct := &ClusterTopology{}
+	for i := 0; i < 4; i++ {
+		ct.AddNode(newTestNode("node-" + strconv.Itoa(i)))
+	}
+	failed := ct.Nodes[0]
+	failed.Twins = []string{"node-2"}
+	slots := append([]int(nil), failed.Node.HashRange...)
+	failed.Node.State = Inactive
+	ct.AddNode(failed)
+	twin, _ := ct.GetNodeByName("node-2")
+	for _, slot := range slots {
+		if !util.Contains(twin.Node.HashRange, slot) {
+			t.Fatalf("slot %d not handed to the twin", slot)
+		}
+		if owner := ct.GetNodeByHash(slot); owner != twin {
+			t.Fatalf("slot %d owned by %s", slot, owner.Node.Name)
+		}
+	}
+	if len(failed.Node.HashRange) != 0 || len(failed.Node.FailedRange) != len(slots) {
+		t.Fatal("failed node still owns its slots")
+	}
+	owned := 0
+	for _, node := range ct.Nodes {
+		owned += len(node.Node.HashRange)
+	}
+	if owned != SlotCount() {
+		t.Fatal("slots with more than one owner")
+	}
+	// the failover survives a new partitioning
+	ct.AddNode(newTestNode("node-4"))
+	for _, slot := range slots {
+		if ct.GetNodeByHash(slot) == nil {
+			t.Fatalf("slot %d without owner", slot)
+		}
+	}
+	if len(slotOwners(ct)) != SlotCount() {
+		t.Fatal("slots not assigned")
+	}
+}
@@ -0,0 +1,67 @@
+package command
+
+import (
+	"strings"
+)
+
+const (
+	RightRead   string = "read"
+	RightWrite  string = "write"
+	RightDelete string = "delete"
+	AnyItem     string = "*"
+)
+
+// An access control list entry: it grants the rights on the objects of a collection whose key starts with a prefix.
+// An empty or * collection matches every collection. The counters have no collection, they are matched only by the prefix.
+type ACL struct {
+	Collection string
+	Prefix     string
+	Rights     []string
+}
+
+// Check if the entry grants the right on the key of the collection.
+func (acl *ACL) Grants(collection string, key string, right string) bool {
+	if acl.Collection != "" && acl.Collection != AnyItem && acl.Collection != collection {
+		return false
+	}
+	return acl.GrantsCounter(key, right)
+}
+
+// Check if the entry grants the right on the counter, whatever the collection of the entry.
+func (acl *ACL) GrantsCounter(key string, right string) bool {
+	if !strings.HasPrefix(key, acl.Prefix) {
+		return false
+	}
+	for _, r := range acl.Rights {
+		if r == right || r == AnyItem {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the list grants the right on the key of the collection. An empty list grants every right.
+func Allowed(acls []ACL, collection string, key string, right string) bool {
+	if len(acls) == 0 {
+		return true
+	}
+	for i := range acls {
+		if acls[i].Grants(collection, key, right) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the list grants the right on the counter. An empty list grants every right.
+func AllowedCounter(acls []ACL, key string, right string) bool {
+	if len(acls) == 0 {
+		return true
+	}
+	for i := range acls {
+		if acls[i].GrantsCounter(key, right) {
+			return true
+		}
+	}
+	return false
+}
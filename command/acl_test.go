@@ -0,0 +1,81 @@
+package command
+
+import (
+	"testing"
+)
+
+func TestGrants(t *testing.T) {
+	cases := []struct {
+		acl        ACL
+		collection string
+		key        string
+		right      string
+		granted    bool
+	}{
+		{ACL{Collection: "users", Prefix: "", Rights: []string{RightRead}}, "users", "u1", RightRead, true},
+		{ACL{Collection: "users", Prefix: "", Rights: []string{RightRead}}, "orders", "u1", RightRead, false},
+		{ACL{Collection: "", Prefix: "", Rights: []string{RightRead}}, "orders", "u1", RightRead, true},
+		{ACL{Collection: AnyItem, Prefix: "", Rights: []string{RightRead}}, "orders", "u1", RightRead, true},
+		{ACL{Collection: "", Prefix: "", Rights: []string{RightRead}}, "", "counter", RightRead, true},
+		{ACL{Collection: "users", Prefix: "", Rights: []string{RightRead}}, "", "counter", RightRead, false},
+		{ACL{Collection: "users", Prefix: "team-a:", Rights: []string{RightRead}}, "users", "team-a:u1", RightRead, true},
+		{ACL{Collection: "users", Prefix: "team-a:", Rights: []string{RightRead}}, "users", "team-b:u1", RightRead, false},
+		{ACL{Collection: "users", Prefix: "team-a:", Rights: []string{RightRead}}, "users", "team-a", RightRead, false},
+		{ACL{Collection: "users", Prefix: "", Rights: []string{RightRead}}, "users", "u1", RightWrite, false},
+		{ACL{Collection: "users", Prefix: "", Rights: []string{RightRead, RightDelete}}, "users", "u1", RightDelete, true},
+		{ACL{Collection: "users", Prefix: "", Rights: []string{AnyItem}}, "users", "u1", RightWrite, true},
+		{ACL{Collection: "users", Prefix: "", Rights: []string{}}, "users", "u1", RightRead, false},
+	}
+	for i, c := range cases {
+		if granted := c.acl.Grants(c.collection, c.key, c.right); granted != c.granted {
+			t.Fatalf("case %d: %v on %s/%s right %s granted %v", i, c.acl, c.collection, c.key, c.right, granted)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	if !Allowed(nil, "users", "u1", RightDelete) {
+		t.Fatal("an empty list must grant every right")
+	}
+	acls := []ACL{
+		{Collection: "users", Prefix: "team-a:", Rights: []string{RightRead, RightWrite}},
+		{Collection: "orders", Prefix: "", Rights: []string{RightRead}},
+	}
+	if !Allowed(acls, "users", "team-a:u1", RightWrite) {
+		t.Fatal("first entry must grant write")
+	}
+	if !Allowed(acls, "orders", "o1", RightRead) {
+		t.Fatal("second entry must grant read")
+	}
+	if Allowed(acls, "orders", "o1", RightWrite) {
+		t.Fatal("no entry grants write on orders")
+	}
+	if Allowed(acls, "users", "team-b:u1", RightRead) {
+		t.Fatal("no entry grants the prefix team-b:")
+	}
+	if Allowed(acls, "", "counter", RightRead) {
+		t.Fatal("no entry grants the counters")
+	}
+}
+
+func TestAllowedCounter(t *testing.T) {
+	if !AllowedCounter(nil, "counter", RightDelete) {
+		t.Fatal("an empty list must grant every right")
+	}
+	acls := []ACL{
+		{Collection: "users", Prefix: "team-a:", Rights: []string{RightRead, RightWrite}},
+		{Collection: "orders", Prefix: "orders:", Rights: []string{RightRead}},
+	}
+	if !AllowedCounter(acls, "team-a:visits", RightWrite) {
+		t.Fatal("the prefix of the first entry must grant write, whatever its collection")
+	}
+	if !AllowedCounter(acls, "orders:count", RightRead) {
+		t.Fatal("the prefix of the second entry must grant read")
+	}
+	if AllowedCounter(acls, "orders:count", RightWrite) {
+		t.Fatal("no entry grants write on the prefix orders:")
+	}
+	if AllowedCounter(acls, "team-b:visits", RightRead) {
+		t.Fatal("no entry grants the prefix team-b:")
+	}
+}
@@ -7,18 +7,121 @@ import (
 type Command struct {
 	OpCode string
 	Obj    *storage.MetaDataUpdObj
+	Batch  []*Command // the commands of a batch, applied in order
 }
 
 func (cmd Command) RpcCommand() *RpcCommand {
-	return &RpcCommand{OpCode: cmd.OpCode, Obj: cmd.Obj}
+	return &RpcCommand{OpCode: cmd.OpCode, Obj: cmd.Obj, Batch: cmd.Batch}
 }
 
 type RpcCommand struct {
 	Source string
 	OpCode string
 	Obj    *storage.MetaDataUpdObj
+	Batch  []*Command
 }
 
 func (rpccmd RpcCommand) Command() *Command {
-	return &Command{OpCode: rpccmd.OpCode, Obj: rpccmd.Obj}
+	return &Command{OpCode: rpccmd.OpCode, Obj: rpccmd.Obj, Batch: rpccmd.Batch}
+}
+
+// A client request forwarded to the node that owns the key.
+type RpcRequest struct {
+	Source      string
+	OpCode      string
+	Obj         *storage.MetaDataUpdObj
+	Consistency string
+	ACLs        []ACL // the access control lists of the API key of the client
+}
+
+// The result of a client request.
+type RpcResponse struct {
+	HttpStatus int
+	Status     string
+	Code       string
+	Obj        *storage.MetaDataUpdObj
+}
+
+func NewRpcResponse(httpStatus int, status string, code string, obj *storage.MetaDataUpdObj) *RpcResponse {
+	return &RpcResponse{HttpStatus: httpStatus, Status: status, Code: code, Obj: obj}
+}
+
+// A batch of client requests of the same kind forwarded to the node that owns the keys.
+type RpcBatchRequest struct {
+	Source      string
+	OpCode      string // get, put or delete
+	Objs        []*storage.MetaDataUpdObj
+	Consistency string
+	ACLs        []ACL // the access control lists of the API key of the client
+}
+
+// The results of a batch of client requests, in the order of the requests.
+type RpcBatchResponse struct {
+	Results []*RpcResponse
+}
+
+// The states of a distributed transaction reported by its coordinator.
+const (
+	TxPending   string = "pending"
+	TxCommitted string = "committed"
+	TxAborted   string = "aborted"
+)
+
+// A transaction forwarded to the node that owns its keys, or the part of a distributed transaction prepared by a participant.
+type RpcTxRequest struct {
+	Source      string
+	TxID        string // the id of a distributed transaction, empty for a transaction on a single node
+	Coordinator string // the node that coordinates the distributed transaction
+	Checks      []storage.TxCheck
+	Mutations   []storage.TxMutation
+	Consistency string
+	ACLs        []ACL // the access control lists of the API key of the client
+}
+
+// The result of a transaction, the results of the mutations are in the order of the mutations.
+type RpcTxResponse struct {
+	HttpStatus int
+	Status     string
+	Code       string
+	Results    []*storage.MetaDataUpdObj
+}
+
+// A key or counter of a hash slot compared by the anti-entropy process.
+type SlotEntry struct {
+	Key       string
+	Counter   bool
+	Version   uint64
+	Timestamp int64
+	Value     int64
+}
+
+// The request of a page of the data owned by a node, sent by a twin that is bootstrapping.
+// The items are ordered by key and the page starts after the key After.
+type SyncRequest struct {
+	Source   string
+	Counters bool
+	After    string
+	Limit    int
+}
+
+// A page of the data owned by a node.
+type SyncPage struct {
+	Objects []*storage.MetaDataUpdObj
+	Last    string
+	Done    bool
+}
+
+// The request of a page of a cursor-based scan of the keys of a node.
+type ScanRequest struct {
+	Cursor uint64
+	Count  int
+	Match  string
+	Owned  bool  // scan only the keys of the slots owned by the node
+	ACLs   []ACL // the access control lists of the API key of the client
+}
+
+// A page of a scan, the scan is complete when the cursor is 0.
+type ScanPage struct {
+	Cursor uint64
+	Keys   []string
 }
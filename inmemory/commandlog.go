@@ -0,0 +1,206 @@
+package inmemory
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maxzerbini/ovo/command"
+)
+
+const (
+	SyncAlways      = "always"
+	SyncEverySecond = "everysec"
+	SyncNever       = "never"
+)
+
+// CommandLog is an append-only log of the mutating commands executed on the storage.
+type CommandLog struct {
+	path       string
+	syncPolicy string
+	file       *os.File
+	dirty      bool
+	doneChan   chan bool
+	mux        sync.Mutex
+}
+
+// Open (or create) the command log at path using the given fsync policy.
+func NewCommandLog(path string, syncPolicy string) (*CommandLog, error) {
+	switch syncPolicy {
+	case "":
+		syncPolicy = SyncEverySecond
+	case SyncAlways, SyncEverySecond, SyncNever:
+	default:
+		return nil, errors.New("Unknown command log sync policy " + syncPolicy + ".")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cl := &CommandLog{path: path, syncPolicy: syncPolicy, file: file, doneChan: make(chan bool)}
+	if syncPolicy == SyncEverySecond {
+		go cl.syncLoop()
+	}
+	return cl, nil
+}
+
+// Append a command to the log.
+func (cl *CommandLog) Append(cmd *command.Command) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		log.Printf("Command log encoding error: %v\r\n", err)
+		return
+	}
+	data = append(data, '\n')
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	if _, err := cl.file.Write(data); err != nil {
+		log.Printf("Command log write error: %v\r\n", err)
+		return
+	}
+	switch cl.syncPolicy {
+	case SyncAlways:
+		cl.file.Sync()
+	case SyncEverySecond:
+		cl.dirty = true
+	}
+}
+
+// Replay all the commands stored in the log calling apply for each of them.
+// The commands moved aside by a failed snapshot are replayed first.
+func (cl *CommandLog) Replay(apply func(cmd *command.Command)) (count int, err error) {
+	if _, err := os.Stat(cl.oldPath()); err == nil {
+		if count, err = replayFile(cl.oldPath(), apply); err != nil {
+			return count, err
+		}
+	}
+	n, err := replayFile(cl.path, apply)
+	return count + n, err
+}
+
+// Move the logged commands aside, the log restarts empty.
+// The commands moved aside are kept until Discard is called.
+func (cl *CommandLog) Rotate() error {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	cl.file.Sync()
+	cl.file.Close()
+	var err error
+	if _, e := os.Stat(cl.oldPath()); e == nil {
+		// the commands of a failed snapshot are still there, append the new ones
+		err = appendFile(cl.oldPath(), cl.path)
+	} else {
+		err = os.Rename(cl.path, cl.oldPath())
+	}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if err == nil {
+		flag |= os.O_TRUNC
+	}
+	file, e := os.OpenFile(cl.path, flag, 0644)
+	if e != nil {
+		return e
+	}
+	cl.file = file
+	cl.dirty = false
+	return err
+}
+
+// Remove the commands moved aside by Rotate.
+func (cl *CommandLog) Discard() error {
+	return os.Remove(cl.oldPath())
+}
+
+// Path of the commands moved aside.
+func (cl *CommandLog) oldPath() string {
+	return cl.path + ".old"
+}
+
+// Append the content of the file src to the file dst.
+func appendFile(dst string, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	return err
+}
+
+// Replay the commands stored in the file at path.
+func replayFile(path string, apply func(cmd *command.Command)) (count int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Command log %s ends with a truncated command, ignored\r\n", path)
+			}
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		cmd := new(command.Command)
+		if err := json.Unmarshal(line, cmd); err != nil {
+			log.Printf("Command log %s contains a corrupted command, ignored: %v\r\n", path, err)
+			continue
+		}
+		if cmd.Obj != nil || len(cmd.Batch) > 0 {
+			apply(cmd)
+			count++
+		}
+	}
+}
+
+// Flush the pending writes to disk.
+func (cl *CommandLog) Sync() error {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	cl.dirty = false
+	return cl.file.Sync()
+}
+
+// Close the log.
+func (cl *CommandLog) Close() error {
+	if cl.syncPolicy == SyncEverySecond {
+		cl.doneChan <- true
+	}
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	cl.file.Sync()
+	return cl.file.Close()
+}
+
+// Sync the file every second if something was written.
+func (cl *CommandLog) syncLoop() {
+	tickChan := time.NewTicker(time.Second).C
+	for {
+		select {
+		case <-tickChan:
+			cl.mux.Lock()
+			if cl.dirty {
+				cl.dirty = false
+				cl.file.Sync()
+			}
+			cl.mux.Unlock()
+		case <-cl.doneChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package inmemory
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+func TestCommandLogReplay(t *testing.T) {
+	t.Log("TestCommandLogReplay started")
+	path := filepath.Join(t.TempDir(), "ovo.log")
+	ks := NewInMemoryStorage()
+	if err := ks.OpenCommandLog(path, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	var data = storage.NewMetaDataObj("test", []byte("test string"), "default", 0, 1)
+	ks.Put(&data)
+	var removed = storage.NewMetaDataObj("removed", []byte("test string"), "default", 0, 1)
+	ks.Put(&removed)
+	ks.Delete("removed")
+	ks.UpdateKey(&storage.MetaDataUpdObj{Key: "test", NewKey: "renamed", NewHash: 2})
+	ks.Increment(&storage.MetaDataCounter{Key: "counter", Value: 5})
+	ks.Increment(&storage.MetaDataCounter{Key: "counter", Value: 3})
+	ks.CloseCommandLog()
+
+	restored := NewInMemoryStorage()
+	if err := restored.OpenCommandLog(path, SyncNever); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.CloseCommandLog()
+	if _, err := restored.Get("renamed"); err != nil {
+		t.Fatal("key renamed not restored")
+	}
+	if _, err := restored.Get("removed"); err == nil {
+		t.Fatal("key removed was restored")
+	}
+	if c, err := restored.GetCounter("counter"); err != nil || c.Value != 8 {
+		t.Fatal("counter not restored")
+	}
+}
+
+func TestCommandLogStaleCopy(t *testing.T) {
+	t.Log("TestCommandLogStaleCopy started")
+	path := filepath.Join(t.TempDir(), "ovo.log")
+	ks := NewInMemoryStorage()
+	if err := ks.OpenCommandLog(path, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	ks.Put(&storage.MetaDataObj{Key: "test", Data: []byte("new"), Version: 5, Timestamp: 5})
+	if err := ks.Put(&storage.MetaDataObj{Key: "test", Data: []byte("old"), Version: 3, Timestamp: 3, TTL: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ks.CloseCommandLog()
+	if obj, _ := ks.Get("test"); string(obj.Data) != "new" || obj.TTL != 0 {
+		t.Fatal("the stale copy has been stored")
+	}
+	cl, err := NewCommandLog(path, SyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	count, err := cl.Replay(func(cmd *command.Command) {})
+	if err != nil || count != 1 {
+		t.Fatalf("%d commands logged, the stale copy must not be logged", count)
+	}
+}
+
+func TestCommandLogReplayTransaction(t *testing.T) {
+	t.Log("TestCommandLogReplayTransaction started")
+	path := filepath.Join(t.TempDir(), "ovo.log")
+	ks := NewInMemoryStorage()
+	if err := ks.OpenCommandLog(path, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	var removed = storage.NewMetaDataObj("removed", []byte("test string"), "default", 0, 1)
+	ks.Put(&removed)
+	mutations := []storage.TxMutation{
+		{Op: storage.TxPut, Obj: &storage.MetaDataUpdObj{Key: "tx", Data: []byte("tx value")}},
+		{Op: storage.TxDelete, Obj: &storage.MetaDataUpdObj{Key: "removed"}},
+		{Op: storage.TxIncrement, Obj: &storage.MetaDataUpdObj{Key: "counter", Value: 4}},
+	}
+	if _, err := ks.Transaction(nil, mutations, nil); err != nil {
+		t.Fatal(err)
+	}
+	ks.CloseCommandLog()
+
+	restored := NewInMemoryStorage()
+	if err := restored.OpenCommandLog(path, SyncNever); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.CloseCommandLog()
+	if res, err := restored.Get("tx"); err != nil || string(res.Data) != "tx value" {
+		t.Fatal("key of the transaction not restored")
+	}
+	if _, err := restored.Get("removed"); err == nil {
+		t.Fatal("key removed by the transaction was restored")
+	}
+	if c, err := restored.GetCounter("counter"); err != nil || c.Value != 4 {
+		t.Fatal("counter of the transaction not restored")
+	}
+}
+
+func TestCommandLogReplayExpired(t *testing.T) {
+	t.Log("TestCommandLogReplayExpired started")
+	path := filepath.Join(t.TempDir(), "ovo.log")
+	ks := NewInMemoryStorage()
+	if err := ks.OpenCommandLog(path, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	var data = storage.NewMetaDataObj("expiring", []byte("test string"), "default", 1, 1)
+	ks.Put(&data)
+	ks.CloseCommandLog()
+	time.Sleep(1100 * time.Millisecond)
+
+	restored := NewInMemoryStorage()
+	if err := restored.OpenCommandLog(path, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.CloseCommandLog()
+	if restored.Count() != 0 {
+		t.Fatal("expired key was restored")
+	}
+}
+
+func TestCommandLogTruncated(t *testing.T) {
+	t.Log("TestCommandLogTruncated started")
+	path := filepath.Join(t.TempDir(), "ovo.log")
+	content := "{\"OpCode\":\"put\",\"Obj\":{\"Key\":\"test\",\"Data\":\"dGVzdA==\"}}\n{\"OpCode\":\"put\",\"Obj\":{\"Ke"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ks := NewInMemoryStorage()
+	if err := ks.OpenCommandLog(path, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	defer ks.CloseCommandLog()
+	if ks.Count() != 1 {
+		t.Fatal("Incorrect count after replay")
+	}
+}
+
+func TestCommandLogConcurrentWrites(t *testing.T) {
+	t.Log("TestCommandLogConcurrentWrites started")
+	path := filepath.Join(t.TempDir(), "ovo.log")
+	ks := NewInMemoryStorage()
+	if err := ks.OpenCommandLog(path, SyncNever); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var data = storage.NewMetaDataObj("test", []byte(strconv.Itoa(i)), "default", 0, 1)
+			data.Timestamp = int64(i + 1)
+			ks.Put(&data)
+		}(i)
+	}
+	wg.Wait()
+	ks.CloseCommandLog()
+	expected, _ := ks.Get("test")
+
+	restored := NewInMemoryStorage()
+	if err := restored.OpenCommandLog(path, SyncNever); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.CloseCommandLog()
+	obj, err := restored.Get("test")
+	if err != nil || string(obj.Data) != string(expected.Data) || obj.Version != expected.Version {
+		t.Fatal("the replay restored a different value")
+	}
+}
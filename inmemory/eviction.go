@@ -0,0 +1,148 @@
+package inmemory
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxzerbini/ovo/storage"
+)
+
+const (
+	AllKeysLRU  = "allkeys-lru"
+	AllKeysLFU  = "allkeys-lfu"
+	VolatileTTL = "volatile-ttl"
+	NoEviction  = "noeviction"
+
+	evictionSamples = 5
+)
+
+// Access statistics of an item used by the eviction policies.
+type accessStats struct {
+	lastAccess int64 // unix nanoseconds
+	hits       int64
+}
+
+// Create the access statistics of a new item.
+func newAccessStats() *accessStats {
+	return &accessStats{lastAccess: time.Now().UnixNano(), hits: 1}
+}
+
+// Register an access to the item. It can be called holding the read lock.
+func (st *accessStats) hit() {
+	atomic.StoreInt64(&st.lastAccess, time.Now().UnixNano())
+	atomic.AddInt64(&st.hits, 1)
+}
+
+// Check the eviction policy name.
+func validEvictionPolicy(policy string) error {
+	switch policy {
+	case AllKeysLRU, AllKeysLFU, VolatileTTL, NoEviction:
+		return nil
+	}
+	return errors.New("Unknown eviction policy " + policy + ".")
+}
+
+// Accounted memory of an item.
+func objSize(obj *storage.MetaDataObj) int64 {
+	return int64(len(obj.Key) + len(obj.Data))
+}
+
+// Remove items until size bytes can be added without exceeding the memory limit.
+// The items with the excluded keys and the items of the prepared transactions are never evicted,
+// the memory reserved by the prepared transactions is not available. If the space can't be freed nothing is evicted.
+// It must be called holding the lock.
+func (coll *InMemoryMutexCollection) reserve(size int64, exclude ...string) (evicted []*storage.MetaDataObj, err error) {
+	evicted = make([]*storage.MetaDataObj, 0)
+	if coll.maxBytes <= 0 || coll.usedBytes+coll.reserved+size <= coll.maxBytes {
+		return evicted, nil
+	}
+	if coll.policy == NoEviction {
+		return evicted, storage.ErrOutOfMemory
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, key := range exclude {
+		excluded[key] = true
+	}
+	if coll.usedBytes+coll.reserved-coll.evictableBytes(excluded)+size > coll.maxBytes {
+		return evicted, storage.ErrOutOfMemory
+	}
+	for coll.usedBytes+coll.reserved+size > coll.maxBytes {
+		key, ok := coll.evictionCandidate(excluded)
+		if !ok {
+			return evicted, storage.ErrOutOfMemory
+		}
+		obj, _ := coll.remove(key)
+		evicted = append(evicted, obj)
+	}
+	return evicted, nil
+}
+
+// Get the memory of the items that the policy can evict. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) evictableBytes(excluded map[string]bool) int64 {
+	volatileOnly := coll.policy == VolatileTTL
+	size := coll.usedBytes
+	if volatileOnly {
+		size = coll.volatileMem
+	}
+	protect := func(key string) {
+		if obj, ok := coll.storage[key]; ok && (!volatileOnly || coll.volatile[key]) {
+			size -= objSize(obj)
+		}
+	}
+	for key := range excluded {
+		if coll.pinned[key] == 0 {
+			protect(key)
+		}
+	}
+	for key := range coll.pinned {
+		protect(key)
+	}
+	return size
+}
+
+// Choose the item to evict sampling some items of the collection (maps are iterated in random order).
+// The volatile-ttl policy samples only the items with a TTL.
+func (coll *InMemoryMutexCollection) evictionCandidate(excluded map[string]bool) (string, bool) {
+	var candidate *storage.MetaDataObj
+	var best int64
+	samples := 0
+	sample := func(key string) bool {
+		if excluded[key] || coll.pinned[key] > 0 {
+			return false
+		}
+		obj := coll.storage[key]
+		var score int64
+		switch coll.policy {
+		case AllKeysLRU:
+			score = atomic.LoadInt64(&coll.stats[key].lastAccess)
+		case AllKeysLFU:
+			score = atomic.LoadInt64(&coll.stats[key].hits)
+		case VolatileTTL:
+			score = obj.CreationDate.Add(time.Duration(obj.TTL) * time.Second).UnixNano()
+		}
+		if candidate == nil || score < best {
+			candidate = obj
+			best = score
+		}
+		samples++
+		return samples >= evictionSamples
+	}
+	if coll.policy == VolatileTTL {
+		for key := range coll.volatile {
+			if sample(key) {
+				break
+			}
+		}
+	} else {
+		for key := range coll.storage {
+			if sample(key) {
+				break
+			}
+		}
+	}
+	if candidate == nil {
+		return "", false
+	}
+	return candidate.Key, true
+}
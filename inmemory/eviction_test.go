@@ -0,0 +1,204 @@
+package inmemory
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/maxzerbini/ovo/storage"
+)
+
+func TestNoEviction(t *testing.T) {
+	t.Log("TestNoEviction started")
+	coll := NewMutexCollection()
+	coll.SetMemoryLimit(100, NoEviction)
+	var data = storage.NewMetaDataObj("key1", make([]byte, 60), "default", 0, 1)
+	if err := coll.Put(&data); err != nil {
+		t.Fatal(err)
+	}
+	var data2 = storage.NewMetaDataObj("key2", make([]byte, 60), "default", 0, 1)
+	if err := coll.Put(&data2); err != storage.ErrOutOfMemory {
+		t.Fatal("write accepted over the memory limit")
+	}
+	if coll.UsedMemory() != 64 {
+		t.Fatal("Incorrect used memory " + strconv.FormatInt(coll.UsedMemory(), 10))
+	}
+}
+
+func TestEvictionLRU(t *testing.T) {
+	t.Log("TestEvictionLRU started")
+	coll := NewMutexCollection()
+	coll.SetMemoryLimit(300, AllKeysLRU)
+	evicted := make([]string, 0)
+	coll.SetEvictionListener(func(objs []*storage.MetaDataObj) {
+		for _, obj := range objs {
+			evicted = append(evicted, obj.Key)
+		}
+	})
+	for i := 0; i < 10; i++ {
+		var data = storage.NewMetaDataObj("key"+strconv.Itoa(i), make([]byte, 96), "default", 0, 1)
+		if err := coll.Put(&data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if coll.Count() != 3 || len(evicted) != 7 {
+		t.Fatal("Incorrect count " + strconv.Itoa(coll.Count()))
+	}
+	if coll.UsedMemory() > 300 {
+		t.Fatal("memory limit exceeded")
+	}
+	if _, ok := coll.Get("key9"); !ok {
+		t.Fatal("last key evicted")
+	}
+}
+
+func TestEvictionVolatileTTL(t *testing.T) {
+	t.Log("TestEvictionVolatileTTL started")
+	coll := NewMutexCollection()
+	coll.SetMemoryLimit(200, VolatileTTL)
+	var persistent = storage.NewMetaDataObj("persistent", make([]byte, 90), "default", 0, 1)
+	coll.Put(&persistent)
+	var volatile = storage.NewMetaDataObj("volatile", make([]byte, 90), "default", 60, 1)
+	coll.Put(&volatile)
+	var data = storage.NewMetaDataObj("new", make([]byte, 90), "default", 0, 1)
+	if err := coll.Put(&data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := coll.Get("volatile"); ok {
+		t.Fatal("volatile key not evicted")
+	}
+	var other = storage.NewMetaDataObj("other", make([]byte, 90), "default", 0, 1)
+	if err := coll.Put(&other); err != storage.ErrOutOfMemory {
+		t.Fatal("persistent key evicted")
+	}
+	// the index of the items with a TTL follows the changes of the items
+	coll.Put(&storage.MetaDataObj{Key: "persistent", Data: make([]byte, 10), TTL: 60})
+	if len(coll.volatile) != 1 || coll.volatileMem != objSize(&storage.MetaDataObj{Key: "persistent", Data: make([]byte, 10)}) {
+		t.Fatalf("volatile index has %d keys and %d bytes", len(coll.volatile), coll.volatileMem)
+	}
+	coll.Delete("persistent")
+	if len(coll.volatile) != 0 || coll.volatileMem != 0 {
+		t.Fatalf("volatile index has %d keys and %d bytes after the delete", len(coll.volatile), coll.volatileMem)
+	}
+}
+
+func TestNoEvictionUpdate(t *testing.T) {
+	t.Log("TestNoEvictionUpdate started")
+	coll := NewMutexCollection()
+	coll.SetMemoryLimit(100, NoEviction)
+	var data = storage.NewMetaDataObj("key1", make([]byte, 60), "default", 0, 1)
+	coll.Put(&data)
+	upd := &storage.MetaDataUpdObj{Key: "key1", Data: make([]byte, 60), NewData: make([]byte, 120)}
+	if _, err := coll.UpdateValueIfEqual(upd); err != storage.ErrOutOfMemory {
+		t.Fatal("update accepted over the memory limit")
+	}
+	upd = &storage.MetaDataUpdObj{Key: "key1", NewData: make([]byte, 120), Version: 1}
+	if _, err := coll.UpdateValueIfVersion(upd); err != storage.ErrOutOfMemory {
+		t.Fatal("versioned update accepted over the memory limit")
+	}
+	upd = &storage.MetaDataUpdObj{Key: "key1", NewKey: "key2", Data: make([]byte, 60), NewData: make([]byte, 120)}
+	if _, err := coll.UpdateKeyAndValueIfEqual(upd); err != storage.ErrOutOfMemory {
+		t.Fatal("key update accepted over the memory limit")
+	}
+	if res, ok := coll.Get("key1"); !ok || len(res.Data) != 60 || coll.UsedMemory() != 64 {
+		t.Fatal("item changed by a refused update")
+	}
+}
+
+func TestEvictionTransaction(t *testing.T) {
+	t.Log("TestEvictionTransaction started")
+	coll := NewMutexCollection()
+	coll.SetMemoryLimit(300, AllKeysLRU)
+	for _, key := range []string{"a", "b", "c"} {
+		var data = storage.NewMetaDataObj(key, make([]byte, 96), "default", 0, 1)
+		coll.Put(&data)
+	}
+	mutations := []storage.TxMutation{
+		{Op: storage.TxPut, Obj: &storage.MetaDataUpdObj{Key: "a", Data: make([]byte, 146)}},
+		{Op: storage.TxPut, Obj: &storage.MetaDataUpdObj{Key: "d", Data: make([]byte, 96)}},
+	}
+	if _, err := coll.Transaction(nil, mutations, nil); err != nil {
+		t.Fatal(err)
+	}
+	if res, ok := coll.Get("a"); !ok || len(res.Data) != 146 {
+		t.Fatal("key of the transaction evicted")
+	}
+	if _, ok := coll.Get("d"); !ok || coll.Count() != 2 || coll.UsedMemory() > 300 {
+		t.Fatal("Incorrect count " + strconv.Itoa(coll.Count()))
+	}
+}
+
+func TestEvictionNothingOnFailure(t *testing.T) {
+	t.Log("TestEvictionNothingOnFailure started")
+	coll := NewMutexCollection()
+	coll.SetMemoryLimit(300, AllKeysLRU)
+	evicted := make([]string, 0)
+	coll.SetEvictionListener(func(objs []*storage.MetaDataObj) {
+		for _, obj := range objs {
+			evicted = append(evicted, obj.Key)
+		}
+	})
+	for _, key := range []string{"a", "b", "c"} {
+		var data = storage.NewMetaDataObj(key, make([]byte, 96), "default", 0, 1)
+		coll.Put(&data)
+	}
+	// the transaction can't fit even evicting the other keys
+	mutations := []storage.TxMutation{{Op: storage.TxPut, Obj: &storage.MetaDataUpdObj{Key: "a", Data: make([]byte, 400)}}}
+	if _, err := coll.Transaction(nil, mutations, nil); err != storage.ErrOutOfMemory {
+		t.Fatal("transaction accepted over the memory limit")
+	}
+	if coll.Count() != 3 || len(evicted) != 0 {
+		t.Fatal("keys evicted by a refused transaction")
+	}
+	// only the volatile key can be evicted and it is not enough
+	coll = NewMutexCollection()
+	coll.SetMemoryLimit(200, VolatileTTL)
+	var persistent = storage.NewMetaDataObj("persistent", make([]byte, 90), "default", 0, 1)
+	coll.Put(&persistent)
+	var volatile = storage.NewMetaDataObj("volatile", make([]byte, 90), "default", 60, 1)
+	coll.Put(&volatile)
+	var data = storage.NewMetaDataObj("new", make([]byte, 150), "default", 0, 1)
+	if err := coll.Put(&data); err != storage.ErrOutOfMemory {
+		t.Fatal("write accepted over the memory limit")
+	}
+	if _, ok := coll.Get("volatile"); !ok {
+		t.Fatal("volatile key evicted by a refused write")
+	}
+}
+
+func TestEvictionReservation(t *testing.T) {
+	t.Log("TestEvictionReservation started")
+	coll := NewMutexCollection()
+	coll.SetMemoryLimit(300, AllKeysLRU)
+	for _, key := range []string{"a", "b"} {
+		var data = storage.NewMetaDataObj(key, make([]byte, 96), "default", 0, 1)
+		coll.Put(&data)
+	}
+	mutations := []storage.TxMutation{{Op: storage.TxPut, Obj: &storage.MetaDataUpdObj{Key: "a", Data: make([]byte, 146)}}}
+	reservation, err := coll.Reserve([]string{"a"}, mutations)
+	if err != nil || reservation.Size != 50 {
+		t.Fatal("memory not reserved")
+	}
+	// the reserved memory and the locked key are not available to the other writes
+	var data = storage.NewMetaDataObj("c", make([]byte, 96), "default", 0, 1)
+	if err := coll.Put(&data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := coll.Get("a"); !ok {
+		t.Fatal("locked key evicted")
+	}
+	if _, ok := coll.Get("b"); ok || coll.UsedMemory()+50 > 300 {
+		t.Fatal("reserved memory used by another write")
+	}
+	if ok, _ := coll.PutIfOutdated(&storage.MetaDataObj{Key: "a", Data: []byte("repair"), Version: 10}); ok {
+		t.Fatal("locked key repaired")
+	}
+	if coll.DropCollection("default") != 1 {
+		t.Fatal("locked key dropped")
+	}
+	if _, err := coll.Transaction(nil, mutations, reservation); err != nil {
+		t.Fatal(err)
+	}
+	if res, ok := coll.Get("a"); !ok || len(res.Data) != 146 || coll.reserved != 0 || len(coll.pinned) != 0 {
+		t.Fatal("reservation not used by the transaction")
+	}
+}
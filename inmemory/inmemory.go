@@ -5,15 +5,24 @@ package inmemory
 
 import (
 	"errors"
+	"log"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/maxzerbini/ovo/command"
 	"github.com/maxzerbini/ovo/storage"
 )
 
 // The InMemoryStorage struct implements the OvoStorage interface.
 type InMemoryStorage struct {
-	collection *InMemoryMutexCollection
-	cleaner    *Cleaner
+	collection       *InMemoryMutexCollection
+	cleaner          *Cleaner
+	commandLog       *CommandLog
+	snapshotPath     string
+	snapshotMux      sync.Mutex
+	writeMux         sync.Mutex // orders the changes of the collection and their commands in the log
+	evictionListener func(evicted []*storage.MetaDataObj)
 }
 
 // Create a InMemoryStorage.
@@ -21,27 +30,242 @@ func NewInMemoryStorage() *InMemoryStorage {
 	ks := new(InMemoryStorage)
 	ks.collection = NewMutexCollection()
 	ks.cleaner = NewCleaner(ks, 60)
+	ks.collection.SetEvictionListener(ks.evicted)
 	return ks
 }
 
+// Set the memory limit in bytes (0 means no limit) and the eviction policy applied when the limit is reached.
+func (ks *InMemoryStorage) SetMemoryLimit(maxBytes int64, policy string) error {
+	if len(policy) == 0 {
+		policy = NoEviction
+	}
+	return ks.collection.SetMemoryLimit(maxBytes, policy)
+}
+
+// Set the function called with the evicted items.
+func (ks *InMemoryStorage) SetEvictionListener(listener func(evicted []*storage.MetaDataObj)) {
+	ks.evictionListener = listener
+}
+
+// Get the accounted memory used by the items.
+func (ks *InMemoryStorage) UsedMemory() int64 {
+	return ks.collection.UsedMemory()
+}
+
+// Log the evicted items and notify them to the listener.
+func (ks *InMemoryStorage) evicted(objs []*storage.MetaDataObj) {
+	for _, obj := range objs {
+		ks.record("delete", &storage.MetaDataUpdObj{Key: obj.Key, Hash: obj.Hash})
+	}
+	if ks.evictionListener != nil {
+		ks.evictionListener(objs)
+	}
+}
+
+// Open the append-only command log replaying the commands already stored in it.
+func (ks *InMemoryStorage) OpenCommandLog(path string, syncPolicy string) error {
+	cl, err := NewCommandLog(path, syncPolicy)
+	if err != nil {
+		return err
+	}
+	count, err := cl.Replay(ks.replay)
+	if err != nil {
+		cl.Close()
+		return err
+	}
+	log.Printf("Command log %s replayed: %d commands\r\n", path, count)
+	ks.commandLog = cl
+	return nil
+}
+
+// Load the snapshot file at path if it exists. The path is used by Snapshot to write new snapshots.
+func (ks *InMemoryStorage) LoadSnapshot(path string) error {
+	ks.snapshotPath = path
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	data, err := readSnapshot(path)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for i := range data.Objects {
+		obj := &data.Objects[i]
+		if !obj.IsExpired() {
+			if err := ks.collection.Put(obj); err == nil && obj.TTL > 0 {
+				go ks.cleaner.AddElement(obj)
+			}
+			count++
+		}
+	}
+	for i := range data.Counters {
+		counter := &data.Counters[i]
+		if !counter.IsExpired() {
+			ks.collection.PutCounter(counter)
+		}
+	}
+	log.Printf("Snapshot %s loaded: %d objects and %d counters\r\n", path, count, len(data.Counters))
+	return nil
+}
+
+// Write a point-in-time snapshot of the storage and truncate the command log.
+// Writers are blocked only while the collection is copied.
+func (ks *InMemoryStorage) Snapshot() error {
+	if ks.snapshotPath == "" {
+		return errors.New("Snapshot path is not configured.")
+	}
+	ks.snapshotMux.Lock()
+	defer ks.snapshotMux.Unlock()
+	// commands logged after the rotation are replayed over the snapshot
+	ks.writeMux.Lock()
+	if ks.commandLog != nil {
+		if err := ks.commandLog.Rotate(); err != nil {
+			ks.writeMux.Unlock()
+			return err
+		}
+	}
+	objects, counters := ks.collection.Snapshot()
+	ks.writeMux.Unlock()
+	if err := writeSnapshot(ks.snapshotPath, objects, counters); err != nil {
+		log.Printf("Snapshot write error at %s: %v\r\n", ks.snapshotPath, err)
+		return err
+	}
+	if ks.commandLog != nil {
+		ks.commandLog.Discard()
+	}
+	log.Printf("Snapshot %s written: %d objects and %d counters\r\n", ks.snapshotPath, len(objects), len(counters))
+	return nil
+}
+
+// Close the command log if it is open.
+func (ks *InMemoryStorage) CloseCommandLog() {
+	if ks.commandLog != nil {
+		ks.commandLog.Close()
+		ks.commandLog = nil
+	}
+}
+
+// Append a command to the command log if it is open. It must be called holding the write lock,
+// so the commands are logged in the order the changes are applied.
+func (ks *InMemoryStorage) record(opcode string, obj *storage.MetaDataUpdObj) {
+	if ks.commandLog != nil {
+		ks.commandLog.Append(&command.Command{OpCode: opcode, Obj: obj})
+	}
+}
+
+// Apply a logged command to the collection. Objects that are already expired are not restored.
+func (ks *InMemoryStorage) replay(cmd *command.Command) {
+	obj := cmd.Obj
+	switch cmd.OpCode {
+	case "put":
+		item := obj.MetaDataObj()
+		item.CreationDate = obj.CreationDate
+		if item.IsExpired() {
+			ks.collection.Delete(item.Key)
+		} else {
+			if err := ks.collection.Put(item); err == nil && item.TTL > 0 {
+				go ks.cleaner.AddElement(item)
+			}
+		}
+	case "delete", "deletevalueifequal":
+		ks.collection.Delete(obj.Key)
+	case "touch":
+		ks.collection.Touch(obj.Key, obj.CreationDate)
+	case "updatevalue":
+		ks.collection.UpdateValueIfEqual(obj)
+	case "updatevalueifversion":
+		ks.collection.UpdateValueIfVersion(obj)
+	case "updatekey":
+		ks.collection.UpdateKey(obj)
+	case "updatekeyvalue":
+		ks.collection.UpdateKeyAndValueIfEqual(obj)
+	case "setcounter":
+		counter := obj.MetaDataCounter()
+		if counter.IsExpired() {
+			ks.collection.DeleteCounter(counter.Key)
+		} else {
+			ks.collection.PutCounter(counter)
+		}
+	case "deletecounter":
+		ks.collection.DeleteCounter(obj.Key)
+	case "dropcollection":
+		ks.collection.DropCollection(obj.Collection)
+	case "batch":
+		for _, c := range cmd.Batch {
+			ks.replay(c)
+		}
+	default:
+		log.Printf("Command log contains an unsupported command: %s\r\n", cmd.OpCode)
+	}
+}
+
 // Add an item to the storage.
 func (ks *InMemoryStorage) Put(obj *storage.MetaDataObj) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
 	if obj != nil {
 		if len(obj.Key) == 0 {
 			return errors.New("Object key is null.")
 		}
 		if len(obj.Collection) == 0 {
-			obj.Collection = "default"
+			obj.Collection = storage.DefaultCollection
 		}
 		obj.CreationDate = time.Now()
-		ks.collection.Put(obj)
+		if obj.Timestamp == 0 {
+			obj.Timestamp = obj.CreationDate.UnixNano()
+		}
+		if err := ks.collection.Put(obj); err == errOutdated {
+			// a stale replicated copy is ignored
+			return nil
+		} else if err != nil {
+			return err
+		}
 		if obj.TTL > 0 {
 			go ks.cleaner.AddElement(obj)
 		}
+		ks.record("put", obj.MetaDataUpdObj())
+		return nil
 	}
 	return errors.New("Object is null.")
 }
 
+// Replace an item with a newer copy only if the stored item still exists and it is outdated by the copy.
+// The copy keeps the creation date of its source, so the repair does not extend its TTL.
+func (ks *InMemoryStorage) PutIfOutdated(obj *storage.MetaDataObj) error {
+	if obj == nil || len(obj.Key) == 0 {
+		return errors.New("Object key is null.")
+	}
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	if len(obj.Collection) == 0 {
+		obj.Collection = storage.DefaultCollection
+	}
+	if obj.CreationDate.IsZero() {
+		obj.CreationDate = time.Now()
+	}
+	if ok, err := ks.collection.PutIfOutdated(obj); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("Object is not outdated.")
+	}
+	if obj.TTL > 0 {
+		go ks.cleaner.AddElement(obj)
+	}
+	ks.record("put", obj.MetaDataUpdObj())
+	return nil
+}
+
+// Remove the item only if it is outdated by the copy, a newer item is kept.
+func (ks *InMemoryStorage) DeleteIfOutdated(obj *storage.MetaDataObj) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	if ks.collection.DeleteIfOutdated(obj) {
+		ks.record("delete", &storage.MetaDataUpdObj{Key: obj.Key})
+		return nil
+	}
+	return errors.New("Object is not outdated.")
+}
+
 // Get an item from the storage by key.
 func (ks *InMemoryStorage) Get(key string) (*storage.MetaDataObj, error) {
 	if obj, ok := ks.collection.Get(key); ok {
@@ -55,7 +279,10 @@ func (ks *InMemoryStorage) Get(key string) (*storage.MetaDataObj, error) {
 
 // Remove the item of the storage
 func (ks *InMemoryStorage) Delete(key string) {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
 	ks.collection.Delete(key)
+	ks.record("delete", &storage.MetaDataUpdObj{Key: key})
 }
 
 // Remove the item of the storage
@@ -65,7 +292,10 @@ func (ks *InMemoryStorage) DeleteExpired(key string) {
 
 // Get an item and remove it from the storage in a single operation.
 func (ks *InMemoryStorage) GetAndRemove(key string) (*storage.MetaDataObj, error) {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
 	if obj, ok := ks.collection.GetAndRemove(key); ok {
+		ks.record("delete", &storage.MetaDataUpdObj{Key: key})
 		if obj.IsExpired() {
 			return nil, errors.New("Not found.")
 		}
@@ -76,15 +306,23 @@ func (ks *InMemoryStorage) GetAndRemove(key string) (*storage.MetaDataObj, error
 
 // Update an item if the value is not changed.
 func (ks *InMemoryStorage) UpdateValueIfEqual(obj *storage.MetaDataUpdObj) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
 	if obj != nil {
 		if len(obj.Key) == 0 {
 			return errors.New("Object key is null.")
 		}
 		if len(obj.Collection) == 0 {
-			obj.Collection = "default"
+			obj.Collection = storage.DefaultCollection
 		}
 		obj.CreationDate = time.Now()
-		if ks.collection.UpdateValueIfEqual(obj) {
+		if obj.Timestamp == 0 {
+			obj.Timestamp = obj.CreationDate.UnixNano()
+		}
+		if ok, err := ks.collection.UpdateValueIfEqual(obj); err != nil {
+			return err
+		} else if ok {
+			ks.record("updatevalue", obj)
 			return nil
 		} else {
 			return errors.New("Objects are not equal.")
@@ -95,6 +333,8 @@ func (ks *InMemoryStorage) UpdateValueIfEqual(obj *storage.MetaDataUpdObj) error
 
 // Update an item (key and value) if the value is not changed.
 func (ks *InMemoryStorage) UpdateKeyAndValueIfEqual(obj *storage.MetaDataUpdObj) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
 	if obj != nil {
 		if len(obj.Key) == 0 {
 			return errors.New("Object key is null.")
@@ -103,10 +343,16 @@ func (ks *InMemoryStorage) UpdateKeyAndValueIfEqual(obj *storage.MetaDataUpdObj)
 			return errors.New("Object new key is null.")
 		}
 		if len(obj.Collection) == 0 {
-			obj.Collection = "default"
+			obj.Collection = storage.DefaultCollection
 		}
 		obj.CreationDate = time.Now()
-		if ks.collection.UpdateKeyAndValueIfEqual(obj) {
+		if obj.Timestamp == 0 {
+			obj.Timestamp = obj.CreationDate.UnixNano()
+		}
+		if ok, err := ks.collection.UpdateKeyAndValueIfEqual(obj); err != nil {
+			return err
+		} else if ok {
+			ks.record("updatekeyvalue", obj)
 			return nil
 		} else {
 			return errors.New("Objects are not equal.")
@@ -117,6 +363,8 @@ func (ks *InMemoryStorage) UpdateKeyAndValueIfEqual(obj *storage.MetaDataUpdObj)
 
 // Change the key of an item.
 func (ks *InMemoryStorage) UpdateKey(obj *storage.MetaDataUpdObj) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
 	if obj != nil {
 		if len(obj.Key) == 0 {
 			return errors.New("Object key is null.")
@@ -125,10 +373,14 @@ func (ks *InMemoryStorage) UpdateKey(obj *storage.MetaDataUpdObj) error {
 			return errors.New("Object new key is null.")
 		}
 		if len(obj.Collection) == 0 {
-			obj.Collection = "default"
+			obj.Collection = storage.DefaultCollection
 		}
 		obj.CreationDate = time.Now()
+		if obj.Timestamp == 0 {
+			obj.Timestamp = obj.CreationDate.UnixNano()
+		}
 		ks.collection.UpdateKey(obj)
+		ks.record("updatekey", obj)
 		return nil
 	}
 	return errors.New("Object is null.")
@@ -136,7 +388,11 @@ func (ks *InMemoryStorage) UpdateKey(obj *storage.MetaDataUpdObj) error {
 
 // Touch an item restarting the time to live.
 func (ks *InMemoryStorage) Touch(key string) {
-	ks.collection.Touch(key, time.Now())
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	now := time.Now()
+	ks.collection.Touch(key, now)
+	ks.record("touch", &storage.MetaDataUpdObj{Key: key, CreationDate: now})
 }
 
 // Count the keys in the storage.
@@ -161,12 +417,32 @@ func (ks *InMemoryStorage) ListExpired() (elements []*storage.MetaDataObj) {
 
 // Increment a counter.
 func (ks *InMemoryStorage) Increment(c *storage.MetaDataCounter) *storage.MetaDataCounter {
-	return ks.collection.Increment(c)
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	ret := ks.collection.Increment(c)
+	ks.record("setcounter", ret.MetaDataUpdObj())
+	return ret
 }
 
 // Set the value of a counter.
 func (ks *InMemoryStorage) SetCounter(c *storage.MetaDataCounter) *storage.MetaDataCounter {
-	return ks.collection.SetCounter(c)
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	ret := ks.collection.SetCounter(c)
+	ks.record("setcounter", ret.MetaDataUpdObj())
+	return ret
+}
+
+// Set the counter only if it does not exist or it is expired, an existing counter is never overwritten.
+func (ks *InMemoryStorage) SetCounterIfAbsent(c *storage.MetaDataCounter) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	if old, ok := ks.collection.GetCounter(c.Key); ok && !old.IsExpired() {
+		return errors.New("Counter exists.")
+	}
+	ret := ks.collection.SetCounter(c)
+	ks.record("setcounter", ret.MetaDataUpdObj())
+	return nil
 }
 
 // Get a counter by key.
@@ -182,7 +458,10 @@ func (ks *InMemoryStorage) GetCounter(key string) (*storage.MetaDataCounter, err
 
 // Remove the item of the collection
 func (ks *InMemoryStorage) DeleteCounter(key string) {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
 	ks.collection.DeleteCounter(key)
+	ks.record("deletecounter", &storage.MetaDataUpdObj{Key: key})
 }
 
 // List the items in the collection
@@ -192,9 +471,163 @@ func (ks *InMemoryStorage) ListCounters() []*storage.MetaDataCounter {
 
 // Delete an item if the value is not changed.
 func (ks *InMemoryStorage) DeleteValueIfEqual(obj *storage.MetaDataObj) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
 	if ks.collection.DeleteValueIfEqual(obj) {
+		ks.record("deletevalueifequal", &storage.MetaDataUpdObj{Key: obj.Key})
 		return nil
 	} else {
 		return errors.New("Values are not equal.")
 	}
 }
+
+// Update the value of an item if its version is the expected version (obj.Version).
+// On success obj.Version is set to the new version of the item.
+func (ks *InMemoryStorage) UpdateValueIfVersion(obj *storage.MetaDataUpdObj) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	if obj != nil {
+		if len(obj.Key) == 0 {
+			return errors.New("Object key is null.")
+		}
+		obj.CreationDate = time.Now()
+		if obj.Timestamp == 0 {
+			obj.Timestamp = obj.CreationDate.UnixNano()
+		}
+		logged := *obj
+		if ok, err := ks.collection.UpdateValueIfVersion(obj); err != nil {
+			return err
+		} else if ok {
+			ks.record("updatevalueifversion", &logged)
+			return nil
+		}
+		return errors.New("Versions are not equal.")
+	}
+	return errors.New("Object is null.")
+}
+
+// Delete an item if its version is the expected version.
+func (ks *InMemoryStorage) DeleteValueIfVersion(key string, version uint64) error {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	if ks.collection.DeleteValueIfVersion(key, version) {
+		ks.record("delete", &storage.MetaDataUpdObj{Key: key})
+		return nil
+	}
+	return errors.New("Versions are not equal.")
+}
+
+// Get the number of objects and the accounted memory of every collection, counting only the objects of the slots if slots is not nil.
+func (ks *InMemoryStorage) Collections(slots []int) []storage.CollectionStats {
+	return ks.collection.Collections(slots)
+}
+
+// List the keys of the objects of a collection, only the keys of the slots if slots is not nil.
+func (ks *InMemoryStorage) CollectionKeys(name string, slots []int) []string {
+	return ks.collection.CollectionKeys(name, slots)
+}
+
+// Remove all the objects of a collection, it returns the number of removed objects.
+func (ks *InMemoryStorage) DropCollection(name string) int {
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	count := ks.collection.DropCollection(name)
+	ks.record("dropcollection", &storage.MetaDataUpdObj{Collection: name})
+	return count
+}
+
+// Scan a page of the objects whose key matches the glob pattern, starting from the cursor.
+// It returns the cursor of the next page, 0 when the scan is complete.
+func (ks *InMemoryStorage) Scan(cursor uint64, count int, match string) (uint64, []*storage.MetaDataObj) {
+	return ks.collection.Scan(cursor, count, match)
+}
+
+// Maintain an ordered index of the keys, it is required by the range queries.
+func (ks *InMemoryStorage) EnableOrderedIndex() {
+	ks.collection.EnableOrderedIndex()
+}
+
+// Get a page of the objects with key in the range [start, end) in lexicographic order, or in reverse order.
+// The page starts after the key after, it returns the key that starts the next page (empty when there are no more objects).
+func (ks *InMemoryStorage) Range(start string, end string, after string, limit int, reverse bool) ([]*storage.MetaDataObj, string, error) {
+	return ks.collection.Range(start, end, after, limit, reverse)
+}
+
+// Apply the mutations of a transaction if all its conditions are satisfied, the transaction is applied entirely or not at all.
+// The reservation of a prepared transaction, if not nil, is released and its memory is used by the mutations.
+// It returns the stored objects, the removed keys and the counters in the order of the mutations.
+func (ks *InMemoryStorage) Transaction(checks []storage.TxCheck, mutations []storage.TxMutation, reservation *storage.TxReservation) ([]*storage.MetaDataUpdObj, error) {
+	if err := normalizeTx(mutations); err != nil {
+		ks.Release(reservation)
+		return nil, err
+	}
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	results, err := ks.collection.Transaction(checks, mutations, reservation)
+	if err != nil {
+		return nil, err
+	}
+	// the transaction is logged as a single command
+	batch := make([]*command.Command, len(results))
+	for i, m := range mutations {
+		switch m.Op {
+		case storage.TxPut:
+			batch[i] = &command.Command{OpCode: "put", Obj: results[i]}
+			if results[i].TTL > 0 {
+				item := results[i].MetaDataObj()
+				item.CreationDate = results[i].CreationDate
+				go ks.cleaner.AddElement(item)
+			}
+		case storage.TxDelete:
+			batch[i] = &command.Command{OpCode: "delete", Obj: results[i]}
+		case storage.TxIncrement:
+			batch[i] = &command.Command{OpCode: "setcounter", Obj: results[i]}
+		}
+	}
+	if ks.commandLog != nil && len(batch) > 0 {
+		ks.commandLog.Append(&command.Command{OpCode: "batch", Batch: batch})
+	}
+	return results, nil
+}
+
+// Check the mutations of a transaction and set the default collection and the timestamps of the new objects.
+func normalizeTx(mutations []storage.TxMutation) error {
+	now := time.Now()
+	for _, m := range mutations {
+		if m.Obj == nil || len(m.Obj.Key) == 0 {
+			return errors.New("Object key is null.")
+		}
+		switch m.Op {
+		case storage.TxPut:
+			if len(m.Obj.Collection) == 0 {
+				m.Obj.Collection = storage.DefaultCollection
+			}
+			m.Obj.CreationDate = now
+			if m.Obj.Timestamp == 0 {
+				m.Obj.Timestamp = now.UnixNano()
+			}
+		case storage.TxDelete, storage.TxIncrement:
+		default:
+			return errors.New("Unsupported mutation.")
+		}
+	}
+	return nil
+}
+
+// Reserve the memory needed by the mutations of a prepared transaction and protect its keys from eviction,
+// read repair and collection drop until the reservation is released or used by the transaction.
+func (ks *InMemoryStorage) Reserve(keys []string, mutations []storage.TxMutation) (*storage.TxReservation, error) {
+	if err := normalizeTx(mutations); err != nil {
+		return nil, err
+	}
+	ks.writeMux.Lock()
+	defer ks.writeMux.Unlock()
+	return ks.collection.Reserve(keys, mutations)
+}
+
+// Release the memory and the keys of a reservation.
+func (ks *InMemoryStorage) Release(reservation *storage.TxReservation) {
+	if reservation != nil {
+		ks.collection.Release(reservation)
+	}
+}
@@ -89,3 +89,40 @@ func TestKSCountConcurrent(t *testing.T) {
 		t.Log("Correct count " + strconv.Itoa(count))
 	}
 }
+
+func TestKSTimestamp(t *testing.T) {
+	t.Log("TestKSTimestamp started")
+	ks := NewInMemoryStorage()
+	var data = storage.NewMetaDataObj("test", []byte("test string"), "default", 60, 0)
+	ks.Put(&data)
+	first, _ := ks.Get("test")
+	ts := first.Timestamp
+	if ts == 0 {
+		t.Fatal("timestamp not set")
+	}
+	var replica = storage.NewMetaDataObj("replica", []byte("test string"), "default", 60, 0)
+	replica.Timestamp = 42
+	ks.Put(&replica)
+	if res, _ := ks.Get("replica"); res.Timestamp != 42 {
+		t.Fatal("timestamp of the replicated object not preserved")
+	}
+	ks.UpdateValueIfEqual(&storage.MetaDataUpdObj{Key: "test", Data: []byte("test string"), NewData: []byte("new string")})
+	if res, _ := ks.Get("test"); res.Timestamp <= ts || string(res.Data) != "new string" {
+		t.Fatal("timestamp not updated")
+	}
+}
+
+func TestKSPutIfOutdatedCreationDate(t *testing.T) {
+	t.Log("TestKSPutIfOutdatedCreationDate started")
+	ks := NewInMemoryStorage()
+	var data = storage.NewMetaDataObj("test", []byte("old"), "default", 60, 0)
+	ks.Put(&data)
+	created := time.Now().Add(-30 * time.Second)
+	repair := &storage.MetaDataObj{Key: "test", Data: []byte("new"), TTL: 60, Version: data.Version + 1, CreationDate: created}
+	if err := ks.PutIfOutdated(repair); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := ks.Get("test"); err != nil || string(obj.Data) != "new" || !obj.CreationDate.Equal(created) {
+		t.Fatal("the repair has not kept the creation date of the copy")
+	}
+}
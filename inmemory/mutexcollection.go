@@ -2,18 +2,51 @@ package inmemory
 
 import (
 	"bytes"
+	"errors"
+	"hash/fnv"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/maxzerbini/ovo/storage"
+	"github.com/maxzerbini/ovo/util"
 )
 
 const collection_buffer_size = 100
+const scanBuckets = 4096 // buckets of the scan index, the cursor of a scan is a bucket number
+
+// The error returned when a replicated copy is older than the stored item.
+var errOutdated = errors.New("Outdated copy.")
+
+// The keys of a collection (namespace) of items and their accounted memory, in total and by hash slot.
+type collectionIndex struct {
+	keys      map[string]bool
+	usedBytes int64
+	slots     map[int]*slotUsage
+}
+
+// The number of items of a collection in a hash slot and their accounted memory.
+type slotUsage struct {
+	count     int
+	usedBytes int64
+}
 
 // Collection (Map) of MetaDataObj. This collection is thread-safe.
 type InMemoryMutexCollection struct {
-	storage  map[string]*storage.MetaDataObj
-	counters map[string]*storage.MetaDataCounter
+	storage     map[string]*storage.MetaDataObj
+	counters    map[string]*storage.MetaDataCounter
+	stats       map[string]*accessStats
+	collections map[string]*collectionIndex
+	buckets     []map[string]bool
+	ordered     *skipList // the ordered index of the keys, nil if it's not enabled
+	usedBytes   int64
+	volatile    map[string]bool // the keys of the items with a TTL, the candidates of the volatile-ttl policy
+	volatileMem int64           // the accounted memory of the items with a TTL
+	reserved    int64           // the memory reserved by the prepared transactions
+	pinned      map[string]int  // the keys of the prepared transactions, they are not evicted nor changed by the repairs
+	maxBytes    int64
+	policy      string
+	onEvict     func(evicted []*storage.MetaDataObj)
 	sync.RWMutex
 }
 
@@ -22,14 +55,222 @@ func NewMutexCollection() *InMemoryMutexCollection {
 	coll := new(InMemoryMutexCollection)
 	coll.storage = make(map[string]*storage.MetaDataObj, 10)
 	coll.counters = make(map[string]*storage.MetaDataCounter, 10)
+	coll.stats = make(map[string]*accessStats, 10)
+	coll.collections = make(map[string]*collectionIndex)
+	coll.pinned = make(map[string]int)
+	coll.volatile = make(map[string]bool)
+	coll.buckets = make([]map[string]bool, scanBuckets)
+	coll.policy = NoEviction
 	return coll
 }
 
-// Add an item to the collection.
-func (coll *InMemoryMutexCollection) Put(obj *storage.MetaDataObj) {
+// Set the memory limit (0 means no limit) and the eviction policy.
+func (coll *InMemoryMutexCollection) SetMemoryLimit(maxBytes int64, policy string) error {
+	if err := validEvictionPolicy(policy); err != nil {
+		return err
+	}
 	coll.Lock()
 	defer coll.Unlock()
+	coll.maxBytes = maxBytes
+	coll.policy = policy
+	return nil
+}
+
+// Set the function called with the evicted items.
+func (coll *InMemoryMutexCollection) SetEvictionListener(listener func(evicted []*storage.MetaDataObj)) {
+	coll.Lock()
+	defer coll.Unlock()
+	coll.onEvict = listener
+}
+
+// Get the accounted memory of the items.
+func (coll *InMemoryMutexCollection) UsedMemory() int64 {
+	coll.RLock()
+	defer coll.RUnlock()
+	return coll.usedBytes
+}
+
+// Get the scan bucket of a key.
+func bucketOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % scanBuckets)
+}
+
+// Get the name of the collection of an item.
+func collectionName(obj *storage.MetaDataObj) string {
+	if obj.Collection == "" {
+		return storage.DefaultCollection
+	}
+	return obj.Collection
+}
+
+// Add an item to the index of its collection. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) index(obj *storage.MetaDataObj) {
+	name := collectionName(obj)
+	idx, ok := coll.collections[name]
+	if !ok {
+		idx = &collectionIndex{keys: make(map[string]bool), slots: make(map[int]*slotUsage)}
+		coll.collections[name] = idx
+	}
+	idx.keys[obj.Key] = true
+	idx.usedBytes += objSize(obj)
+	usage, ok := idx.slots[obj.Hash]
+	if !ok {
+		usage = new(slotUsage)
+		idx.slots[obj.Hash] = usage
+	}
+	usage.count++
+	usage.usedBytes += objSize(obj)
+}
+
+// Remove an item from the index of its collection. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) unindex(obj *storage.MetaDataObj) {
+	name := collectionName(obj)
+	if idx, ok := coll.collections[name]; ok {
+		delete(idx.keys, obj.Key)
+		idx.usedBytes -= objSize(obj)
+		if len(idx.keys) == 0 {
+			delete(coll.collections, name)
+		}
+		if usage, ok := idx.slots[obj.Hash]; ok {
+			usage.count--
+			usage.usedBytes -= objSize(obj)
+			if usage.count == 0 {
+				delete(idx.slots, obj.Hash)
+			}
+		}
+	}
+}
+
+// Remove an item from the index of the items with a TTL. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) unindexTTL(obj *storage.MetaDataObj) {
+	if obj.TTL != 0 {
+		delete(coll.volatile, obj.Key)
+		coll.volatileMem -= objSize(obj)
+	}
+}
+
+// Change the accounted memory of an item whose value is changed in place. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) resize(obj *storage.MetaDataObj, delta int64) {
+	coll.usedBytes += delta
+	if obj.TTL != 0 {
+		coll.volatileMem += delta
+	}
+	if idx, ok := coll.collections[collectionName(obj)]; ok {
+		idx.usedBytes += delta
+		if usage, ok := idx.slots[obj.Hash]; ok {
+			usage.usedBytes += delta
+		}
+	}
+}
+
+// Store an item updating the accounted memory. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) set(obj *storage.MetaDataObj) {
+	if old, ok := coll.storage[obj.Key]; ok {
+		coll.usedBytes -= objSize(old)
+		coll.unindex(old)
+		coll.unindexTTL(old)
+		coll.stats[obj.Key].hit()
+	} else {
+		coll.stats[obj.Key] = newAccessStats()
+		bucket := bucketOf(obj.Key)
+		if coll.buckets[bucket] == nil {
+			coll.buckets[bucket] = make(map[string]bool)
+		}
+		coll.buckets[bucket][obj.Key] = true
+		if coll.ordered != nil {
+			coll.ordered.Insert(obj.Key)
+		}
+	}
 	coll.storage[obj.Key] = obj
+	coll.usedBytes += objSize(obj)
+	coll.index(obj)
+	if obj.TTL != 0 {
+		coll.volatile[obj.Key] = true
+		coll.volatileMem += objSize(obj)
+	}
+}
+
+// Remove an item updating the accounted memory. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) remove(key string) (*storage.MetaDataObj, bool) {
+	if old, ok := coll.storage[key]; ok {
+		coll.usedBytes -= objSize(old)
+		coll.unindex(old)
+		coll.unindexTTL(old)
+		delete(coll.buckets[bucketOf(key)], key)
+		if coll.ordered != nil {
+			coll.ordered.Delete(key)
+		}
+		delete(coll.storage, key)
+		delete(coll.stats, key)
+		return old, true
+	}
+	return nil, false
+}
+
+// Notify the evicted items. It must be called without holding the lock.
+func (coll *InMemoryMutexCollection) notifyEvicted(evicted []*storage.MetaDataObj) {
+	if len(evicted) > 0 && coll.onEvict != nil {
+		coll.onEvict(evicted)
+	}
+}
+
+// Add an item to the collection. Other items can be evicted if the memory limit is reached.
+// An item without version gets the next version of the key, an item with a version is a replicated copy
+// and it is not stored if the stored item is not outdated by it (errOutdated is returned).
+func (coll *InMemoryMutexCollection) Put(obj *storage.MetaDataObj) error {
+	coll.Lock()
+	var size = objSize(obj)
+	if old, ok := coll.storage[obj.Key]; ok {
+		if obj.Version == 0 {
+			obj.Version = old.Version + 1
+		} else if !old.IsOutdatedBy(obj) {
+			coll.Unlock()
+			return errOutdated
+		}
+		size -= objSize(old)
+	} else if obj.Version == 0 {
+		obj.Version = 1
+	}
+	evicted, err := coll.reserve(size, obj.Key)
+	if err == nil {
+		coll.set(obj)
+	}
+	coll.Unlock()
+	coll.notifyEvicted(evicted)
+	return err
+}
+
+// Replace an item with a newer copy (e.g. a read repair). The copy is stored only if the item still exists
+// and it is outdated by the copy, so a change applied after the copy was read is never overwritten.
+// It returns false if the copy is not stored.
+func (coll *InMemoryMutexCollection) PutIfOutdated(obj *storage.MetaDataObj) (bool, error) {
+	coll.Lock()
+	old, ok := coll.storage[obj.Key]
+	if !ok || !old.IsOutdatedBy(obj) || coll.pinned[obj.Key] > 0 {
+		coll.Unlock()
+		return false, nil
+	}
+	evicted, err := coll.reserve(objSize(obj)-objSize(old), obj.Key)
+	if err == nil {
+		coll.set(obj)
+	}
+	coll.Unlock()
+	coll.notifyEvicted(evicted)
+	return err == nil, err
+}
+
+// Remove an item if it is outdated by the copy (e.g. the replicated removal of the old key of a renamed item).
+// It returns false if the item is not found or it is not outdated by the copy.
+func (coll *InMemoryMutexCollection) DeleteIfOutdated(obj *storage.MetaDataObj) bool {
+	coll.Lock()
+	defer coll.Unlock()
+	if old, ok := coll.storage[obj.Key]; ok && old.IsOutdatedBy(obj) {
+		coll.remove(obj.Key)
+		return true
+	}
+	return false
 }
 
 // Get an item from the collection by key.
@@ -37,6 +278,7 @@ func (coll *InMemoryMutexCollection) Get(key string) (*storage.MetaDataObj, bool
 	coll.RLock()
 	defer coll.RUnlock()
 	if ret, ok := coll.storage[key]; ok {
+		coll.stats[key].hit()
 		return ret, true
 	} else {
 		return nil, false
@@ -47,7 +289,7 @@ func (coll *InMemoryMutexCollection) Get(key string) (*storage.MetaDataObj, bool
 func (coll *InMemoryMutexCollection) Delete(key string) {
 	coll.Lock()
 	defer coll.Unlock()
-	delete(coll.storage, key)
+	coll.remove(key)
 }
 
 // Remove the item of the collection
@@ -56,7 +298,7 @@ func (coll *InMemoryMutexCollection) DeleteExpired(key string) {
 	defer coll.Unlock()
 	if ret, ok := coll.storage[key]; ok {
 		if ret.IsExpired() {
-			delete(coll.storage, key)
+			coll.remove(key)
 		}
 	}
 }
@@ -65,49 +307,87 @@ func (coll *InMemoryMutexCollection) DeleteExpired(key string) {
 func (coll *InMemoryMutexCollection) GetAndRemove(key string) (*storage.MetaDataObj, bool) {
 	coll.Lock()
 	defer coll.Unlock()
-	if ret, ok := coll.storage[key]; ok {
-		delete(coll.storage, key)
-		return ret, true
-	} else {
-		return nil, false
-	}
+	return coll.remove(key)
 }
 
 // Update an item if the value is not changed.
-func (coll *InMemoryMutexCollection) UpdateValueIfEqual(obj *storage.MetaDataUpdObj) bool {
+// It returns false if the item is not found or its value is changed, and an error if the memory limit is reached.
+func (coll *InMemoryMutexCollection) UpdateValueIfEqual(obj *storage.MetaDataUpdObj) (bool, error) {
 	coll.Lock()
+	var evicted []*storage.MetaDataObj
+	defer func() { coll.notifyEvicted(evicted) }()
 	defer coll.Unlock()
 	if ret, ok := coll.storage[obj.Key]; ok {
 		if bytes.Equal(ret.Data, obj.Data) {
+			var err error
+			if evicted, err = coll.reserve(int64(len(obj.NewData)-len(ret.Data)), obj.Key); err != nil {
+				return false, err
+			}
+			coll.resize(ret, int64(len(obj.NewData)-len(ret.Data)))
 			ret.Data = obj.NewData
 			ret.CreationDate = obj.CreationDate
-			return true
+			ret.Timestamp = obj.Timestamp
+			ret.Version++
+			return true, nil
 		} else {
-			return false // not equal
+			return false, nil // not equal
 		}
 	} else {
-		return false // not found
+		return false, nil // not found
+	}
+}
+
+// Update the value of an item if its version is the expected version (obj.Version).
+// On success obj.Version is set to the new version of the item.
+// It returns false if the item is not found or its version is changed, and an error if the memory limit is reached.
+func (coll *InMemoryMutexCollection) UpdateValueIfVersion(obj *storage.MetaDataUpdObj) (bool, error) {
+	coll.Lock()
+	var evicted []*storage.MetaDataObj
+	defer func() { coll.notifyEvicted(evicted) }()
+	defer coll.Unlock()
+	if ret, ok := coll.storage[obj.Key]; ok && ret.Version == obj.Version {
+		var err error
+		if evicted, err = coll.reserve(int64(len(obj.NewData)-len(ret.Data)), obj.Key); err != nil {
+			return false, err
+		}
+		coll.resize(ret, int64(len(obj.NewData)-len(ret.Data)))
+		ret.Data = obj.NewData
+		ret.CreationDate = obj.CreationDate
+		ret.Timestamp = obj.Timestamp
+		ret.Version++
+		obj.Version = ret.Version
+		return true, nil
 	}
+	return false, nil // not found or version changed
 }
 
 // Update an item (key and value) if the value is not changed.
-func (coll *InMemoryMutexCollection) UpdateKeyAndValueIfEqual(obj *storage.MetaDataUpdObj) bool {
+// It returns false if the item is not found or its value is changed, and an error if the memory limit is reached.
+func (coll *InMemoryMutexCollection) UpdateKeyAndValueIfEqual(obj *storage.MetaDataUpdObj) (bool, error) {
 	coll.Lock()
+	var evicted []*storage.MetaDataObj
+	defer func() { coll.notifyEvicted(evicted) }()
 	defer coll.Unlock()
 	if ret, ok := coll.storage[obj.Key]; ok {
 		if bytes.Equal(ret.Data, obj.Data) {
-			delete(coll.storage, obj.Key)
+			var err error
+			if evicted, err = coll.reserve(int64(len(obj.NewKey)+len(obj.NewData))-objSize(ret), obj.Key); err != nil {
+				return false, err
+			}
+			coll.remove(obj.Key)
 			ret.Data = obj.NewData
 			ret.Key = obj.NewKey
 			ret.Hash = obj.NewHash
 			ret.CreationDate = obj.CreationDate
-			coll.storage[obj.NewKey] = ret
-			return true
+			ret.Timestamp = obj.Timestamp
+			ret.Version++
+			coll.set(ret)
+			return true, nil
 		} else {
-			return false
+			return false, nil
 		}
 	} else {
-		return false
+		return false, nil
 	}
 }
 
@@ -115,12 +395,13 @@ func (coll *InMemoryMutexCollection) UpdateKeyAndValueIfEqual(obj *storage.MetaD
 func (coll *InMemoryMutexCollection) UpdateKey(obj *storage.MetaDataUpdObj) {
 	coll.Lock()
 	defer coll.Unlock()
-	if ret, ok := coll.storage[obj.Key]; ok {
-		delete(coll.storage, obj.Key)
+	if ret, ok := coll.remove(obj.Key); ok {
 		ret.Key = obj.NewKey
 		ret.CreationDate = obj.CreationDate
 		ret.Hash = obj.NewHash
-		coll.storage[obj.NewKey] = ret
+		ret.Timestamp = obj.Timestamp
+		ret.Version++
+		coll.set(ret)
 	}
 }
 
@@ -183,6 +464,11 @@ func (coll *InMemoryMutexCollection) ListExpired() []*storage.MetaDataObj {
 func (coll *InMemoryMutexCollection) Increment(c *storage.MetaDataCounter) *storage.MetaDataCounter {
 	coll.Lock()
 	defer coll.Unlock()
+	return coll.increment(c)
+}
+
+// Increment a counter. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) increment(c *storage.MetaDataCounter) *storage.MetaDataCounter {
 	if ret, ok := coll.counters[c.Key]; ok {
 		if ret.IsExpired() {
 			ret.CreationDate = time.Now()
@@ -215,6 +501,13 @@ func (coll *InMemoryMutexCollection) SetCounter(c *storage.MetaDataCounter) *sto
 	}
 }
 
+// Add a counter to the collection keeping its creation date.
+func (coll *InMemoryMutexCollection) PutCounter(c *storage.MetaDataCounter) {
+	coll.Lock()
+	defer coll.Unlock()
+	coll.counters[c.Key] = c
+}
+
 // Get a counter by key.
 func (coll *InMemoryMutexCollection) GetCounter(key string) (*storage.MetaDataCounter, bool) {
 	coll.RLock()
@@ -246,13 +539,32 @@ func (coll *InMemoryMutexCollection) ListCounters() []*storage.MetaDataCounter {
 	return list
 }
 
+// Copy the items and the counters of the collection holding the read lock only for the copy.
+func (coll *InMemoryMutexCollection) Snapshot() ([]storage.MetaDataObj, []storage.MetaDataCounter) {
+	coll.RLock()
+	defer coll.RUnlock()
+	objects := make([]storage.MetaDataObj, 0, len(coll.storage))
+	for _, val := range coll.storage {
+		if !val.IsExpired() {
+			objects = append(objects, *val)
+		}
+	}
+	counters := make([]storage.MetaDataCounter, 0, len(coll.counters))
+	for _, val := range coll.counters {
+		if !val.IsExpired() {
+			counters = append(counters, *val)
+		}
+	}
+	return objects, counters
+}
+
 // Delete an item if the value is not changed.
 func (coll *InMemoryMutexCollection) DeleteValueIfEqual(obj *storage.MetaDataObj) bool {
 	coll.Lock()
 	defer coll.Unlock()
 	if ret, ok := coll.storage[obj.Key]; ok {
 		if bytes.Equal(ret.Data, obj.Data) {
-			delete(coll.storage, obj.Key)
+			coll.remove(obj.Key)
 			return true
 		} else {
 			return false // values are not equal
@@ -262,3 +574,285 @@ func (coll *InMemoryMutexCollection) DeleteValueIfEqual(obj *storage.MetaDataObj
 	}
 
 }
+
+// Delete an item if its version is the expected version.
+func (coll *InMemoryMutexCollection) DeleteValueIfVersion(key string, version uint64) bool {
+	coll.Lock()
+	defer coll.Unlock()
+	if ret, ok := coll.storage[key]; ok {
+		if ret.Version == version {
+			coll.remove(key)
+			return true
+		}
+		return false // version changed
+	}
+	return false // not found
+}
+
+// Check the condition of a transaction. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) satisfied(check *storage.TxCheck) bool {
+	ret, ok := coll.storage[check.Key]
+	if !ok || ret.IsExpired() {
+		return false
+	}
+	switch check.Op {
+	case storage.TxCheckExists:
+		return true
+	case storage.TxCheckVersion:
+		return ret.Version == check.Version
+	case storage.TxCheckValue:
+		return bytes.Equal(ret.Data, check.Data)
+	}
+	return false
+}
+
+// Get the memory needed by the mutations of a transaction. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) txSize(mutations []storage.TxMutation) int64 {
+	var size int64
+	for _, m := range mutations {
+		if m.Op == storage.TxPut {
+			size += objSize(m.Obj.MetaDataObj())
+			if old, ok := coll.storage[m.Obj.Key]; ok {
+				size -= objSize(old)
+			}
+		}
+	}
+	return size
+}
+
+// Reserve the memory needed by the mutations of a prepared transaction and protect its keys, evicting other items if needed.
+// The reservation lasts until it is released or used by the transaction.
+func (coll *InMemoryMutexCollection) Reserve(keys []string, mutations []storage.TxMutation) (*storage.TxReservation, error) {
+	coll.Lock()
+	var evicted []*storage.MetaDataObj
+	defer func() { coll.notifyEvicted(evicted) }()
+	defer coll.Unlock()
+	reservation := &storage.TxReservation{Keys: keys}
+	if size := coll.txSize(mutations); size > 0 {
+		var err error
+		if evicted, err = coll.reserve(size, keys...); err != nil {
+			return nil, err
+		}
+		reservation.Size = size
+	}
+	coll.reserved += reservation.Size
+	for _, key := range keys {
+		coll.pinned[key]++
+	}
+	return reservation, nil
+}
+
+// Release the memory and the keys of a reservation.
+func (coll *InMemoryMutexCollection) Release(reservation *storage.TxReservation) {
+	coll.Lock()
+	defer coll.Unlock()
+	coll.release(reservation)
+}
+
+// Release a reservation. It must be called holding the lock.
+func (coll *InMemoryMutexCollection) release(reservation *storage.TxReservation) {
+	if reservation == nil {
+		return
+	}
+	coll.reserved -= reservation.Size
+	for _, key := range reservation.Keys {
+		if coll.pinned[key]--; coll.pinned[key] <= 0 {
+			delete(coll.pinned, key)
+		}
+	}
+}
+
+// Apply the mutations of a transaction if all its conditions are satisfied, holding the lock for the whole transaction.
+// The memory of all the new objects is reserved before applying the mutations, so the transaction is applied entirely or not at all.
+// The reservation of a prepared transaction, if not nil, is released and its memory is used by the mutations.
+// It returns the stored objects, the removed keys and the counters in the order of the mutations.
+func (coll *InMemoryMutexCollection) Transaction(checks []storage.TxCheck, mutations []storage.TxMutation, reservation *storage.TxReservation) ([]*storage.MetaDataUpdObj, error) {
+	coll.Lock()
+	var evicted []*storage.MetaDataObj
+	defer func() { coll.notifyEvicted(evicted) }()
+	defer coll.Unlock()
+	coll.release(reservation)
+	for i := range checks {
+		if !coll.satisfied(&checks[i]) {
+			return nil, storage.ErrTxCheckFailed
+		}
+	}
+	keys := make([]string, 0, len(mutations))
+	for _, m := range mutations {
+		keys = append(keys, m.Obj.Key)
+	}
+	if size := coll.txSize(mutations); size > 0 {
+		var err error
+		if evicted, err = coll.reserve(size, keys...); err != nil {
+			return nil, err
+		}
+	}
+	results := make([]*storage.MetaDataUpdObj, len(mutations))
+	for i, m := range mutations {
+		switch m.Op {
+		case storage.TxPut:
+			obj := m.Obj.MetaDataObj()
+			obj.CreationDate = m.Obj.CreationDate
+			obj.Version = 1
+			if old, ok := coll.storage[obj.Key]; ok {
+				obj.Version = old.Version + 1
+			}
+			coll.set(obj)
+			results[i] = obj.MetaDataUpdObj()
+		case storage.TxDelete:
+			coll.remove(m.Obj.Key)
+			results[i] = &storage.MetaDataUpdObj{Key: m.Obj.Key}
+		case storage.TxIncrement:
+			results[i] = coll.increment(m.Obj.MetaDataCounter()).MetaDataUpdObj()
+		}
+	}
+	return results, nil
+}
+
+// Get the number of items and the accounted memory of every collection, ordered by name.
+// If slots is not nil only the items of the hash slots are counted and the collections without items in the slots are omitted.
+func (coll *InMemoryMutexCollection) Collections(slots []int) []storage.CollectionStats {
+	coll.RLock()
+	defer coll.RUnlock()
+	list := make([]storage.CollectionStats, 0, len(coll.collections))
+	for name, idx := range coll.collections {
+		stats := storage.CollectionStats{Name: name, Count: len(idx.keys), UsedBytes: idx.usedBytes}
+		if slots != nil {
+			stats.Count, stats.UsedBytes = 0, 0
+			for _, slot := range slots {
+				if usage, ok := idx.slots[slot]; ok {
+					stats.Count += usage.count
+					stats.UsedBytes += usage.usedBytes
+				}
+			}
+			if stats.Count == 0 {
+				continue
+			}
+		}
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// List the keys of the items of a collection. If slots is not nil only the keys of the hash slots are listed.
+func (coll *InMemoryMutexCollection) CollectionKeys(name string, slots []int) []string {
+	coll.RLock()
+	defer coll.RUnlock()
+	list := make([]string, 0)
+	if idx, ok := coll.collections[name]; ok {
+		for key := range idx.keys {
+			obj := coll.storage[key]
+			if !obj.IsExpired() && (slots == nil || util.Contains(slots, obj.Hash)) {
+				list = append(list, key)
+			}
+		}
+	}
+	return list
+}
+
+// Remove all the items of a collection, it returns the number of removed items.
+// The items locked by a prepared transaction are kept.
+func (coll *InMemoryMutexCollection) DropCollection(name string) int {
+	coll.Lock()
+	defer coll.Unlock()
+	idx, ok := coll.collections[name]
+	if !ok {
+		return 0
+	}
+	keys := make([]string, 0, len(idx.keys))
+	for key := range idx.keys {
+		if coll.pinned[key] == 0 {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		coll.remove(key)
+	}
+	return len(keys)
+}
+
+// Scan the items starting from the bucket cursor, whole buckets are read until count items have been examined.
+// Only the items whose key matches the glob pattern match are returned (all the items if match is empty).
+// It returns the cursor of the next bucket, 0 when the scan is complete. The keys never change bucket,
+// so an item that exists for the whole scan is returned exactly once.
+func (coll *InMemoryMutexCollection) Scan(cursor uint64, count int, match string) (uint64, []*storage.MetaDataObj) {
+	coll.RLock()
+	defer coll.RUnlock()
+	list := make([]*storage.MetaDataObj, 0)
+	examined := 0
+	if count < 1 {
+		count = 1
+	}
+	for cursor < scanBuckets && examined < count {
+		for key := range coll.buckets[cursor] {
+			examined++
+			if obj := coll.storage[key]; !obj.IsExpired() && (match == "" || util.Glob(match, key)) {
+				list = append(list, obj)
+			}
+		}
+		cursor++
+	}
+	if cursor >= scanBuckets {
+		cursor = 0
+	}
+	return cursor, list
+}
+
+// Maintain an ordered index of the keys, the keys already stored are indexed.
+func (coll *InMemoryMutexCollection) EnableOrderedIndex() {
+	coll.Lock()
+	defer coll.Unlock()
+	if coll.ordered != nil {
+		return
+	}
+	coll.ordered = newSkipList()
+	for key := range coll.storage {
+		coll.ordered.Insert(key)
+	}
+}
+
+// Get at most limit items with key in the range [start, end) in lexicographic order, or in reverse order.
+// An empty end means no upper bound. The page starts after the key after, the last key of the previous page.
+// It returns the key to pass as after to get the next page, empty if there are no more items.
+func (coll *InMemoryMutexCollection) Range(start string, end string, after string, limit int, reverse bool) ([]*storage.MetaDataObj, string, error) {
+	coll.RLock()
+	defer coll.RUnlock()
+	if coll.ordered == nil {
+		return nil, "", storage.ErrNoOrderedIndex
+	}
+	list := make([]*storage.MetaDataObj, 0)
+	last := ""
+	var node *skipListNode
+	inRange := func(key string) bool { return key >= start && (end == "" || key < end) }
+	if !reverse {
+		if after != "" && after >= start {
+			if node = coll.ordered.Seek(after); node != nil && node.key == after {
+				node = node.next[0]
+			}
+		} else {
+			node = coll.ordered.Seek(start)
+		}
+	} else {
+		bound := end
+		if after != "" && (end == "" || after < end) {
+			bound = after
+		}
+		node = coll.ordered.SeekBefore(bound)
+	}
+	for node != nil && inRange(node.key) && len(list) < limit {
+		if obj := coll.storage[node.key]; !obj.IsExpired() {
+			list = append(list, obj)
+		}
+		last = node.key
+		if reverse {
+			node = node.prev
+		} else {
+			node = node.next[0]
+		}
+	}
+	if node == nil || !inRange(node.key) {
+		last = ""
+	}
+	return list, last, nil
+}
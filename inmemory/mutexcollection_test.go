@@ -2,6 +2,7 @@ package inmemory
 
 import (
 	"runtime"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -126,3 +127,261 @@ func _TestCountConcurrentMutex(t *testing.T) {
 		t.Log("Correct count " + strconv.Itoa(count))
 	}
 }
+
+func TestVersionsMutex(t *testing.T) {
+	t.Log("TestVersionsMutex started")
+	coll := NewMutexCollection()
+	var data = storage.NewMetaDataObj("test", []byte("v1"), "default", 0, 1)
+	coll.Put(&data)
+	var data2 = storage.NewMetaDataObj("test", []byte("v2"), "default", 0, 1)
+	coll.Put(&data2)
+	if res, _ := coll.Get("test"); res.Version != 2 {
+		t.Fatalf("wrong version %d", res.Version)
+	}
+	if ok, _ := coll.UpdateValueIfVersion(&storage.MetaDataUpdObj{Key: "test", NewData: []byte("v3"), Version: 1}); ok {
+		t.Fatal("update with an old version accepted")
+	}
+	upd := &storage.MetaDataUpdObj{Key: "test", NewData: []byte("v3"), Version: 2}
+	if ok, _ := coll.UpdateValueIfVersion(upd); !ok || upd.Version != 3 {
+		t.Fatal("update with the current version refused")
+	}
+	// a replicated copy with an older version is ignored
+	var stale = storage.NewMetaDataObj("test", []byte("stale"), "default", 0, 1)
+	stale.Version = 2
+	coll.Put(&stale)
+	if res, _ := coll.Get("test"); string(res.Data) != "v3" {
+		t.Fatal("stale copy applied")
+	}
+	if coll.DeleteValueIfVersion("test", 2) {
+		t.Fatal("delete with an old version accepted")
+	}
+	if !coll.DeleteValueIfVersion("test", 3) {
+		t.Fatal("delete with the current version refused")
+	}
+	if coll.DeleteValueIfVersion("test", 3) {
+		t.Fatal("delete of a missing key accepted")
+	}
+}
+
+func TestOutdatedOrderMutex(t *testing.T) {
+	t.Log("TestOutdatedOrderMutex started")
+	coll := NewMutexCollection()
+	var data = storage.NewMetaDataObj("test", []byte("v3"), "default", 0, 1)
+	data.Version = 3
+	data.Timestamp = 100
+	coll.Put(&data)
+	// a copy with an older version but written later does not replace the item
+	var older = storage.NewMetaDataObj("test", []byte("v2"), "default", 0, 1)
+	older.Version = 2
+	older.Timestamp = 200
+	coll.Put(&older)
+	if res, _ := coll.Get("test"); string(res.Data) != "v3" {
+		t.Fatal("copy with an older version applied")
+	}
+	if data.IsOutdatedBy(&older) == older.IsOutdatedBy(&data) {
+		t.Fatal("the copies are not ordered")
+	}
+	// the timestamp breaks the ties
+	var tie = storage.NewMetaDataObj("test", []byte("tie"), "default", 0, 1)
+	tie.Version = 3
+	tie.Timestamp = 150
+	coll.Put(&tie)
+	if res, _ := coll.Get("test"); string(res.Data) != "tie" {
+		t.Fatal("copy written later not applied")
+	}
+}
+
+func TestCollectionsMutex(t *testing.T) {
+	t.Log("TestCollectionsMutex started")
+	coll := NewMutexCollection()
+	for i := 0; i < 10; i++ {
+		var name = "users"
+		if i%2 == 0 {
+			name = "orders"
+		}
+		var data = storage.NewMetaDataObj("key"+strconv.Itoa(i), []byte("value"), name, 0, 1)
+		coll.Put(&data)
+	}
+	// moving a key to another collection updates both indexes
+	var moved = storage.NewMetaDataObj("key0", []byte("value"), "users", 0, 1)
+	coll.Put(&moved)
+	stats := coll.Collections(nil)
+	if len(stats) != 2 || stats[0].Name != "orders" || stats[0].Count != 4 || stats[1].Count != 6 {
+		t.Fatalf("wrong collections %v", stats)
+	}
+	if stats[0].UsedBytes+stats[1].UsedBytes != coll.UsedMemory() {
+		t.Fatal("wrong collections memory")
+	}
+	if keys := coll.CollectionKeys("users", nil); len(keys) != 6 {
+		t.Fatalf("wrong keys %v", keys)
+	}
+	if count := coll.DropCollection("users"); count != 6 {
+		t.Fatalf("wrong dropped count %d", count)
+	}
+	if coll.Count() != 4 || len(coll.Collections(nil)) != 1 {
+		t.Fatal("collection not dropped")
+	}
+	// the collections of some slots count only their items
+	var other = storage.NewMetaDataObj("other", []byte("other value"), "orders", 0, 2)
+	coll.Put(&other)
+	if stats := coll.Collections([]int{2}); len(stats) != 1 || stats[0].Count != 1 || stats[0].UsedBytes != objSize(&other) {
+		t.Fatalf("wrong collections of the slot %v", stats)
+	}
+	if stats := coll.Collections([]int{3}); len(stats) != 0 {
+		t.Fatalf("wrong collections of an empty slot %v", stats)
+	}
+	if keys := coll.CollectionKeys("orders", []int{2}); len(keys) != 1 || keys[0] != "other" {
+		t.Fatalf("wrong keys of the slot %v", keys)
+	}
+}
+
+func TestScanMutex(t *testing.T) {
+	t.Log("TestScanMutex started")
+	coll := NewMutexCollection()
+	for i := 0; i < 1000; i++ {
+		var data = storage.NewMetaDataObj("user:"+strconv.Itoa(i), []byte("value"), "default", 0, 1)
+		coll.Put(&data)
+	}
+	var other = storage.NewMetaDataObj("order:1", []byte("value"), "default", 0, 1)
+	coll.Put(&other)
+	found := make(map[string]int)
+	var cursor uint64
+	for {
+		var objs []*storage.MetaDataObj
+		cursor, objs = coll.Scan(cursor, 50, "user:*")
+		for _, obj := range objs {
+			found[obj.Key]++
+		}
+		// the keys added during the scan may be returned or not
+		var added = storage.NewMetaDataObj("user:new"+strconv.Itoa(len(found)), []byte("value"), "default", 0, 1)
+		coll.Put(&added)
+		if cursor == 0 {
+			break
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if found["user:"+strconv.Itoa(i)] != 1 {
+			t.Fatalf("key user:%d returned %d times", i, found["user:"+strconv.Itoa(i)])
+		}
+	}
+	if _, ok := found["order:1"]; ok {
+		t.Fatal("key not matching the pattern returned")
+	}
+}
+
+func TestRangeMutex(t *testing.T) {
+	t.Log("TestRangeMutex started")
+	coll := NewMutexCollection()
+	if _, _, err := coll.Range("", "", "", 10, false); err != storage.ErrNoOrderedIndex {
+		t.Fatal("range without ordered index")
+	}
+	var first = storage.NewMetaDataObj("tenant:1:a", []byte("value"), "default", 0, 1)
+	coll.Put(&first)
+	coll.EnableOrderedIndex()
+	for i := 0; i < 100; i++ {
+		var data = storage.NewMetaDataObj("tenant:"+strconv.Itoa(i%3)+":"+strconv.Itoa(1000+i), []byte("value"), "default", 0, 1)
+		coll.Put(&data)
+	}
+	coll.Delete("tenant:1:1001")
+	// read the prefix in pages of 7 keys
+	keys := make([]string, 0)
+	after := ""
+	for {
+		objs, next, err := coll.Range("tenant:1:", "tenant:1;", after, 7, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objs {
+			keys = append(keys, obj.Key)
+		}
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if len(keys) != 33 || keys[0] != "tenant:1:1004" || keys[32] != "tenant:1:a" || !sort.StringsAreSorted(keys) {
+		t.Fatalf("wrong prefix keys %v", keys)
+	}
+	objs, next, _ := coll.Range("tenant:1:", "tenant:1;", "", 3, true)
+	if len(objs) != 3 || objs[0].Key != "tenant:1:a" || objs[1].Key != "tenant:1:1097" || next != "tenant:1:1094" {
+		t.Fatalf("wrong reverse page %v %s", objs, next)
+	}
+	objs, _, _ = coll.Range("tenant:1:", "tenant:1;", next, 2, true)
+	if len(objs) != 2 || objs[0].Key != "tenant:1:1091" {
+		t.Fatalf("wrong reverse next page %v", objs)
+	}
+}
+
+func TestTransactionMutex(t *testing.T) {
+	t.Log("TestTransactionMutex started")
+	coll := NewMutexCollection()
+	var data = storage.NewMetaDataObj("account:1", []byte("open"), "default", 0, 1)
+	coll.Put(&data)
+	coll.SetCounter(&storage.MetaDataCounter{Key: "credit:1", Value: 10})
+	mutations := []storage.TxMutation{
+		{Op: storage.TxPut, Obj: &storage.MetaDataUpdObj{Key: "account:1", Data: []byte("closed")}},
+		{Op: storage.TxDelete, Obj: &storage.MetaDataUpdObj{Key: "account:2"}},
+		{Op: storage.TxIncrement, Obj: &storage.MetaDataUpdObj{Key: "credit:1", Value: -10}},
+	}
+	// a failed check leaves everything unchanged
+	checks := []storage.TxCheck{{Op: storage.TxCheckExists, Key: "account:1"}, {Op: storage.TxCheckValue, Key: "account:1", Data: []byte("closed")}}
+	if _, err := coll.Transaction(checks, mutations, nil); err != storage.ErrTxCheckFailed {
+		t.Fatal("transaction with a failed check applied")
+	}
+	if obj, _ := coll.Get("account:1"); string(obj.Data) != "open" || obj.Version != 1 {
+		t.Fatal("object changed by a failed transaction")
+	}
+	if cnt, _ := coll.GetCounter("credit:1"); cnt.Value != 10 {
+		t.Fatal("counter changed by a failed transaction")
+	}
+	checks = []storage.TxCheck{{Op: storage.TxCheckValue, Key: "account:1", Data: []byte("open")}, {Op: storage.TxCheckVersion, Key: "account:1", Version: 1}}
+	results, err := coll.Transaction(checks, mutations, nil)
+	if err != nil || len(results) != 3 {
+		t.Fatalf("transaction failed %v", err)
+	}
+	if results[0].Version != 2 || results[2].Value != 0 {
+		t.Fatalf("wrong results %v %v", results[0], results[2])
+	}
+	if obj, _ := coll.Get("account:1"); string(obj.Data) != "closed" || obj.Version != 2 {
+		t.Fatal("object not changed by the transaction")
+	}
+	// the memory of the new objects is reserved before applying the mutations
+	coll.SetMemoryLimit(coll.UsedMemory()+10, NoEviction)
+	mutations = []storage.TxMutation{
+		{Op: storage.TxDelete, Obj: &storage.MetaDataUpdObj{Key: "account:1"}},
+		{Op: storage.TxPut, Obj: &storage.MetaDataUpdObj{Key: "account:3", Data: []byte("a value larger than the limit")}},
+	}
+	if _, err := coll.Transaction(nil, mutations, nil); err != storage.ErrOutOfMemory {
+		t.Fatal("transaction over the memory limit applied")
+	}
+	if _, ok := coll.Get("account:1"); !ok {
+		t.Fatal("object deleted by a failed transaction")
+	}
+}
+
+func TestPutIfOutdatedMutex(t *testing.T) {
+	t.Log("TestPutIfOutdatedMutex started")
+	coll := NewMutexCollection()
+	var data = storage.NewMetaDataObj("test", []byte("v1"), "default", 0, 1)
+	coll.Put(&data)
+	var repair = storage.NewMetaDataObj("test", []byte("repair"), "default", 0, 1)
+	repair.Version = 2
+	// a write received after the repair was read
+	var data2 = storage.NewMetaDataObj("test", []byte("v2"), "default", 0, 1)
+	coll.Put(&data2)
+	if ok, _ := coll.PutIfOutdated(&repair); ok {
+		t.Fatal("repair overwrote a newer write")
+	}
+	if res, _ := coll.Get("test"); string(res.Data) != "v2" {
+		t.Fatal("the newer write was lost")
+	}
+	repair.Version = 3
+	if ok, _ := coll.PutIfOutdated(&repair); !ok {
+		t.Fatal("repair of an older copy refused")
+	}
+	var missing = storage.NewMetaDataObj("missing", []byte("repair"), "default", 0, 1)
+	missing.Version = 5
+	if ok, _ := coll.PutIfOutdated(&missing); ok || coll.Count() != 1 {
+		t.Fatal("repair restored a removed key")
+	}
+}
@@ -0,0 +1,121 @@
+package inmemory
+
+import (
+	"math/rand"
+)
+
+const (
+	skipListMaxLevel = 32
+	skipListP        = 4 // a node has the next level with probability 1/skipListP
+)
+
+type skipListNode struct {
+	key  string
+	next []*skipListNode
+	prev *skipListNode // the previous node on the first level, used by the reverse iteration
+}
+
+// Ordered set of keys. It is not thread-safe, the collection protects it with its lock.
+type skipList struct {
+	head   *skipListNode
+	tail   *skipListNode
+	level  int
+	length int
+	random *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{head: &skipListNode{next: make([]*skipListNode, skipListMaxLevel)}, level: 1, random: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+func (sl *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && sl.random.Intn(skipListP) == 0 {
+		level++
+	}
+	return level
+}
+
+// Find the last node with key lower than key on every level.
+func (sl *skipList) predecessors(key string) []*skipListNode {
+	update := make([]*skipListNode, skipListMaxLevel)
+	node := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// Add a key if it is not in the list.
+func (sl *skipList) Insert(key string) {
+	update := sl.predecessors(key)
+	if next := update[0].next[0]; next != nil && next.key == key {
+		return
+	}
+	level := sl.randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.head
+		}
+		sl.level = level
+	}
+	node := &skipListNode{key: key, next: make([]*skipListNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	if update[0] != sl.head {
+		node.prev = update[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	} else {
+		sl.tail = node
+	}
+	sl.length++
+}
+
+// Remove a key if it is in the list.
+func (sl *skipList) Delete(key string) {
+	update := sl.predecessors(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	} else {
+		sl.tail = node.prev
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// Get the first node with key greater than or equal to key.
+func (sl *skipList) Seek(key string) *skipListNode {
+	return sl.predecessors(key)[0].next[0]
+}
+
+// Get the last node with key lower than key, the last node of the list if key is empty.
+func (sl *skipList) SeekBefore(key string) *skipListNode {
+	if key == "" {
+		return sl.tail
+	}
+	if node := sl.predecessors(key)[0]; node != sl.head {
+		return node
+	}
+	return nil
+}
+
+// Get the number of keys.
+func (sl *skipList) Len() int {
+	return sl.length
+}
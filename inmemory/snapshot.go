@@ -0,0 +1,69 @@
+package inmemory
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/maxzerbini/ovo/storage"
+)
+
+const (
+	snapshotMagic   = "OVOSNAP"
+	snapshotVersion = 1
+)
+
+// The content of a snapshot file.
+type snapshotData struct {
+	Version  int
+	Objects  []storage.MetaDataObj
+	Counters []storage.MetaDataCounter
+}
+
+// Write the snapshot data to path. The file is written aside and renamed when it is complete.
+func writeSnapshot(path string, objects []storage.MetaDataObj, counters []storage.MetaDataCounter) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	writer.WriteString(snapshotMagic)
+	err = gob.NewEncoder(writer).Encode(&snapshotData{Version: snapshotVersion, Objects: objects, Counters: counters})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Read the snapshot file at path.
+func readSnapshot(path string) (*snapshotData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, errors.New("Invalid snapshot file.")
+	}
+	data := new(snapshotData)
+	if err := gob.NewDecoder(reader).Decode(data); err != nil {
+		return nil, err
+	}
+	if data.Version != snapshotVersion {
+		return nil, errors.New("Unsupported snapshot version.")
+	}
+	return data, nil
+}
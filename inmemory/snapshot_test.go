@@ -0,0 +1,48 @@
+package inmemory
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxzerbini/ovo/storage"
+)
+
+func TestSnapshotAndLoad(t *testing.T) {
+	t.Log("TestSnapshotAndLoad started")
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "ovo.snapshot")
+	logPath := filepath.Join(dir, "ovo.log")
+	ks := NewInMemoryStorage()
+	ks.LoadSnapshot(snapshotPath)
+	if err := ks.OpenCommandLog(logPath, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	var data = storage.NewMetaDataObj("before", []byte("test string"), "default", 0, 1)
+	ks.Put(&data)
+	ks.SetCounter(&storage.MetaDataCounter{Key: "counter", Value: 42})
+	if err := ks.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(logPath); err != nil || info.Size() != 0 {
+		t.Fatal("command log not truncated")
+	}
+	var after = storage.NewMetaDataObj("after", []byte("test string"), "default", 0, 1)
+	ks.Put(&after)
+	ks.CloseCommandLog()
+
+	restored := NewInMemoryStorage()
+	if err := restored.LoadSnapshot(snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.OpenCommandLog(logPath, SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.CloseCommandLog()
+	if restored.Count() != 2 {
+		t.Fatal("Incorrect count after restore")
+	}
+	if c, err := restored.GetCounter("counter"); err != nil || c.Value != 42 {
+		t.Fatal("counter not restored")
+	}
+}
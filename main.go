@@ -42,7 +42,24 @@ func start() {
 	conf = server.LoadConfiguration(configPath)
 	log.Printf("Start server node OVO Engine v.%s .\r\n", Version)
 	conf.Init(configPathTemp)
-	ks = inmemory.NewInMemoryStorage()
+	mks := inmemory.NewInMemoryStorage()
+	if err := mks.SetMemoryLimit(conf.MaxMemoryBytes, conf.EvictionPolicy); err != nil {
+		log.Fatalf("Memory limit configuration error: %v", err)
+	}
+	if conf.OrderedIndex {
+		mks.EnableOrderedIndex()
+	}
+	if conf.SnapshotPath != "" {
+		if err := mks.LoadSnapshot(conf.SnapshotPath); err != nil {
+			log.Fatalf("Snapshot error at %s: %v", conf.SnapshotPath, err)
+		}
+	}
+	if conf.CommandLogPath != "" {
+		if err := mks.OpenCommandLog(conf.CommandLogPath, conf.CommandLogSync); err != nil {
+			log.Fatalf("Command log error at %s: %v", conf.CommandLogPath, err)
+		}
+	}
+	ks = mks
 	srv = server.NewServer(&conf, ks)
 	srv.Do()
 }
@@ -0,0 +1,237 @@
+package processor
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/storage"
+	"github.com/maxzerbini/ovo/util"
+)
+
+// The anti-entropy process compares the hash slots owned by the node with the copies on the twins
+// and transfers only the keys and counters of the slots that differ.
+type AntiEntropy struct {
+	storage        storage.OvoStorage
+	serverNode     *cluster.ClusterTopologyNode
+	outcomingQueue *OutCommandQueue
+	period         time.Duration
+	doneChan       chan (bool)
+	stats          AntiEntropyStats
+	recovered      map[string]bool // the twins whose copies have been pulled back after the start of the node
+	mux            *sync.Mutex
+}
+
+// The counters of the anti-entropy process.
+type AntiEntropyStats struct {
+	Rounds         int64
+	DivergentSlots int64
+	PushedKeys     int64
+	PulledKeys     int64
+	DeletedKeys    int64
+	LastRound      time.Time
+}
+
+// Create the anti-entropy process, it runs every period.
+func NewAntiEntropy(storage storage.OvoStorage, serverNode *cluster.ClusterTopologyNode, outcomingQueue *OutCommandQueue, period time.Duration) *AntiEntropy {
+	return &AntiEntropy{storage: storage, serverNode: serverNode, outcomingQueue: outcomingQueue, period: period, doneChan: make(chan bool), recovered: make(map[string]bool), mux: new(sync.Mutex)}
+}
+
+func (ae *AntiEntropy) Stop() {
+	ae.doneChan <- true
+}
+
+func (ae *AntiEntropy) Do() {
+	tickChan := time.NewTicker(ae.period).C
+	log.Printf("Start anti-entropy synchronization with the twins...\r\n")
+	for {
+		select {
+		case <-tickChan:
+			ae.Synchronize()
+		case <-ae.doneChan:
+			return
+		}
+	}
+}
+
+// Get a copy of the counters.
+func (ae *AntiEntropy) Stats() AntiEntropyStats {
+	ae.mux.Lock()
+	defer ae.mux.Unlock()
+	return ae.stats
+}
+
+// Synchronize the owned slots with every active twin.
+func (ae *AntiEntropy) Synchronize() {
+	slots := append([]int(nil), ae.serverNode.Node.HashRange...)
+	if len(slots) > 0 {
+		for _, node := range ae.outcomingQueue.topology.GetTwins(ae.serverNode.Replicas()) {
+			ae.syncTwin(node.Node, slots)
+		}
+	}
+	ae.mux.Lock()
+	ae.stats.Rounds++
+	ae.stats.LastRound = time.Now()
+	ae.mux.Unlock()
+}
+
+// Compare the digests of the slots with the twin and repair the slots that differ.
+// The node is the owner of the data: a key missing on the node is deleted on the twin if it was written after the node started,
+// otherwise the node may have lost it in a restart and it is copied back from the twin. The keys are copied back only until
+// a round with the twin completes, later a missing key has been deleted by the node and its deletion may still be pending
+// (in the pipeline or in the hints), so it is deleted on the twin instead of being restored.
+func (ae *AntiEntropy) syncTwin(twin *cluster.OvoNode, slots []int) {
+	remoteDigests, err := ae.outcomingQueue.Caller.GetSlotDigests(slots, twin)
+	if err != nil {
+		return
+	}
+	ae.mux.Lock()
+	pullBack := !ae.recovered[twin.Name]
+	ae.mux.Unlock()
+	complete := true
+	defer func() {
+		if complete {
+			ae.mux.Lock()
+			ae.recovered[twin.Name] = true
+			ae.mux.Unlock()
+		}
+	}()
+	localDigests := SlotDigests(ae.storage, slots)
+	diff := make([]int, 0)
+	for _, slot := range slots {
+		if localDigests[slot] != remoteDigests[slot] {
+			diff = append(diff, slot)
+		}
+	}
+	if len(diff) == 0 {
+		return
+	}
+	log.Printf("Anti-entropy found %d divergent slots on twin %s\r\n", len(diff), twin.Name)
+	entries, err := ae.outcomingQueue.Caller.GetSlotEntries(diff, twin)
+	if err != nil {
+		complete = false
+		return
+	}
+	objects := make(map[string]*storage.MetaDataObj)
+	for _, obj := range ae.storage.List() {
+		if util.Contains(diff, obj.Hash) {
+			objects[obj.Key] = obj
+		}
+	}
+	counters := make(map[string]*storage.MetaDataCounter)
+	for _, cnt := range ae.storage.ListCounters() {
+		if util.Contains(diff, cnt.Hash) && !cnt.IsExpired() {
+			counters[cnt.Key] = cnt
+		}
+	}
+	startTime := ae.serverNode.StartDate.UnixNano()
+	var pushed, pulled, deleted int64
+	for _, entry := range entries {
+		if entry.Counter {
+			if cnt, ok := counters[entry.Key]; ok {
+				delete(counters, entry.Key)
+				if cnt.Value != entry.Value {
+					ae.outcomingQueue.executeOn(cnt.MetaDataUpdObj(), twin, "setcounter")
+					pushed++
+				}
+			} else if entry.Timestamp > startTime {
+				ae.outcomingQueue.executeOn(&storage.MetaDataUpdObj{Key: entry.Key}, twin, "deletecounter")
+				deleted++
+			}
+			continue
+		}
+		remote := &storage.MetaDataObj{Key: entry.Key, Version: entry.Version, Timestamp: entry.Timestamp}
+		if obj, ok := objects[entry.Key]; ok {
+			delete(objects, entry.Key)
+			if obj.IsOutdatedBy(remote) {
+				if ae.pull(entry.Key, twin) {
+					pulled++
+				}
+			} else if remote.IsOutdatedBy(obj) {
+				ae.outcomingQueue.executeOn(obj.MetaDataUpdObj(), twin, "put")
+				pushed++
+			}
+		} else if entry.Timestamp > startTime || !pullBack {
+			ae.outcomingQueue.executeOn(&storage.MetaDataUpdObj{Key: entry.Key}, twin, "delete")
+			deleted++
+		} else if ae.pull(entry.Key, twin) {
+			pulled++
+		} else {
+			complete = false
+		}
+	}
+	for _, obj := range objects {
+		ae.outcomingQueue.executeOn(obj.MetaDataUpdObj(), twin, "put")
+		pushed++
+	}
+	for _, cnt := range counters {
+		ae.outcomingQueue.executeOn(cnt.MetaDataUpdObj(), twin, "setcounter")
+		pushed++
+	}
+	ae.mux.Lock()
+	ae.stats.DivergentSlots += int64(len(diff))
+	ae.stats.PushedKeys += pushed
+	ae.stats.PulledKeys += pulled
+	ae.stats.DeletedKeys += deleted
+	ae.mux.Unlock()
+}
+
+// Copy an object from the twin, the stored object is replaced only if it is outdated.
+func (ae *AntiEntropy) pull(key string, twin *cluster.OvoNode) bool {
+	obj, err := ae.outcomingQueue.Caller.ReadObject(key, twin)
+	if err != nil || obj == nil {
+		return false
+	}
+	return ae.storage.Put(obj.MetaDataObj()) == nil
+}
+
+// Compute the digests of the slots: every digest combines the key, version and write time of the objects
+// and the key and value of the counters in the slot, regardless of their order.
+func SlotDigests(ks storage.OvoStorage, slots []int) map[int]uint64 {
+	digests := make(map[int]uint64, len(slots))
+	for _, slot := range slots {
+		digests[slot] = 0
+	}
+	for _, obj := range ks.List() {
+		if _, ok := digests[obj.Hash]; ok {
+			digests[obj.Hash] ^= entryDigest('o', obj.Key, obj.Version, obj.Timestamp)
+		}
+	}
+	for _, cnt := range ks.ListCounters() {
+		if _, ok := digests[cnt.Hash]; ok && !cnt.IsExpired() {
+			digests[cnt.Hash] ^= entryDigest('c', cnt.Key, 0, cnt.Value)
+		}
+	}
+	return digests
+}
+
+// List the keys and counters of the slots with the data compared by the anti-entropy process.
+func SlotEntries(ks storage.OvoStorage, slots []int) []command.SlotEntry {
+	entries := make([]command.SlotEntry, 0)
+	for _, obj := range ks.List() {
+		if util.Contains(slots, obj.Hash) {
+			entries = append(entries, command.SlotEntry{Key: obj.Key, Version: obj.Version, Timestamp: obj.Timestamp})
+		}
+	}
+	for _, cnt := range ks.ListCounters() {
+		if util.Contains(slots, cnt.Hash) && !cnt.IsExpired() {
+			entries = append(entries, command.SlotEntry{Key: cnt.Key, Counter: true, Value: cnt.Value, Timestamp: cnt.CreationDate.UnixNano()})
+		}
+	}
+	return entries
+}
+
+func entryDigest(kind byte, key string, version uint64, value int64) uint64 {
+	h := fnv.New64a()
+	var buf [17]byte
+	buf[0] = kind
+	binary.BigEndian.PutUint64(buf[1:9], version)
+	binary.BigEndian.PutUint64(buf[9:], uint64(value))
+	h.Write([]byte(key))
+	h.Write(buf[:])
+	return h.Sum64()
+}
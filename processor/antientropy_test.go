@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/inmemory"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+// Put an object with the given version and write time.
+func putVersion(ks storage.OvoStorage, key string, version uint64, timestamp int64) {
+	var data = storage.NewMetaDataObj(key, []byte(key), "default", 0, 0)
+	data.Version = version
+	data.Timestamp = timestamp
+	ks.Put(&data)
+}
+
+func TestAntiEntropySynchronize(t *testing.T) {
+	t.Log("TestAntiEntropySynchronize started")
+	twin := startFakeNode(t, "twin")
+	start := time.Now()
+	ks := inmemory.NewInMemoryStorage()
+	serverNode := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "owner", HashRange: []int{0, 1}, State: cluster.Active}, StartDate: start, Twins: []string{"twin"}}
+	topology := &cluster.ClusterTopology{Nodes: []*cluster.ClusterTopologyNode{serverNode, {Node: twin.node}}}
+	out := NewOutCommandQueue(serverNode, topology, nil, 0, 0, 0, "")
+	before := start.Add(-time.Hour).UnixNano()
+	after := start.Add(time.Hour).UnixNano()
+	putVersion(ks, "a", 1, before) // missing on the twin: pushed
+	putVersion(ks, "b", 1, before) // newer on the twin: pulled
+	putVersion(twin.store, "b", 3, before)
+	putVersion(ks, "c", 2, before) // older on the twin: pushed
+	putVersion(twin.store, "c", 1, before)
+	putVersion(twin.store, "d", 1, before) // missing on the node, written before it started: pulled
+	putVersion(twin.store, "e", 1, after)  // missing on the node, written after it started: deleted
+	ks.SetCounter(&storage.MetaDataCounter{Key: "n", Value: 5})
+
+	ae := NewAntiEntropy(ks, serverNode, out, time.Hour)
+	ae.Synchronize()
+	local, remote := SlotDigests(ks, []int{0, 1}), SlotDigests(twin.store, []int{0, 1})
+	if local[0] != remote[0] || local[1] != remote[1] {
+		t.Fatal("the twin is not synchronized")
+	}
+	if obj, err := ks.Get("b"); err != nil || obj.Version != 3 {
+		t.Fatal("newer object not pulled")
+	}
+	if _, err := twin.store.Get("e"); err == nil {
+		t.Fatal("removed object not deleted on the twin")
+	}
+	stats := ae.Stats()
+	if stats.Rounds != 1 || stats.DivergentSlots != 1 || stats.PushedKeys != 3 || stats.PulledKeys != 2 || stats.DeletedKeys != 1 {
+		t.Fatalf("wrong stats %+v", stats)
+	}
+	// a synchronized twin is not changed again
+	ae.Synchronize()
+	if stats := ae.Stats(); stats.DivergentSlots != 1 {
+		t.Fatal("synchronized slots found divergent")
+	}
+	// after the first round a key deleted on the node is not restored, even if it was written before the node started
+	ks.Delete("d")
+	ae.Synchronize()
+	if _, err := ks.Get("d"); err == nil {
+		t.Fatal("deleted object restored from the twin")
+	}
+	if _, err := twin.store.Get("d"); err == nil {
+		t.Fatal("deleted object not deleted on the twin")
+	}
+}
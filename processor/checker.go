@@ -50,6 +50,8 @@ func (ckr *Checker) checkNodes() {
 			ckr.nodeError[nd.Node.Name] = ckr.nodeError[nd.Node.Name] + 1
 		} else {
 			ckr.nodeError[nd.Node.Name] = 0
+			// the node responds, send the mutations it missed
+			ckr.outcomingQueue.ReplayHints(nd.Node.Name)
 		}
 	}
 	for name, count := range ckr.nodeError {
@@ -63,7 +65,7 @@ func (ckr *Checker) notifyFaultNotification(name string) {
 	node, _ := ckr.topology.GetNodeByName(name)
 	node.Node.State = cluster.Inactive
 	node.UpdateDate = time.Now()
-	node.Node.HashRange = make([]int, 0)
+	// the node keeps its range, so the slots are handed to one of its twins
 	nodes := ckr.topology.GetClusterNodes()
 	ckr.topology.AddNode(node) // repartition index
 	ckr.outcomingQueue.Caller.RemoveClient(name)
@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/inmemory"
+	"github.com/maxzerbini/ovo/storage"
+	"github.com/maxzerbini/ovo/transport"
+)
+
+// A node that serves the inner methods used by the processors on its own storage.
+type fakeNode struct {
+	node     *cluster.OvoNode
+	store    *inmemory.InMemoryStorage
+	queue    *InCommandQueue
+	received []*command.RpcCommand
+	batches  []int
+	fail     bool
+	gate     chan bool // if not nil the calls wait on it
+	mux      *sync.Mutex
+}
+
+// The inner server of a fake node.
+type fakeInnerServer struct {
+	fn *fakeNode
+}
+
+// Start a fake node listening on a local port.
+func startFakeNode(t *testing.T, name string) *fakeNode {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	ks := inmemory.NewInMemoryStorage()
+	fn := &fakeNode{store: ks, queue: &InCommandQueue{keystorage: ks}, received: make([]*command.RpcCommand, 0), batches: make([]int, 0), mux: new(sync.Mutex)}
+	fn.node = &cluster.OvoNode{Name: name, HashRange: []int{}, APIHost: "127.0.0.1", APIPort: listener.Addr().(*net.TCPAddr).Port, State: cluster.Active}
+	server := rpc.NewServer()
+	server.RegisterName("InnerServer", &fakeInnerServer{fn: fn})
+	go transport.Serve(listener, server, server)
+	return fn
+}
+
+// Make the calls fail (true) or succeed (false).
+func (fn *fakeNode) setFail(fail bool) {
+	fn.mux.Lock()
+	defer fn.mux.Unlock()
+	fn.fail = fail
+}
+
+// Get the keys of the received commands in order.
+func (fn *fakeNode) keys() []string {
+	fn.mux.Lock()
+	defer fn.mux.Unlock()
+	keys := make([]string, 0, len(fn.received))
+	for _, cmd := range fn.received {
+		keys = append(keys, cmd.Obj.Key)
+	}
+	return keys
+}
+
+// Get the sizes of the received batches.
+func (fn *fakeNode) batchSizes() []int {
+	fn.mux.Lock()
+	defer fn.mux.Unlock()
+	return append([]int(nil), fn.batches...)
+}
+
+// Apply the commands to the storage of the node.
+func (fn *fakeNode) execute(cmds []command.RpcCommand) error {
+	if fn.gate != nil {
+		<-fn.gate
+	}
+	fn.mux.Lock()
+	defer fn.mux.Unlock()
+	if fn.fail {
+		return errors.New("Node unreachable.")
+	}
+	for i := range cmds {
+		fn.received = append(fn.received, &cmds[i])
+		fn.queue.apply(cmds[i].Command())
+	}
+	fn.batches = append(fn.batches, len(cmds))
+	return nil
+}
+
+func (srv *fakeInnerServer) ExecuteCommand(rpccmd command.RpcCommand, reply *int) error {
+	return srv.fn.execute([]command.RpcCommand{rpccmd})
+}
+
+func (srv *fakeInnerServer) ExecuteCommands(rpccmds []command.RpcCommand, reply *int) error {
+	return srv.fn.execute(rpccmds)
+}
+
+func (srv *fakeInnerServer) ReadObject(key *string, reply *storage.MetaDataUpdObj) error {
+	if obj, err := srv.fn.store.Get(*key); err == nil {
+		*reply = *obj.MetaDataUpdObj()
+	}
+	return nil
+}
+
+func (srv *fakeInnerServer) SyncData(req command.SyncRequest, reply *command.SyncPage) error {
+	p := NewPartitioner(srv.fn.store, &cluster.ClusterTopologyNode{Node: srv.fn.node}, nil)
+	*reply = *p.SyncPage(&req)
+	return nil
+}
+
+func (srv *fakeInnerServer) GetSlotDigests(slots []int, reply *map[int]uint64) error {
+	*reply = SlotDigests(srv.fn.store, slots)
+	return nil
+}
+
+func (srv *fakeInnerServer) GetSlotEntries(slots []int, reply *[]command.SlotEntry) error {
+	*reply = SlotEntries(srv.fn.store, slots)
+	return nil
+}
+
+// Wait until the condition is true or fail the test after a few seconds.
+func waitFor(t *testing.T, condition func() bool, message string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
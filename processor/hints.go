@@ -0,0 +1,222 @@
+package processor
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+const (
+	DefaultMaxHints    = 10000
+	DefaultHintsMaxAge = 3600 // secs
+	hintsMemorySize    = 1000 // hints kept in memory for every destination before spilling on disk
+)
+
+// A mutation that must be replayed on a destination node.
+type Hint struct {
+	Operation string
+	Obj       *storage.MetaDataUpdObj
+	Batch     []*command.Command `json:",omitempty"`
+	Date      time.Time
+}
+
+// The counters of the hinted handoff store.
+type HintsStats struct {
+	Pending  map[string]int
+	Queued   int64
+	Dropped  int64
+	Replayed int64
+}
+
+// The hints of a destination: the oldest hints are in memory, the newest ones can be spilled on disk.
+type hintQueue struct {
+	destination *cluster.OvoNode
+	hints       []*Hint
+	spilled     int
+	spillFile   *os.File
+	replaying   bool
+}
+
+// The hinted handoff store keeps the ordered mutations for the unreachable nodes and replays them when the nodes respond again.
+type HintedHandoff struct {
+	caller    *NodeCaller
+	queues    map[string]*hintQueue
+	maxHints  int
+	maxAge    time.Duration
+	spillPath string
+	stats     HintsStats
+	mux       *sync.Mutex
+}
+
+// Create the hinted handoff store. If spillPath is empty the hints are kept only in memory.
+func NewHintedHandoff(caller *NodeCaller, maxHints int, maxAge time.Duration, spillPath string) *HintedHandoff {
+	if maxHints <= 0 {
+		maxHints = DefaultMaxHints
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultHintsMaxAge * time.Second
+	}
+	return &HintedHandoff{caller: caller, queues: make(map[string]*hintQueue), maxHints: maxHints, maxAge: maxAge, spillPath: spillPath, stats: HintsStats{Pending: make(map[string]int)}, mux: new(sync.Mutex)}
+}
+
+// Store a mutation for the destination. The mutation is dropped if the destination has too many hints.
+func (hh *HintedHandoff) Add(obj *storage.MetaDataUpdObj, destination *cluster.OvoNode, operation string) {
+	hh.AddCommand(&command.RpcCommand{OpCode: operation, Obj: obj}, destination)
+}
+
+// Store a command for the destination, a batch is kept as a single hint.
+func (hh *HintedHandoff) AddCommand(cmd *command.RpcCommand, destination *cluster.OvoNode) {
+	hh.mux.Lock()
+	defer hh.mux.Unlock()
+	queue, ok := hh.queues[destination.Name]
+	if !ok {
+		queue = &hintQueue{destination: destination, hints: make([]*Hint, 0)}
+		hh.queues[destination.Name] = queue
+	}
+	queue.destination = destination
+	if len(queue.hints)+queue.spilled >= hh.maxHints {
+		hh.stats.Dropped++
+		return
+	}
+	hint := &Hint{Operation: cmd.OpCode, Obj: cmd.Obj, Batch: cmd.Batch, Date: time.Now()}
+	if hh.spillPath != "" && (queue.spilled > 0 || len(queue.hints) >= hintsMemorySize) {
+		if err := hh.spill(queue, hint); err != nil {
+			log.Printf("Hint spill error for node %s: %v\r\n", destination.Name, err)
+			hh.stats.Dropped++
+			return
+		}
+	} else {
+		queue.hints = append(queue.hints, hint)
+	}
+	hh.stats.Queued++
+}
+
+// Check if the destination has hints that must be replayed before new mutations.
+func (hh *HintedHandoff) Pending(name string) bool {
+	hh.mux.Lock()
+	defer hh.mux.Unlock()
+	if queue, ok := hh.queues[name]; ok {
+		return len(queue.hints)+queue.spilled > 0
+	}
+	return false
+}
+
+// Replay in background the hints of the destination in order. The replay stops at the first failure.
+func (hh *HintedHandoff) Replay(name string) {
+	hh.mux.Lock()
+	queue, ok := hh.queues[name]
+	if !ok || queue.replaying || len(queue.hints)+queue.spilled == 0 {
+		hh.mux.Unlock()
+		return
+	}
+	queue.replaying = true
+	hh.mux.Unlock()
+	go hh.replay(queue)
+}
+
+func (hh *HintedHandoff) replay(queue *hintQueue) {
+	replayed := 0
+	defer func() {
+		hh.mux.Lock()
+		queue.replaying = false
+		hh.mux.Unlock()
+		if replayed > 0 {
+			log.Printf("Replayed %d hints on node %s\r\n", replayed, queue.destination.Name)
+		}
+	}()
+	for {
+		hh.mux.Lock()
+		if len(queue.hints) == 0 && queue.spilled > 0 {
+			hh.load(queue)
+		}
+		if len(queue.hints) == 0 {
+			hh.mux.Unlock()
+			return
+		}
+		hint := queue.hints[0]
+		destination := queue.destination
+		hh.mux.Unlock()
+		expired := time.Since(hint.Date) > hh.maxAge
+		if !expired {
+			if err := hh.caller.ExecuteCommand(&command.RpcCommand{OpCode: hint.Operation, Obj: hint.Obj, Batch: hint.Batch}, destination); err != nil {
+				return
+			}
+			replayed++
+		}
+		hh.mux.Lock()
+		queue.hints = queue.hints[1:]
+		if expired {
+			hh.stats.Dropped++
+		} else {
+			hh.stats.Replayed++
+		}
+		hh.mux.Unlock()
+	}
+}
+
+// Get a copy of the counters.
+func (hh *HintedHandoff) Stats() HintsStats {
+	hh.mux.Lock()
+	defer hh.mux.Unlock()
+	stats := hh.stats
+	stats.Pending = make(map[string]int, len(hh.queues))
+	for name, queue := range hh.queues {
+		stats.Pending[name] = len(queue.hints) + queue.spilled
+	}
+	return stats
+}
+
+// Append a hint to the spill file of the destination. It must be called holding the lock.
+func (hh *HintedHandoff) spill(queue *hintQueue, hint *Hint) error {
+	if queue.spillFile == nil {
+		// the hints spilled by a previous run are discarded
+		file, err := os.Create(filepath.Join(hh.spillPath, queue.destination.Name+".hints"))
+		if err != nil {
+			return err
+		}
+		queue.spillFile = file
+	}
+	data, err := json.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	if _, err = queue.spillFile.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	queue.spilled++
+	return nil
+}
+
+// Move the spilled hints in memory and truncate the spill file. It must be called holding the lock.
+func (hh *HintedHandoff) load(queue *hintQueue) {
+	queue.spilled = 0
+	if queue.spillFile == nil {
+		return
+	}
+	defer func() {
+		queue.spillFile.Truncate(0)
+		queue.spillFile.Seek(0, 0)
+	}()
+	if _, err := queue.spillFile.Seek(0, 0); err != nil {
+		log.Printf("Hint load error for node %s: %v\r\n", queue.destination.Name, err)
+		return
+	}
+	scanner := bufio.NewScanner(queue.spillFile)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		hint := new(Hint)
+		if err := json.Unmarshal(scanner.Bytes(), hint); err == nil {
+			queue.hints = append(queue.hints, hint)
+		} else {
+			hh.stats.Dropped++
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maxzerbini/ovo/storage"
+)
+
+// Add a put hint for every key.
+func addHints(hh *HintedHandoff, fn *fakeNode, keys ...string) {
+	for _, key := range keys {
+		hh.Add(&storage.MetaDataUpdObj{Key: key, Data: []byte(key)}, fn.node, "put")
+	}
+}
+
+// Check if the hints of the destination are being replayed.
+func (hh *HintedHandoff) replaying(name string) bool {
+	hh.mux.Lock()
+	defer hh.mux.Unlock()
+	queue, ok := hh.queues[name]
+	return ok && queue.replaying
+}
+
+func TestHintsReplay(t *testing.T) {
+	t.Log("TestHintsReplay started")
+	twin := startFakeNode(t, "twin")
+	hh := NewHintedHandoff(NewNodeCaller("owner"), 0, 0, "")
+	addHints(hh, twin, "a", "b", "c")
+	if !hh.Pending("twin") {
+		t.Fatal("hints not pending")
+	}
+	// the replay stops at the first failure and keeps the hints
+	twin.setFail(true)
+	hh.Replay("twin")
+	waitFor(t, func() bool { return !hh.replaying("twin") }, "replay not ended")
+	if !hh.Pending("twin") || hh.Stats().Pending["twin"] != 3 {
+		t.Fatal("hints lost by a failed replay")
+	}
+	twin.setFail(false)
+	hh.Replay("twin")
+	waitFor(t, func() bool { return !hh.Pending("twin") }, "hints not replayed")
+	if keys := twin.keys(); len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "c" {
+		t.Fatalf("hints replayed out of order %v", keys)
+	}
+	if stats := hh.Stats(); stats.Queued != 3 || stats.Replayed != 3 {
+		t.Fatalf("wrong stats %+v", stats)
+	}
+	if _, err := twin.store.Get("c"); err != nil {
+		t.Fatal("hint not applied")
+	}
+}
+
+func TestHintsMaxHints(t *testing.T) {
+	t.Log("TestHintsMaxHints started")
+	twin := startFakeNode(t, "twin")
+	hh := NewHintedHandoff(NewNodeCaller("owner"), 2, 0, "")
+	addHints(hh, twin, "a", "b", "c")
+	if stats := hh.Stats(); stats.Pending["twin"] != 2 || stats.Dropped != 1 {
+		t.Fatalf("wrong stats %+v", stats)
+	}
+}
+
+func TestHintsMaxAge(t *testing.T) {
+	t.Log("TestHintsMaxAge started")
+	twin := startFakeNode(t, "twin")
+	hh := NewHintedHandoff(NewNodeCaller("owner"), 0, 50*time.Millisecond, "")
+	addHints(hh, twin, "old")
+	time.Sleep(100 * time.Millisecond)
+	addHints(hh, twin, "new")
+	hh.Replay("twin")
+	waitFor(t, func() bool { return !hh.Pending("twin") }, "hints not replayed")
+	if keys := twin.keys(); len(keys) != 1 || keys[0] != "new" {
+		t.Fatalf("expired hint replayed %v", keys)
+	}
+	if stats := hh.Stats(); stats.Dropped != 1 || stats.Replayed != 1 {
+		t.Fatalf("wrong stats %+v", stats)
+	}
+}
+
+func TestHintsSpill(t *testing.T) {
+	t.Log("TestHintsSpill started")
+	twin := startFakeNode(t, "twin")
+	dir := t.TempDir()
+	hh := NewHintedHandoff(NewNodeCaller("owner"), 0, 0, dir)
+	total := hintsMemorySize + 50
+	for i := 0; i < total; i++ {
+		addHints(hh, twin, "key"+strconv.Itoa(i))
+	}
+	if info, err := os.Stat(filepath.Join(dir, "twin.hints")); err != nil || info.Size() == 0 {
+		t.Fatal("hints not spilled on disk")
+	}
+	if stats := hh.Stats(); stats.Pending["twin"] != total {
+		t.Fatalf("wrong pending hints %d", stats.Pending["twin"])
+	}
+	hh.Replay("twin")
+	waitFor(t, func() bool { return !hh.Pending("twin") }, "hints not replayed")
+	keys := twin.keys()
+	if len(keys) != total {
+		t.Fatalf("replayed %d hints", len(keys))
+	}
+	for i, key := range keys {
+		if key != "key"+strconv.Itoa(i) {
+			t.Fatalf("hint %d replayed out of order", i)
+		}
+	}
+}
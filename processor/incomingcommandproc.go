@@ -31,38 +31,60 @@ func (cq *InCommandQueue) Enqueu(cmd *command.Command) {
 func (cq *InCommandQueue) backend() {
 	for cmd := range cq.commands {
 		if cmd != nil {
-			switch cmd.OpCode {
-			case "put":
-				cq.put(cmd.Obj)
-			case "delete":
-				cq.delete(cmd.Obj)
-			case "touch":
-				cq.touch(cmd.Obj)
-			case "updatevalue":
-				cq.updatevalue(cmd.Obj)
-			case "updatekey":
-				cq.updatekey(cmd.Obj)
-			case "updatekeyvalue":
-				cq.updatekeyvalue(cmd.Obj)
-			case "setcounter":
-				cq.setcounter(cmd.Obj)
-			case "deletecounter":
-				cq.deletecounter(cmd.Obj)
-			default:
-				println("usupported command: " + cmd.OpCode)
-			}
+			cq.apply(cmd)
 		}
 	}
 }
 
+func (cq *InCommandQueue) apply(cmd *command.Command) {
+	switch cmd.OpCode {
+	case "put":
+		cq.put(cmd.Obj)
+	case "repair":
+		cq.repair(cmd.Obj)
+	case "delete":
+		cq.delete(cmd.Obj)
+	case "deleteifoutdated":
+		cq.deleteIfOutdated(cmd.Obj)
+	case "touch":
+		cq.touch(cmd.Obj)
+	case "updatevalue":
+		cq.updatevalue(cmd.Obj)
+	case "updatekey":
+		cq.updatekey(cmd.Obj)
+	case "updatekeyvalue":
+		cq.updatekeyvalue(cmd.Obj)
+	case "setcounter":
+		cq.setcounter(cmd.Obj)
+	case "deletecounter":
+		cq.deletecounter(cmd.Obj)
+	case "dropcollection":
+		cq.dropcollection(cmd.Obj)
+	case "batch":
+		cq.batch(cmd.Batch)
+	default:
+		println("usupported command: " + cmd.OpCode)
+	}
+}
+
 func (cq *InCommandQueue) put(obj *storage.MetaDataUpdObj) {
 	cq.keystorage.Put(obj.MetaDataObj())
 }
 
+func (cq *InCommandQueue) repair(obj *storage.MetaDataUpdObj) {
+	item := obj.MetaDataObj()
+	item.CreationDate = obj.CreationDate
+	cq.keystorage.PutIfOutdated(item)
+}
+
 func (cq *InCommandQueue) delete(obj *storage.MetaDataUpdObj) {
 	cq.keystorage.Delete(obj.Key)
 }
 
+func (cq *InCommandQueue) deleteIfOutdated(obj *storage.MetaDataUpdObj) {
+	cq.keystorage.DeleteIfOutdated(obj.MetaDataObj())
+}
+
 func (cq *InCommandQueue) touch(obj *storage.MetaDataUpdObj) {
 	cq.keystorage.Touch(obj.Key)
 }
@@ -86,3 +108,16 @@ func (cq *InCommandQueue) setcounter(obj *storage.MetaDataUpdObj) {
 func (cq *InCommandQueue) deletecounter(obj *storage.MetaDataUpdObj) {
 	cq.keystorage.DeleteCounter(obj.Key)
 }
+
+func (cq *InCommandQueue) dropcollection(obj *storage.MetaDataUpdObj) {
+	cq.keystorage.DropCollection(obj.Collection)
+}
+
+// Apply the commands of a batch in order.
+func (cq *InCommandQueue) batch(cmds []*command.Command) {
+	for _, cmd := range cmds {
+		if cmd != nil && cmd.OpCode != "batch" {
+			cq.apply(cmd)
+		}
+	}
+}
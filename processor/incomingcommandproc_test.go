@@ -0,0 +1,40 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/inmemory"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+func TestRenameConverges(t *testing.T) {
+	t.Log("TestRenameConverges started")
+	owner := inmemory.NewInMemoryStorage()
+	putVersion(owner, "old", 1, 1)
+	owner.UpdateKey(&storage.MetaDataUpdObj{Key: "old", NewKey: "new", Timestamp: 2})
+	res, _ := owner.Get("new")
+	obj := res.MetaDataUpdObj()
+	obj.Key, obj.NewKey = "old", "new"
+	put, remove := renameCommands(obj)
+
+	// the commands are delivered out of order and more than once
+	twin := inmemory.NewInMemoryStorage()
+	putVersion(twin, "old", 1, 1)
+	cq := &InCommandQueue{keystorage: twin}
+	for _, cmd := range []*command.Command{remove, put, put, remove} {
+		cq.apply(cmd)
+	}
+	if _, err := twin.Get("old"); err == nil {
+		t.Fatal("the old key has not been removed")
+	}
+	if copy, err := twin.Get("new"); err != nil || copy.Version != res.Version || string(copy.Data) != "old" {
+		t.Fatal("the renamed object has not been replicated")
+	}
+	// a newer object with the old key is not removed by a late delivery
+	putVersion(twin, "old", 5, 5)
+	cq.apply(remove)
+	if _, err := twin.Get("old"); err != nil {
+		t.Fatal("a newer object removed by the rename")
+	}
+}
@@ -1,284 +1,300 @@
 package processor
 
 import (
+	"crypto/tls"
+	"errors"
 	"github.com/maxzerbini/ovo/cluster"
 	"github.com/maxzerbini/ovo/command"
 	"github.com/maxzerbini/ovo/storage"
+	"github.com/maxzerbini/ovo/transport"
 	"log"
-	"net/rpc"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type NodeCaller struct {
-	Source  string
-	Name    string
-	clients map[string]*rpc.Client
-	mux     *sync.RWMutex
+	Source    string
+	Name      string
+	Protocol  string        // inner transport protocol, binary or rpc
+	Timeout   time.Duration // deadline of every call
+	PoolSize  int           // connections for every destination
+	TLSConfig *tls.Config   // if not nil the connections use TLS
+	Secret    string        // cluster secret sent with the registration requests
+	clients   map[string]transport.Transport
+	mux       *sync.RWMutex
 }
 
 // Create the node caller
 func NewNodeCaller(source string) *NodeCaller {
 	nc := new(NodeCaller)
 	nc.Source = source
-	nc.clients = make(map[string]*rpc.Client)
+	nc.Protocol = transport.ProtocolBinary
+	nc.Timeout = transport.DefaultCallTimeout * time.Millisecond
+	nc.PoolSize = transport.DefaultPoolSize
+	nc.clients = make(map[string]transport.Transport)
 	nc.mux = new(sync.RWMutex)
 	return nc
 }
 
-// Add a client if it is not already in the map
-func (nc *NodeCaller) addCaller(name string, client *rpc.Client) {
+// Add a client if it is not already in the map, the client in the map is returned
+func (nc *NodeCaller) addCaller(name string, client transport.Transport) transport.Transport {
 	nc.mux.Lock()
 	defer nc.mux.Unlock()
-	if _, ok := nc.clients[name]; !ok {
-		log.Printf("Create client for %s\r\n", name)
-		nc.clients[name] = client
+	if current, ok := nc.clients[name]; ok {
+		client.Close()
+		return current
 	}
+	log.Printf("Create client for %s\r\n", name)
+	nc.clients[name] = client
+	return client
 }
 
-// Delete a client
-func (nc *NodeCaller) deleteCaller(name string) {
+// Delete a client, the client is closed only if it is still the one in the map
+func (nc *NodeCaller) deleteCaller(name string, client transport.Transport) {
 	nc.mux.Lock()
 	defer nc.mux.Unlock()
-	delete(nc.clients, name)
+	if current, ok := nc.clients[name]; ok && (client == nil || current == client) {
+		delete(nc.clients, name)
+		current.Close()
+	}
 }
 
 // Get the caller
-func (nc *NodeCaller) getCaller(name string) (*rpc.Client, bool) {
+func (nc *NodeCaller) getCaller(name string) (transport.Transport, bool) {
 	nc.mux.RLock()
 	defer nc.mux.RUnlock()
-	if val, ok := nc.clients[name]; ok {
-		return val, true
-	} else {
-		return nil, false
+	val, ok := nc.clients[name]
+	return val, ok
+}
+
+// Call a method of the inner server of the destination. The client is dropped when the connection fails
+// and it will be created again by the next call.
+func (nc *NodeCaller) call(destination *cluster.OvoNode, method string, args interface{}, reply interface{}) error {
+	if destination == nil {
+		return errors.New("Destination not found.")
 	}
+	client, ok := nc.getCaller(destination.Name)
+	if !ok {
+		var err error
+		if client, err = nc.createClient(destination); err != nil {
+			log.Printf("%s dialing %s error: %v\r\n", method, destination.Name, err)
+			return err
+		}
+	}
+	err := client.Call(method, args, reply, nc.Timeout)
+	if err != nil {
+		log.Println(method+" error: ", err)
+		if !transport.IsRemoteError(err) {
+			nc.deleteCaller(destination.Name, client)
+		}
+	}
+	return err
 }
 
 // Execute remote operation on destination server
 func (nc *NodeCaller) ExecuteOperation(obj *storage.MetaDataUpdObj, destination *cluster.OvoNode, operation string) error {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
+	return nc.ExecuteCommand(&command.RpcCommand{OpCode: operation, Obj: obj}, destination)
+}
+
+// Execute a remote command on destination server
+func (nc *NodeCaller) ExecuteCommand(rpccmd *command.RpcCommand, destination *cluster.OvoNode) error {
+	rpccmd.Source = nc.Source
+	var reply int = 0
+	return nc.call(destination, "InnerServer.ExecuteCommand", rpccmd, &reply)
+}
+
+// Execute a batch of remote operations on destination server, the operations are executed in order
+func (nc *NodeCaller) ExecuteCommands(cmds []*command.RpcCommand, destination *cluster.OvoNode) error {
+	var reply int = 0
+	return nc.call(destination, "InnerServer.ExecuteCommands", cmds, &reply)
+}
+
+// Forward a client request to the destination server
+func (nc *NodeCaller) ForwardRequest(req *command.RpcRequest, destination *cluster.OvoNode) (*command.RpcResponse, error) {
+	var res = new(command.RpcResponse)
+	if err := nc.call(destination, "InnerServer.ForwardRequest", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Forward a batch of client requests to the destination server
+func (nc *NodeCaller) ForwardBatch(req *command.RpcBatchRequest, destination *cluster.OvoNode) (*command.RpcBatchResponse, error) {
+	var res = new(command.RpcBatchResponse)
+	if err := nc.call(destination, "InnerServer.ForwardBatch", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Forward a transaction to the destination server
+func (nc *NodeCaller) ForwardTransaction(req *command.RpcTxRequest, destination *cluster.OvoNode) (*command.RpcTxResponse, error) {
+	var res = new(command.RpcTxResponse)
+	if err := nc.call(destination, "InnerServer.ForwardTransaction", req, res); err != nil {
+		return nil, err
 	}
-	rpccmd := &command.RpcCommand{Source: cluster.GetCurrentNode().Node.Name, OpCode: operation, Obj: obj}
+	return res, nil
+}
+
+// Prepare the part of a distributed transaction on the destination server
+func (nc *NodeCaller) PrepareTx(req *command.RpcTxRequest, destination *cluster.OvoNode) (*command.RpcTxResponse, error) {
+	var res = new(command.RpcTxResponse)
+	if err := nc.call(destination, "InnerServer.PrepareTx", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Commit a prepared transaction on the destination server
+func (nc *NodeCaller) CommitTx(id string, destination *cluster.OvoNode) (*command.RpcTxResponse, error) {
+	var res = new(command.RpcTxResponse)
+	if err := nc.call(destination, "InnerServer.CommitTx", id, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Abort a prepared transaction on the destination server
+func (nc *NodeCaller) AbortTx(id string, destination *cluster.OvoNode) error {
 	var reply int = 0
-	err := client.Call("InnerServer.ExecuteCommand", rpccmd, &reply)
-	if err != nil {
-		log.Println("InnerServer.ExecuteCommand error: ", err)
+	return nc.call(destination, "InnerServer.AbortTx", id, &reply)
+}
+
+// Ask the state of a transaction to its coordinator
+func (nc *NodeCaller) TxStatus(id string, destination *cluster.OvoNode) (string, error) {
+	var status string
+	err := nc.call(destination, "InnerServer.TxStatus", id, &status)
+	return status, err
+}
+
+// Read an object from the destination server, the result is nil if the object is not found
+func (nc *NodeCaller) ReadObject(key string, destination *cluster.OvoNode) (*storage.MetaDataUpdObj, error) {
+	var obj = new(storage.MetaDataUpdObj)
+	if err := nc.call(destination, "InnerServer.ReadObject", &key, obj); err != nil {
+		return nil, err
 	}
-	return err
+	if obj.Key == "" {
+		obj = nil
+	}
+	return obj, nil
 }
 
-// Ask the destination to register the node
-func (nc *NodeCaller) RegisterNode(node *cluster.ClusterTopologyNode, destination *cluster.OvoNode) (*cluster.ClusterTopology, error) {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
+// Get the digests of the hash slots stored on the destination server
+func (nc *NodeCaller) GetSlotDigests(slots []int, destination *cluster.OvoNode) (map[int]uint64, error) {
+	digests := make(map[int]uint64)
+	err := nc.call(destination, "InnerServer.GetSlotDigests", slots, &digests)
+	return digests, err
+}
+
+// Get the keys and counters of the hash slots stored on the destination server
+func (nc *NodeCaller) GetSlotEntries(slots []int, destination *cluster.OvoNode) ([]command.SlotEntry, error) {
+	entries := make([]command.SlotEntry, 0)
+	err := nc.call(destination, "InnerServer.GetSlotEntries", slots, &entries)
+	return entries, err
+}
+
+// Get a page of the data owned by the destination server
+func (nc *NodeCaller) SyncData(req *command.SyncRequest, destination *cluster.OvoNode) (*command.SyncPage, error) {
+	var page = new(command.SyncPage)
+	if err := nc.call(destination, "InnerServer.SyncData", req, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Scan a page of the keys of the destination server
+func (nc *NodeCaller) Scan(req *command.ScanRequest, destination *cluster.OvoNode) (*command.ScanPage, error) {
+	var page = new(command.ScanPage)
+	if err := nc.call(destination, "InnerServer.Scan", req, page); err != nil {
+		return nil, err
 	}
+	return page, nil
+}
+
+// Get the statistics of the collections in the slots owned by the destination server, of all the collections if name is empty
+func (nc *NodeCaller) Collections(name string, destination *cluster.OvoNode) ([]storage.CollectionStats, error) {
+	list := make([]storage.CollectionStats, 0)
+	err := nc.call(destination, "InnerServer.Collections", name, &list)
+	return list, err
+}
+
+// List the keys of a collection in the slots owned by the destination server
+func (nc *NodeCaller) CollectionKeys(name string, destination *cluster.OvoNode) ([]string, error) {
+	keys := make([]string, 0)
+	err := nc.call(destination, "InnerServer.CollectionKeys", name, &keys)
+	return keys, err
+}
+
+// Call a method of the destination that returns the topology
+func (nc *NodeCaller) callTopology(destination *cluster.OvoNode, method string, args interface{}) (*cluster.ClusterTopology, error) {
 	var topology = new(cluster.ClusterTopology)
-	var err = client.Call("InnerServer.RegisterNode", node, topology)
-	if err != nil {
-		topology = nil
-		log.Println("InnerServer.RegisterNode error: ", err)
+	if err := nc.call(destination, method, args, topology); err != nil {
+		return nil, err
 	}
-	return topology, err
+	return topology, nil
+}
+
+// Copy the node adding the cluster secret
+func (nc *NodeCaller) withSecret(node *cluster.ClusterTopologyNode) *cluster.ClusterTopologyNode {
+	signed := *node
+	signed.Secret = nc.Secret
+	return &signed
+}
+
+// Ask the destination to register the node
+func (nc *NodeCaller) RegisterNode(node *cluster.ClusterTopologyNode, destination *cluster.OvoNode) (*cluster.ClusterTopology, error) {
+	return nc.callTopology(destination, "InnerServer.RegisterNode", nc.withSecret(node))
 }
 
 // Ask the destination to register the node as a twin
 func (nc *NodeCaller) RegisterTwin(node *cluster.ClusterTopologyNode, destination *cluster.OvoNode) (*cluster.ClusterTopology, error) {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
-	}
-	var topology = new(cluster.ClusterTopology)
-	var err = client.Call("InnerServer.RegisterTwin", node, topology)
-	if err != nil {
-		topology = nil
-		log.Println("InnerServer.RegisterTwin error: ", err)
-	}
-	return topology, err
+	return nc.callTopology(destination, "InnerServer.RegisterTwin", nc.withSecret(node))
 }
 
 // Ask the destination to register the node as a stepbrother
 func (nc *NodeCaller) RegisterStepbrother(node *cluster.ClusterTopologyNode, destination *cluster.OvoNode) (*cluster.ClusterTopology, error) {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
-	}
-	var topology = new(cluster.ClusterTopology)
-	var err = client.Call("InnerServer.RegisterStepbrother", node, topology)
-	if err != nil {
-		topology = nil
-		log.Println("InnerServer.RegisterStepbrother error: ", err)
-	}
-	return topology, err
+	return nc.callTopology(destination, "InnerServer.RegisterStepbrother", nc.withSecret(node))
 }
 
 // Ask the destination to register the node as a twin and a stepbrother
 func (nc *NodeCaller) RegisterTwinAndStepbrother(node *cluster.ClusterTopologyNode, destination *cluster.OvoNode) (*cluster.ClusterTopology, error) {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
-	}
-	var topology = new(cluster.ClusterTopology)
-	var err = client.Call("InnerServer.RegisterTwinAndStepbrother", node, topology)
-	if err != nil {
-		topology = nil
-		log.Println("InnerServer.RegisterTwinAndStepbrother error: ", err)
-	}
-	return topology, err
+	return nc.callTopology(destination, "InnerServer.RegisterTwinAndStepbrother", nc.withSecret(node))
 }
 
 // Ask the destination to give the topology
 func (nc *NodeCaller) GetTopology(currentNode string, destination *cluster.OvoNode) (*cluster.ClusterTopology, error) {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
-	}
-	var topology = new(cluster.ClusterTopology)
-	var err = client.Call("InnerServer.GetTopology", currentNode, topology)
-	if err != nil {
-		topology = nil
-		log.Println("InnerServer.GetTopology error: ", err)
-	}
-	return topology, err
+	return nc.callTopology(destination, "InnerServer.GetTopology", currentNode)
 }
 
 // Ask the destination to update the topology
 func (nc *NodeCaller) UpdateTopology(topology *cluster.ClusterTopology, destination *cluster.OvoNode) (*cluster.ClusterTopology, error) {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
-	}
-	var mergedtopology = new(cluster.ClusterTopology)
-	var err = client.Call("InnerServer.UpdateTopology", topology, mergedtopology)
-	if err != nil {
-		mergedtopology = nil
-		log.Println("InnerServer.UpdateTopology error: ", err)
-	}
-	return mergedtopology, err
+	signed := *topology
+	signed.Secret = nc.Secret
+	return nc.callTopology(destination, "InnerServer.UpdateTopology", &signed)
 }
 
 // Ask the destination to update the node
 func (nc *NodeCaller) UpdateNode(node *cluster.ClusterTopologyNode, destination *cluster.OvoNode) (*cluster.ClusterTopology, error) {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
-	}
-	var topology = new(cluster.ClusterTopology)
-	var err = client.Call("InnerServer.UpdateNode", node, topology)
-	if err != nil {
-		topology = nil
-		log.Println("InnerServer.UpdateNode error: ", err)
-	}
-	return topology, err
+	return nc.callTopology(destination, "InnerServer.UpdateNode", nc.withSecret(node))
 }
 
-// Ask the destination to give the topology
+// Check if the destination is alive
 func (nc *NodeCaller) Ping(currentNode string, destination *cluster.OvoNode) error {
-	defer func() {
-		// executes normally even if there is a panic
-		if err2 := recover(); err2 != nil {
-			//remove the client
-			nc.deleteCaller(destination.Name)
-		}
-	}()
-	var client *rpc.Client
-	var ok bool
-	if client, ok = nc.getCaller(destination.Name); !ok {
-		client = nc.createClient(destination)
-	}
 	var reply int = 0
-	var err = client.Call("InnerServer.Ping", currentNode, &reply)
-	if err != nil {
-		log.Println("InnerServer.Ping error: ", err)
-	}
-	return err
+	return nc.call(destination, "InnerServer.Ping", currentNode, &reply)
 }
 
 // Remove a client by name
 func (nc *NodeCaller) RemoveClient(name string) {
-	delete(nc.clients, name)
+	nc.deleteCaller(name, nil)
 }
 
 // Create the client.
-func (nc *NodeCaller) createClient(destination *cluster.OvoNode) *rpc.Client {
-	defer func() {
-		// Println executes normally even if there is a panic
-		if err := recover(); err != nil {
-			log.Println("run time panic: %v", err)
-		}
-	}()
-	client, err := rpc.DialHTTP("tcp", destination.APIHost+":"+strconv.Itoa(destination.APIPort))
+func (nc *NodeCaller) createClient(destination *cluster.OvoNode) (transport.Transport, error) {
+	client, err := transport.Dial(destination.APIHost+":"+strconv.Itoa(destination.APIPort), nc.Protocol, nc.PoolSize, nc.Timeout, nc.TLSConfig)
 	if err != nil {
-		log.Printf("dialing: %v \r\n", err)
-		return nil
-	} else {
-		nc.addCaller(destination.Name, client)
-		return client
+		return nil, err
 	}
+	return nc.addCaller(destination.Name, client), nil
 }
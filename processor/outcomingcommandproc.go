@@ -1,154 +1,301 @@
 package processor
 
 import (
+	"errors"
 	"github.com/maxzerbini/ovo/cluster"
 	"github.com/maxzerbini/ovo/command"
 	"github.com/maxzerbini/ovo/storage"
 	"github.com/maxzerbini/ovo/util"
+	"sync"
 	"time"
 )
 
+var errHinted = errors.New("Older mutations are pending.")
+
+// A command queued for the replication. If sent is not nil the command is synchronous:
+// when the command is queued on the pipelines the channels of the results of the twins are written on sent.
+type queuedCommand struct {
+	cmd  *command.Command
+	sent chan []chan error
+}
+
 type OutCommandQueue struct {
-	commands      chan *command.Command
-	errors        chan *commandError
+	commands      chan *queuedCommand
+	hints         *HintedHandoff
+	pipelines     map[string]*pipeline
+	batchSize     int
+	pipelinesMux  *sync.Mutex
 	serverNode    *cluster.ClusterTopologyNode
 	topology      *cluster.ClusterTopology
 	Caller        *NodeCaller
 	incomingQueue *InCommandQueue
 }
 
-// Create the outcoming command processor queue
-func NewOutCommandQueue(serverNode *cluster.ClusterTopologyNode, topology *cluster.ClusterTopology, incomingQueue *InCommandQueue) *OutCommandQueue {
+// Create the outcoming command processor queue.
+// The commands are sent to every twin by its own pipeline in batches of at most batchSize commands.
+// The mutations for the unreachable nodes are kept as hints (at most maxHints for every node, not older than hintsMaxAge).
+func NewOutCommandQueue(serverNode *cluster.ClusterTopologyNode, topology *cluster.ClusterTopology, incomingQueue *InCommandQueue, batchSize int, maxHints int, hintsMaxAge time.Duration, hintsPath string) *OutCommandQueue {
 	cq := new(OutCommandQueue)
-	cq.commands = make(chan *command.Command, commands_buffer_size)
-	cq.errors = make(chan *commandError, commands_buffer_size)
+	cq.commands = make(chan *queuedCommand, commands_buffer_size)
+	cq.pipelines = make(map[string]*pipeline)
+	cq.batchSize = batchSize
+	cq.pipelinesMux = new(sync.Mutex)
 	cq.serverNode = serverNode
 	cq.topology = topology
 	cq.incomingQueue = incomingQueue
 	cq.Caller = NewNodeCaller(serverNode.Node.Name)
+	cq.hints = NewHintedHandoff(cq.Caller, maxHints, hintsMaxAge, hintsPath)
 	go cq.backend()
-	go cq.errorBackend()
 	return cq
 }
 
+// Replay the hints of a node that responds again.
+func (cq *OutCommandQueue) ReplayHints(name string) {
+	cq.hints.Replay(name)
+}
+
+// Get the replication pipeline of the destination.
+func (cq *OutCommandQueue) pipelineFor(destination *cluster.OvoNode) *pipeline {
+	cq.pipelinesMux.Lock()
+	defer cq.pipelinesMux.Unlock()
+	pl, ok := cq.pipelines[destination.Name]
+	if !ok {
+		pl = newPipeline(destination, cq.Caller, cq.hints, cq.batchSize)
+		cq.pipelines[destination.Name] = pl
+	} else {
+		pl.setDestination(destination)
+	}
+	return pl
+}
+
+// Queue the command on the pipelines of the twins. It returns the channels of the results of the twins.
+func (cq *OutCommandQueue) replicate(obj *storage.MetaDataUpdObj, operation string) []chan error {
+	twins := cq.topology.GetTwins(cq.serverNode.Replicas())
+	results := make([]chan error, len(twins))
+	for i, node := range twins {
+		results[i] = make(chan error, 1)
+		cq.pipelineFor(node.Node).push(&command.RpcCommand{Source: cq.serverNode.Node.Name, OpCode: operation, Obj: obj}, results[i])
+	}
+	return results
+}
+
+// Queue a batch of commands on the pipelines of the twins as a single command. It returns the channels of the results of the twins.
+func (cq *OutCommandQueue) replicateBatch(batch []*command.Command) []chan error {
+	twins := cq.topology.GetTwins(cq.serverNode.Replicas())
+	results := make([]chan error, len(twins))
+	for i, node := range twins {
+		results[i] = make(chan error, 1)
+		cq.pipelineFor(node.Node).push(&command.RpcCommand{Source: cq.serverNode.Node.Name, OpCode: "batch", Batch: batch}, results[i])
+	}
+	return results
+}
+
+// Queue the command on the pipelines of all the other nodes of the cluster, the unreachable nodes get it from the hints.
+func (cq *OutCommandQueue) broadcast(obj *storage.MetaDataUpdObj, operation string) {
+	for _, node := range cq.topology.GetNodesExcept(cq.serverNode.Node.Name) {
+		cq.pipelineFor(node.Node).push(&command.RpcCommand{Source: cq.serverNode.Node.Name, OpCode: operation, Obj: obj}, nil)
+	}
+}
+
+// Get the counters of the replication pipelines by destination.
+func (cq *OutCommandQueue) ReplicationStats() map[string]PipelineStats {
+	cq.pipelinesMux.Lock()
+	defer cq.pipelinesMux.Unlock()
+	stats := make(map[string]PipelineStats, len(cq.pipelines))
+	for name, pl := range cq.pipelines {
+		stats[name] = pl.Stats()
+	}
+	return stats
+}
+
+// Get the counters of the hints.
+func (cq *OutCommandQueue) HintsStats() HintsStats {
+	return cq.hints.Stats()
+}
+
 func (cq *OutCommandQueue) Enqueu(cmd *command.Command) {
-	cq.commands <- cmd
+	cq.commands <- &queuedCommand{cmd: cmd}
 }
 
 func (cq *OutCommandQueue) backend() {
-	for cmd := range cq.commands {
-		if cmd != nil {
-			switch cmd.OpCode {
-			case "put":
-				cq.execute(cmd.Obj, cmd.OpCode)
-			case "delete":
-				cq.execute(cmd.Obj, cmd.OpCode)
-			case "touch":
-				cq.execute(cmd.Obj, cmd.OpCode)
-			case "updatevalue":
-				cq.execute(cmd.Obj, cmd.OpCode)
-			case "updatekey":
-				cq.executeUpdateKey(cmd.Obj, cmd.OpCode)
-			case "updatekeyvalue":
-				cq.executeUpdateKey(cmd.Obj, cmd.OpCode)
-			case "move":
-				cq.move(cmd.Obj)
-			case "setcounter":
-				cq.execute(cmd.Obj, cmd.OpCode)
-			case "deletecounter":
-				cq.execute(cmd.Obj, cmd.OpCode)
-			case "movecounter":
-				cq.moveCounter(cmd.Obj)
-			default:
-				println("usupported command: " + cmd.OpCode)
-			}
+	for item := range cq.commands {
+		results := cq.dispatch(item.cmd)
+		if item.sent != nil {
+			item.sent <- results
 		}
 	}
 }
 
-func (cq *OutCommandQueue) execute(obj *storage.MetaDataUpdObj, operation string) {
-	for _, node := range cq.topology.GetTwins(cq.serverNode.Twins) {
-		err := cq.Caller.ExecuteOperation(obj, node.Node, operation)
-		if err != nil {
-			cq.enqueuError(newCommandError(obj, node.Node, operation))
-		}
+// Queue the command on the pipelines of its destinations. It returns the channels of the results of the twins,
+// nil if the command is not replicated on the twins.
+func (cq *OutCommandQueue) dispatch(cmd *command.Command) []chan error {
+	if cmd == nil {
+		return nil
+	}
+	switch cmd.OpCode {
+	case "put":
+		return cq.execute(cmd.Obj, cmd.OpCode)
+	case "delete":
+		return cq.execute(cmd.Obj, cmd.OpCode)
+	case "touch":
+		return cq.execute(cmd.Obj, cmd.OpCode)
+	case "updatevalue":
+		return cq.execute(cmd.Obj, cmd.OpCode)
+	case "updatekey":
+		return cq.executeUpdateKey(cmd.Obj)
+	case "updatekeyvalue":
+		return cq.executeUpdateKey(cmd.Obj)
+	case "move":
+		cq.move(cmd.Obj)
+	case "setcounter":
+		return cq.execute(cmd.Obj, cmd.OpCode)
+	case "deletecounter":
+		return cq.execute(cmd.Obj, cmd.OpCode)
+	case "movecounter":
+		cq.moveCounter(cmd.Obj)
+	case "dropcollection":
+		cq.broadcast(cmd.Obj, cmd.OpCode)
+	case "batch":
+		return cq.replicateBatch(cmd.Batch)
+	default:
+		println("usupported command: " + cmd.OpCode)
 	}
+	return nil
 }
 
-func (cq *OutCommandQueue) executeUpdateKey(obj *storage.MetaDataUpdObj, operation string) {
-	if !util.Contains(cq.serverNode.Node.HashRange, obj.NewHash) {
-		// delete the data on the twins
-		for _, node := range cq.topology.GetTwins(cq.serverNode.Twins) {
-			err := cq.Caller.ExecuteOperation(obj, node.Node, "delete")
-			if err != nil {
-				cq.enqueuError(newCommandError(obj, node.Node, "delete"))
+func (cq *OutCommandQueue) execute(obj *storage.MetaDataUpdObj, operation string) []chan error {
+	return cq.replicate(obj, operation)
+}
+
+// Queue the command on the pipelines of the twins and wait at most timeout for the required acknowledgements.
+// The command follows the same ordered path of the asynchronous commands, so the twins receive the changes of a key
+// in the order they are made. The commands that fail are kept as hints. It returns the number of twins that acknowledged
+// the command in time. A command that moves the object to another node is not waited for and it counts as acknowledged
+// by all the required twins.
+func (cq *OutCommandQueue) ExecuteSync(cmd *command.Command, required int, timeout time.Duration) int {
+	if (cmd.OpCode == "updatekey" || cmd.OpCode == "updatekeyvalue") && !util.Contains(cq.serverNode.Node.HashRange, cmd.Obj.NewHash) {
+		// the object is moved to another node, its replication is asynchronous
+		cq.Enqueu(cmd)
+		return required
+	}
+	timeoutChan := time.After(timeout)
+	sent := make(chan []chan error, 1)
+	cq.commands <- &queuedCommand{cmd: cmd, sent: sent}
+	var dones []chan error
+	select {
+	case dones = <-sent:
+	case <-timeoutChan:
+		return 0
+	}
+	results := make(chan bool, len(dones))
+	for _, done := range dones {
+		go func(done chan error) {
+			results <- <-done == nil
+		}(done)
+	}
+	acks := 0
+	for i := 0; i < len(dones) && acks < required; i++ {
+		select {
+		case ok := <-results:
+			if ok {
+				acks++
 			}
+		case <-timeoutChan:
+			return acks
 		}
-		// move the data because the new hashcode does not belong to this node
-		cq.move(obj)
-	} else {
-		// update data on the twins
-		for _, node := range cq.topology.GetTwins(cq.serverNode.Twins) {
-			err := cq.Caller.ExecuteOperation(obj, node.Node, operation)
+	}
+	return acks
+}
+
+// The copy of an object read from a twin, Obj is nil if the twin does not have the object.
+type ReplicaRead struct {
+	Node *cluster.OvoNode
+	Obj  *storage.MetaDataUpdObj
+}
+
+// Read the object from the twins in parallel and wait at most timeout for the required responses.
+// It returns the responses received in time.
+func (cq *OutCommandQueue) ReadSync(key string, required int, timeout time.Duration) []*ReplicaRead {
+	twins := cq.topology.GetTwins(cq.serverNode.Replicas())
+	results := make(chan *ReplicaRead, len(twins))
+	for _, node := range twins {
+		go func(destination *cluster.OvoNode) {
+			obj, err := cq.Caller.ReadObject(key, destination)
 			if err != nil {
-				cq.enqueuError(newCommandError(obj, node.Node, operation))
+				results <- nil
+			} else {
+				results <- &ReplicaRead{Node: destination, Obj: obj}
 			}
+		}(node.Node)
+	}
+	reads := make([]*ReplicaRead, 0, required)
+	timeoutChan := time.After(timeout)
+	for i := 0; i < len(twins) && len(reads) < required; i++ {
+		select {
+		case read := <-results:
+			if read != nil {
+				reads = append(reads, read)
+			}
+		case <-timeoutChan:
+			return reads
 		}
 	}
+	return reads
 }
 
-func (cq *OutCommandQueue) move(obj *storage.MetaDataUpdObj) {
-	if node := cq.topology.GetNodeByHash(obj.Hash); node != nil {
-		err := cq.Caller.ExecuteOperation(obj, node.Node, "move")
-		if err != nil {
-			cq.enqueuError(newCommandError(obj, node.Node, "move"))
-		} else {
-			cq.incomingQueue.Enqueu(&command.Command{OpCode: "delete", Obj: obj})
-		}
-	}
+// Write the newest copy of the object on a stale twin, the twin stores it only if its copy is still older.
+func (cq *OutCommandQueue) Repair(obj *storage.MetaDataUpdObj, destination *cluster.OvoNode) {
+	cq.executeOn(obj, destination, "repair")
 }
 
-func (cq *OutCommandQueue) moveCounter(obj *storage.MetaDataUpdObj) {
-	if node := cq.topology.GetNodeByHash(obj.Hash); node != nil {
-		err := cq.Caller.ExecuteOperation(obj, node.Node, "setcounter")
-		if err != nil {
-			cq.enqueuError(newCommandError(obj, node.Node, "setcounter"))
-		} else {
-			cq.incomingQueue.Enqueu(&command.Command{OpCode: "deletecounter", Obj: obj})
-		}
+// Execute the operation on a single destination node. If the node is unreachable, or older mutations
+// for the node are pending, the operation is stored as a hint and replayed in order later.
+func (cq *OutCommandQueue) executeOn(obj *storage.MetaDataUpdObj, destination *cluster.OvoNode, operation string) error {
+	if cq.hints.Pending(destination.Name) {
+		cq.hints.Add(obj, destination, operation)
+		return errHinted
+	}
+	err := cq.Caller.ExecuteOperation(obj, destination, operation)
+	if err != nil {
+		cq.hints.Add(obj, destination, operation)
 	}
+	return err
 }
 
-func (cq *OutCommandQueue) enqueuError(cmd *commandError) {
-	go func() {
-		cmd.count++
-		time.Sleep(5000000000) // 5 secs
-		cq.errors <- cmd
-	}()
+// Get the commands that replicate a renamed object (Key and Hash are the old ones, NewKey and NewHash the new ones):
+// the versioned put of the object with the new key and the removal of the old key, applied only if the copy is outdated
+// by the renamed object. So repeated or reordered deliveries converge like the other versioned commands.
+func renameCommands(obj *storage.MetaDataUpdObj) (put *command.Command, remove *command.Command) {
+	renamed := &storage.MetaDataUpdObj{Key: obj.NewKey, Data: obj.Data, Collection: obj.Collection, CreationDate: obj.CreationDate, TTL: obj.TTL, Hash: obj.NewHash, Timestamp: obj.Timestamp, Version: obj.Version}
+	removed := &storage.MetaDataUpdObj{Key: obj.Key, Hash: obj.Hash, Timestamp: obj.Timestamp, Version: obj.Version}
+	return &command.Command{OpCode: "put", Obj: renamed}, &command.Command{OpCode: "deleteifoutdated", Obj: removed}
 }
 
-type commandError struct {
-	obj         *storage.MetaDataUpdObj
-	operation   string
-	destination *cluster.OvoNode
-	count       int
+func (cq *OutCommandQueue) executeUpdateKey(obj *storage.MetaDataUpdObj) []chan error {
+	put, remove := renameCommands(obj)
+	if !util.Contains(cq.serverNode.Node.HashRange, obj.NewHash) {
+		// delete the data on the twins
+		cq.replicate(remove.Obj, remove.OpCode)
+		// move the data because the new hashcode does not belong to this node
+		cq.move(put.Obj)
+		return nil
+	}
+	// update data on the twins
+	return cq.replicateBatch([]*command.Command{put, remove})
 }
 
-func newCommandError(o *storage.MetaDataUpdObj, dest *cluster.OvoNode, op string) *commandError {
-	return &commandError{obj: o, operation: op, destination: dest}
+func (cq *OutCommandQueue) move(obj *storage.MetaDataUpdObj) {
+	if node := cq.topology.GetNodeByHash(obj.Hash); node != nil {
+		if err := cq.executeOn(obj, node.Node, "move"); err == nil {
+			cq.incomingQueue.Enqueu(&command.Command{OpCode: "delete", Obj: obj})
+		}
+	}
 }
 
-func (cq *OutCommandQueue) errorBackend() {
-	for cmd := range cq.errors {
-		if cmd != nil {
-			if cmd.count < 4 {
-				err := cq.Caller.ExecuteOperation(cmd.obj, cmd.destination, cmd.operation)
-				if err != nil {
-					cq.enqueuError(cmd)
-				}
-			} else {
-				// TODO remove node from topology
-			}
+func (cq *OutCommandQueue) moveCounter(obj *storage.MetaDataUpdObj) {
+	if node := cq.topology.GetNodeByHash(obj.Hash); node != nil {
+		if err := cq.executeOn(obj, node.Node, "setcounter"); err == nil {
+			cq.incomingQueue.Enqueu(&command.Command{OpCode: "deletecounter", Obj: obj})
 		}
 	}
 }
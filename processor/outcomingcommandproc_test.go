@@ -0,0 +1,35 @@
+package processor
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+func TestExecuteSyncOrder(t *testing.T) {
+	t.Log("TestExecuteSyncOrder started")
+	twin := startFakeNode(t, "twin")
+	serverNode := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "owner", State: cluster.Active}, Twins: []string{"twin"}}
+	topology := &cluster.ClusterTopology{Nodes: []*cluster.ClusterTopologyNode{serverNode, {Node: twin.node}}}
+	out := NewOutCommandQueue(serverNode, topology, nil, 10, 0, 0, "")
+	for i := 0; i < 500; i++ {
+		key := "key" + strconv.Itoa(i)
+		out.Enqueu(&command.Command{OpCode: "put", Obj: &storage.MetaDataUpdObj{Key: key, Data: []byte(key)}})
+	}
+	// the synchronous put follows the asynchronous delete of the same key
+	out.Enqueu(&command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: "key"}})
+	if acks := out.ExecuteSync(&command.Command{OpCode: "put", Obj: &storage.MetaDataUpdObj{Key: "key", Data: []byte("v")}}, 1, 5*time.Second); acks != 1 {
+		t.Fatalf("%d acknowledgements", acks)
+	}
+	keys := twin.keys()
+	if len(keys) != 502 || keys[500] != "key" || keys[501] != "key" || twin.received[500].OpCode != "delete" {
+		t.Fatal("the synchronous command has been sent before the queued commands")
+	}
+	if _, err := twin.store.Get("key"); err != nil {
+		t.Fatal("the synchronous put has been deleted on the twin")
+	}
+}
@@ -1,29 +1,61 @@
 package processor
 
 import (
+	"errors"
 	"github.com/maxzerbini/ovo/cluster"
 	"github.com/maxzerbini/ovo/command"
 	"github.com/maxzerbini/ovo/storage"
 	"github.com/maxzerbini/ovo/util"
 	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SyncPageSize       = 500
+	SyncRetries        = 3
+	SyncSessionTimeout = 10 * time.Minute // a copy that does not ask a page for this time is discarded
 )
 
 func NewPartitioner(storage storage.OvoStorage, serverNode *cluster.ClusterTopologyNode, outcomingQueue *OutCommandQueue) *Partitioner {
-	return &Partitioner{storage: storage, serverNode: serverNode, outcomingQueue: outcomingQueue}
+	return &Partitioner{storage: storage, serverNode: serverNode, outcomingQueue: outcomingQueue, syncedTwins: make([]string, 0), sessions: make(map[string]*syncSession), mux: new(sync.Mutex), sessionsMux: new(sync.Mutex)}
 }
 
 type Partitioner struct {
 	storage        storage.OvoStorage
 	serverNode     *cluster.ClusterTopologyNode
 	outcomingQueue *OutCommandQueue
+	syncedTwins    []string
+	ownedSlots     []int
+	sessions       map[string]*syncSession // the copies in progress by twin
+	mux            *sync.Mutex
+	sessionsMux    *sync.Mutex
+}
+
+// A copy in progress for a twin: the keys owned by the node are listed and sorted once when the copy starts,
+// the pages are read in order from the sorted keys. The keys written after the start reach the twin by replication.
+type syncSession struct {
+	keys     []string
+	lastUsed time.Time
 }
 
+// Check if the current node replicates the data of the owner of the hashcode.
+func (p *Partitioner) isReplica(hash int) bool {
+	if node := p.outcomingQueue.topology.GetNodeByHash(hash); node != nil {
+		return util.ContainsString(node.Replicas(), p.serverNode.Node.Name)
+	}
+	return false
+}
+
+// Move the data that do not belong to this node and synchronize the new twins.
 func (p *Partitioner) MoveData() {
+	defer p.SyncTwins()
 	var list = p.storage.List()
 	log.Printf("Partitioner is moving data (storage size = %d)\r\n", len(list))
 	for _, obj := range list {
 		if obj != nil {
-			if !util.Contains(p.serverNode.Node.HashRange, obj.Hash) {
+			if !util.Contains(p.serverNode.Node.HashRange, obj.Hash) && !p.isReplica(obj.Hash) {
 				log.Printf("Moving key = %s\r\n", obj.Key)
 				p.outcomingQueue.Enqueu(&command.Command{OpCode: "move", Obj: obj.MetaDataUpdObj()})
 			}
@@ -33,7 +65,7 @@ func (p *Partitioner) MoveData() {
 	log.Printf("Partitioner is moving counters (storage size = %d)\r\n", len(counters))
 	for _, obj := range counters {
 		if obj != nil {
-			if !util.Contains(p.serverNode.Node.HashRange, obj.Hash) {
+			if !util.Contains(p.serverNode.Node.HashRange, obj.Hash) && !p.isReplica(obj.Hash) {
 				log.Printf("Moving counter key = %s\r\n", obj.Key)
 				p.outcomingQueue.Enqueu(&command.Command{OpCode: "movecounter", Obj: obj.MetaDataUpdObj()})
 			}
@@ -41,6 +73,203 @@ func (p *Partitioner) MoveData() {
 	}
 }
 
+// Copy the data owned by this node on the twins that were not synchronized yet
+// and the data of the slots gained by this node (e.g. in a failover) on the other twins.
+// The syncing twins copy the data by themselves.
+func (p *Partitioner) SyncTwins() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	replicas := p.serverNode.Replicas()
+	owned := append(make([]int, 0, len(p.serverNode.Node.HashRange)), p.serverNode.Node.HashRange...)
+	gained := make([]int, 0)
+	for _, slot := range owned {
+		if !util.Contains(p.ownedSlots, slot) {
+			gained = append(gained, slot)
+		}
+	}
+	for _, node := range p.outcomingQueue.topology.GetTwins(replicas) {
+		if cluster.Syncing == node.Node.State {
+			continue
+		}
+		if !util.ContainsString(p.syncedTwins, node.Node.Name) {
+			p.ReplicateTo(node.Node)
+		} else if len(gained) > 0 {
+			log.Printf("Partitioner is replicating %d gained slots on the twin %s\r\n", len(gained), node.Node.Name)
+			p.replicateSlots(node.Node, gained)
+		}
+	}
+	p.syncedTwins = append(make([]string, 0, len(replicas)), replicas...)
+	p.ownedSlots = owned
+}
+
+// Copy all the data owned by this node on the destination node.
+func (p *Partitioner) ReplicateTo(destination *cluster.OvoNode) {
+	log.Printf("Partitioner is synchronizing the twin %s\r\n", destination.Name)
+	p.replicateSlots(destination, p.serverNode.Node.HashRange)
+}
+
+// Copy the data of the slots on the destination node.
+func (p *Partitioner) replicateSlots(destination *cluster.OvoNode, slots []int) {
+	for _, obj := range p.storage.List() {
+		if obj != nil && util.Contains(slots, obj.Hash) {
+			p.outcomingQueue.executeOn(obj.MetaDataUpdObj(), destination, "put")
+		}
+	}
+	for _, obj := range p.storage.ListCounters() {
+		if obj != nil && util.Contains(slots, obj.Hash) {
+			p.outcomingQueue.executeOn(obj.MetaDataUpdObj(), destination, "setcounter")
+		}
+	}
+}
+
+// Get a page of the data owned by this node. The time to live of the items is reduced by the elapsed time.
+// The first page of a copy lists the owned keys, the next pages continue from the key after which the previous page ended.
+func (p *Partitioner) SyncPage(req *command.SyncRequest) *command.SyncPage {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = SyncPageSize
+	}
+	keys := p.syncKeys(req)
+	start := sort.SearchStrings(keys, req.After)
+	if start < len(keys) && req.After != "" && keys[start] == req.After {
+		start++
+	}
+	items := make([]*storage.MetaDataUpdObj, 0, limit)
+	page := &command.SyncPage{Done: true}
+	for i := start; i < len(keys); i++ {
+		if len(items) == limit {
+			page.Done = false
+			break
+		}
+		page.Last = keys[i]
+		if req.Counters {
+			if cnt, err := p.storage.GetCounter(keys[i]); err == nil {
+				if ttl, ok := remainingTTL(cnt.CreationDate, cnt.TTL); ok {
+					obj := cnt.MetaDataUpdObj()
+					obj.TTL = ttl
+					items = append(items, obj)
+				}
+			}
+		} else if item, err := p.storage.Get(keys[i]); err == nil {
+			if ttl, ok := remainingTTL(item.CreationDate, item.TTL); ok {
+				obj := item.MetaDataUpdObj()
+				obj.TTL = ttl
+				items = append(items, obj)
+			}
+		}
+	}
+	page.Objects = items
+	if page.Done {
+		p.sessionsMux.Lock()
+		delete(p.sessions, syncSessionID(req))
+		p.sessionsMux.Unlock()
+	}
+	return page
+}
+
+// Get the identifier of the copy of a twin.
+func syncSessionID(req *command.SyncRequest) string {
+	if req.Counters {
+		return req.Source + "/counters"
+	}
+	return req.Source
+}
+
+// Get the sorted keys of the copy of a twin. They are listed when the copy starts (or restarts after the session was lost),
+// the sessions not used for SyncSessionTimeout are discarded.
+func (p *Partitioner) syncKeys(req *command.SyncRequest) []string {
+	id := syncSessionID(req)
+	now := time.Now()
+	p.sessionsMux.Lock()
+	defer p.sessionsMux.Unlock()
+	for name, session := range p.sessions {
+		if now.Sub(session.lastUsed) > SyncSessionTimeout {
+			delete(p.sessions, name)
+		}
+	}
+	session, ok := p.sessions[id]
+	if !ok || req.After == "" {
+		keys := make([]string, 0)
+		if req.Counters {
+			for _, cnt := range p.storage.ListCounters() {
+				if util.Contains(p.serverNode.Node.HashRange, cnt.Hash) {
+					keys = append(keys, cnt.Key)
+				}
+			}
+		} else {
+			for _, item := range p.storage.List() {
+				if util.Contains(p.serverNode.Node.HashRange, item.Hash) {
+					keys = append(keys, item.Key)
+				}
+			}
+		}
+		sort.Strings(keys)
+		session = &syncSession{keys: keys}
+		p.sessions[id] = session
+	}
+	session.lastUsed = now
+	return session.keys
+}
+
+// Copy the data owned by the source node page by page, the objects are stored only if they are newer than the stored ones.
+// The counters have no version, so only the missing counters are set: a counter already stored has been replicated
+// during the copy and it is newer than the page.
+func (p *Partitioner) PullFrom(source *cluster.OvoNode) error {
+	log.Printf("Partitioner is copying the data of node %s\r\n", source.Name)
+	objects, counters := 0, 0
+	for _, onlyCounters := range []bool{false, true} {
+		req := &command.SyncRequest{Source: p.serverNode.Node.Name, Counters: onlyCounters, Limit: SyncPageSize}
+		for {
+			page, err := p.fetchPage(req, source)
+			if err != nil {
+				log.Printf("Partitioner failed copying the data of node %s: %v\r\n", source.Name, err)
+				return err
+			}
+			for _, obj := range page.Objects {
+				if onlyCounters {
+					if p.storage.SetCounterIfAbsent(obj.MetaDataCounter()) == nil {
+						counters++
+					}
+				} else {
+					p.storage.Put(obj.MetaDataObj())
+					objects++
+				}
+			}
+			if page.Done {
+				break
+			}
+			req.After = page.Last
+		}
+	}
+	log.Printf("Partitioner copied %d objects and %d counters of node %s\r\n", objects, counters, source.Name)
+	return nil
+}
+
+// Get a page of data from the source node retrying if it fails.
+func (p *Partitioner) fetchPage(req *command.SyncRequest, source *cluster.OvoNode) (*command.SyncPage, error) {
+	var err error
+	for i := 0; i < SyncRetries; i++ {
+		var page *command.SyncPage
+		if page, err = p.outcomingQueue.Caller.SyncData(req, source); err == nil && page != nil {
+			return page, nil
+		}
+		time.Sleep(time.Second)
+	}
+	if err == nil {
+		err = errors.New("Empty page.")
+	}
+	return nil, err
+}
+
+// Compute the time to live left to an item, it returns false if the item is expired.
+func remainingTTL(creationDate time.Time, ttl int) (int, bool) {
+	if ttl == 0 {
+		return 0, true
+	}
+	left := ttl - int(time.Since(creationDate)/time.Second)
+	return left, left > 0
+}
+
 func (p *Partitioner) MoveObject(obj *storage.MetaDataObj) {
 	if obj != nil {
 		if !util.Contains(p.serverNode.Node.HashRange, obj.Hash) {
@@ -0,0 +1,78 @@
+package processor
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/inmemory"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+func TestSyncPages(t *testing.T) {
+	t.Log("TestSyncPages started")
+	ks := inmemory.NewInMemoryStorage()
+	for i := 0; i < 25; i++ {
+		var data = storage.NewMetaDataObj("key"+strconv.Itoa(100+i), []byte("test"), "default", 0, i%2)
+		ks.Put(&data)
+	}
+	node := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "owner", HashRange: []int{0}}}
+	p := NewPartitioner(ks, node, nil)
+	req := &command.SyncRequest{Source: "twin", Limit: 5}
+	keys := make([]string, 0)
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("the copy does not end")
+		}
+		page := p.SyncPage(req)
+		for _, obj := range page.Objects {
+			keys = append(keys, obj.Key)
+		}
+		if page.Done {
+			break
+		}
+		// the keys deleted during the copy are skipped
+		ks.Delete("key120")
+		req.After = page.Last
+	}
+	if len(keys) != 12 {
+		t.Fatalf("copied %d keys", len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] || keys[i] == "key120" {
+			t.Fatal("wrong page order")
+		}
+	}
+	if len(p.sessions) != 0 {
+		t.Fatal("the session of a completed copy is not discarded")
+	}
+}
+
+func TestPullFromKeepsCounters(t *testing.T) {
+	t.Log("TestPullFromKeepsCounters started")
+	source := startFakeNode(t, "source")
+	source.node.HashRange = []int{0}
+	source.store.SetCounter(&storage.MetaDataCounter{Key: "replicated", Value: 5})
+	source.store.SetCounter(&storage.MetaDataCounter{Key: "missing", Value: 3})
+	var data = storage.NewMetaDataObj("key", []byte("test"), "default", 0, 0)
+	source.store.Put(&data)
+	ks := inmemory.NewInMemoryStorage()
+	// an increment replicated while the copy is running
+	ks.SetCounter(&storage.MetaDataCounter{Key: "replicated", Value: 6})
+	node := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "twin"}}
+	out := NewOutCommandQueue(node, &cluster.ClusterTopology{}, nil, 0, 0, 0, "")
+	p := NewPartitioner(ks, node, out)
+	if err := p.PullFrom(source.node); err != nil {
+		t.Fatal(err)
+	}
+	if cnt, err := ks.GetCounter("replicated"); err != nil || cnt.Value != 6 {
+		t.Fatal("the copy overwrote a replicated counter")
+	}
+	if cnt, err := ks.GetCounter("missing"); err != nil || cnt.Value != 3 {
+		t.Fatal("missing counter not copied")
+	}
+	if _, err := ks.Get("key"); err != nil {
+		t.Fatal("object not copied")
+	}
+}
@@ -0,0 +1,154 @@
+package processor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+)
+
+const (
+	DefaultBatchSize  = 100
+	maxQueuedCommands = commands_buffer_size // commands queued for a destination before they are moved to the hints
+)
+
+// A command waiting to be sent to a destination. If done is not nil the result of the send is written on it.
+type pipelineItem struct {
+	cmd  *command.RpcCommand
+	date time.Time
+	done chan error
+}
+
+// The counters of the replication pipeline of a destination.
+type PipelineStats struct {
+	Queued    int
+	LagMillis int64
+	Sent      int64
+	Batches   int64
+}
+
+// The replication pipeline of a destination: the commands are sent in order, in batches, by a dedicated goroutine,
+// so a slow destination does not stall the others. The commands that can't be sent are moved to the hints.
+type pipeline struct {
+	destination *cluster.OvoNode
+	caller      *NodeCaller
+	hints       *HintedHandoff
+	batchSize   int
+	queue       []*pipelineItem
+	inflight    []*pipelineItem
+	signal      chan bool
+	stats       PipelineStats
+	mux         *sync.Mutex
+}
+
+func newPipeline(destination *cluster.OvoNode, caller *NodeCaller, hints *HintedHandoff, batchSize int) *pipeline {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	pl := &pipeline{destination: destination, caller: caller, hints: hints, batchSize: batchSize, queue: make([]*pipelineItem, 0), signal: make(chan bool, 1), mux: new(sync.Mutex)}
+	go pl.backend()
+	return pl
+}
+
+// Update the address of the destination.
+func (pl *pipeline) setDestination(destination *cluster.OvoNode) {
+	pl.mux.Lock()
+	defer pl.mux.Unlock()
+	pl.destination = destination
+}
+
+// Queue a command. The command goes to the hints if older commands for the destination are pending in the hints
+// or too many commands are queued.
+func (pl *pipeline) push(cmd *command.RpcCommand, done chan error) {
+	pl.mux.Lock()
+	defer pl.mux.Unlock()
+	item := &pipelineItem{cmd: cmd, date: time.Now(), done: done}
+	if pl.hints.Pending(pl.destination.Name) {
+		pl.hint(item)
+		return
+	}
+	pl.queue = append(pl.queue, item)
+	if len(pl.queue) > maxQueuedCommands {
+		pl.hintQueue()
+		return
+	}
+	select {
+	case pl.signal <- true:
+	default:
+	}
+}
+
+func (pl *pipeline) backend() {
+	for range pl.signal {
+		for {
+			pl.mux.Lock()
+			if len(pl.queue) == 0 {
+				pl.mux.Unlock()
+				break
+			}
+			size := pl.batchSize
+			if size > len(pl.queue) {
+				size = len(pl.queue)
+			}
+			pl.inflight = pl.queue[:size]
+			pl.queue = pl.queue[size:]
+			batch := pl.inflight
+			destination := pl.destination
+			pl.mux.Unlock()
+			cmds := make([]*command.RpcCommand, len(batch))
+			for i, item := range batch {
+				cmds[i] = item.cmd
+			}
+			err := pl.caller.ExecuteCommands(cmds, destination)
+			pl.mux.Lock()
+			pl.inflight = nil
+			if err != nil {
+				// keep the order: the failed batch and the queued commands go to the hints
+				for _, item := range batch {
+					pl.hint(item)
+				}
+				pl.hintQueue()
+			} else {
+				pl.stats.Sent += int64(len(batch))
+				pl.stats.Batches++
+				for _, item := range batch {
+					if item.done != nil {
+						item.done <- nil
+					}
+				}
+			}
+			pl.mux.Unlock()
+		}
+	}
+}
+
+// Move a command to the hints. It must be called holding the lock.
+func (pl *pipeline) hint(item *pipelineItem) {
+	pl.hints.AddCommand(item.cmd, pl.destination)
+	if item.done != nil {
+		item.done <- errHinted
+	}
+}
+
+// Move all the queued commands to the hints. It must be called holding the lock.
+func (pl *pipeline) hintQueue() {
+	for _, item := range pl.queue {
+		pl.hint(item)
+	}
+	pl.queue = make([]*pipelineItem, 0)
+}
+
+// Get the counters of the pipeline, the lag is the age of the oldest command not yet delivered.
+func (pl *pipeline) Stats() PipelineStats {
+	pl.mux.Lock()
+	defer pl.mux.Unlock()
+	stats := pl.stats
+	stats.Queued = len(pl.queue) + len(pl.inflight)
+	if len(pl.inflight) > 0 {
+		stats.LagMillis = int64(time.Since(pl.inflight[0].date) / time.Millisecond)
+	} else if len(pl.queue) > 0 {
+		stats.LagMillis = int64(time.Since(pl.queue[0].date) / time.Millisecond)
+	}
+	return stats
+}
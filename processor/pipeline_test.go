@@ -0,0 +1,100 @@
+package processor
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+// Push a put command for every key, it returns the channels of the results.
+func pushKeys(pl *pipeline, keys ...string) []chan error {
+	results := make([]chan error, len(keys))
+	for i, key := range keys {
+		results[i] = make(chan error, 1)
+		pl.push(&command.RpcCommand{OpCode: "put", Obj: &storage.MetaDataUpdObj{Key: key, Data: []byte(key)}}, results[i])
+	}
+	return results
+}
+
+// Wait the result of every command.
+func waitResults(t *testing.T, results []chan error) []error {
+	errs := make([]error, len(results))
+	for i, result := range results {
+		select {
+		case errs[i] = <-result:
+		case <-time.After(5 * time.Second):
+			t.Fatal("command result not received")
+		}
+	}
+	return errs
+}
+
+func TestPipelineOrderAndBatches(t *testing.T) {
+	t.Log("TestPipelineOrderAndBatches started")
+	twin := startFakeNode(t, "twin")
+	twin.gate = make(chan bool)
+	pl := newPipeline(twin.node, NewNodeCaller("owner"), NewHintedHandoff(nil, 0, 0, ""), 10)
+	keys := make([]string, 25)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	results := pushKeys(pl, keys...)
+	// the first batch is blocked on the twin while the other commands are queued
+	close(twin.gate)
+	for _, err := range waitResults(t, results) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := twin.keys()
+	for i, key := range keys {
+		if received[i] != key {
+			t.Fatalf("command %d sent out of order", i)
+		}
+	}
+	sizes := twin.batchSizes()
+	if len(sizes) >= len(keys) {
+		t.Fatal("commands not batched")
+	}
+	for _, size := range sizes {
+		if size > 10 {
+			t.Fatalf("batch of %d commands", size)
+		}
+	}
+	if stats := pl.Stats(); stats.Sent != 25 || stats.Batches != int64(len(sizes)) || stats.Queued != 0 {
+		t.Fatalf("wrong stats %+v", stats)
+	}
+}
+
+func TestPipelineHints(t *testing.T) {
+	t.Log("TestPipelineHints started")
+	twin := startFakeNode(t, "twin")
+	caller := NewNodeCaller("owner")
+	hints := NewHintedHandoff(caller, 0, 0, "")
+	pl := newPipeline(twin.node, caller, hints, 10)
+	twin.setFail(true)
+	for _, err := range waitResults(t, pushKeys(pl, "a", "b", "c")) {
+		if err != errHinted {
+			t.Fatal("failed command not moved to the hints")
+		}
+	}
+	twin.setFail(false)
+	// the new commands follow the pending hints
+	if err := waitResults(t, pushKeys(pl, "d"))[0]; err != errHinted {
+		t.Fatal("command sent before the pending hints")
+	}
+	if stats := hints.Stats(); stats.Pending["twin"] != 4 {
+		t.Fatalf("wrong pending hints %d", stats.Pending["twin"])
+	}
+	hints.Replay("twin")
+	waitFor(t, func() bool { return !hints.Pending("twin") }, "hints not replayed")
+	if keys := twin.keys(); len(keys) != 4 || keys[0] != "a" || keys[3] != "d" {
+		t.Fatalf("hints replayed out of order %v", keys)
+	}
+	if err := waitResults(t, pushKeys(pl, "e"))[0]; err != nil {
+		t.Fatal("command not sent after the replay")
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/server/model"
+)
+
+const (
+	APIKeyHeader  string = "X-Api-Key"
+	apiKeyContext string = "apikey"
+)
+
+// The level of the roles, every role includes the permissions of the lower ones.
+var roleLevels = map[string]int{RoleReadOnly: 1, RoleReadWrite: 2, RoleAdmin: 3}
+
+// Index the API keys of the configuration.
+func indexAPIKeys(keys []APIKey) map[string]*APIKey {
+	index := make(map[string]*APIKey, len(keys))
+	for i := range keys {
+		if _, ok := roleLevels[keys[i].Role]; !ok {
+			log.Printf("API key with unknown role %s, the key has no access\r\n", keys[i].Role)
+		}
+		index[keys[i].Key] = &keys[i]
+	}
+	return index
+}
+
+// Get the API key of the request from the X-Api-Key header or from the bearer token.
+func requestAPIKey(c *gin.Context) string {
+	if key := c.Request.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	auth := c.Request.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Create the middleware that authenticates the request and checks that the role of its API key includes role.
+// If the configuration has no API keys the API is open.
+func (srv *Server) authorize(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(srv.apiKeys) == 0 {
+			c.Next()
+			return
+		}
+		key, ok := srv.apiKeys[requestAPIKey(c)]
+		if !ok {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.JSON(http.StatusUnauthorized, model.NewOvoResponse("error", "112", nil))
+			c.Abort()
+			return
+		}
+		if roleLevels[key.Role] < roleLevels[role] {
+			c.JSON(http.StatusForbidden, model.NewOvoResponse("error", "113", nil))
+			c.Abort()
+			return
+		}
+		c.Set(apiKeyContext, key)
+		c.Next()
+	}
+}
+
+// Get the access control lists of the API key of the request, nil if the key has no restrictions.
+func requestACLs(c *gin.Context) []command.ACL {
+	if key, ok := c.Get(apiKeyContext); ok {
+		return key.(*APIKey).ACLs
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Create a router with a route for every role.
+func authRouter(keys []APIKey) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	srv := &Server{apiKeys: indexAPIKeys(keys)}
+	router := gin.New()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	router.GET("/read", srv.authorize(RoleReadOnly), ok)
+	router.GET("/write", srv.authorize(RoleReadWrite), ok)
+	router.GET("/admin", srv.authorize(RoleAdmin), ok)
+	return router
+}
+
+// Send a request with the header and return the status code.
+func authStatus(router *gin.Engine, path string, header string, value string) int {
+	req := httptest.NewRequest("GET", path, nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAuthorizeOpen(t *testing.T) {
+	router := authRouter(nil)
+	for _, path := range []string{"/read", "/write", "/admin"} {
+		if code := authStatus(router, path, "", ""); code != http.StatusOK {
+			t.Fatalf("open access to %s, status %d", path, code)
+		}
+	}
+}
+
+func TestAuthorizeMissingKey(t *testing.T) {
+	router := authRouter([]APIKey{{Key: "k1", Role: RoleAdmin}})
+	req := httptest.NewRequest("GET", "/read", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("missing key, status %d", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("missing WWW-Authenticate header")
+	}
+	if code := authStatus(router, "/read", APIKeyHeader, "unknown"); code != http.StatusUnauthorized {
+		t.Fatalf("unknown key, status %d", code)
+	}
+}
+
+func TestAuthorizeHeaders(t *testing.T) {
+	router := authRouter([]APIKey{{Key: "k1", Role: RoleReadOnly}})
+	if code := authStatus(router, "/read", APIKeyHeader, "k1"); code != http.StatusOK {
+		t.Fatalf("X-Api-Key header, status %d", code)
+	}
+	if code := authStatus(router, "/read", "Authorization", "Bearer k1"); code != http.StatusOK {
+		t.Fatalf("bearer token, status %d", code)
+	}
+	if code := authStatus(router, "/read", "Authorization", "bearer k1"); code != http.StatusOK {
+		t.Fatalf("lower case bearer token, status %d", code)
+	}
+	if code := authStatus(router, "/read", "Authorization", "Basic k1"); code != http.StatusUnauthorized {
+		t.Fatalf("basic authorization, status %d", code)
+	}
+}
+
+func TestAuthorizeRoles(t *testing.T) {
+	router := authRouter([]APIKey{{Key: "ro", Role: RoleReadOnly}, {Key: "rw", Role: RoleReadWrite}, {Key: "ad", Role: RoleAdmin}, {Key: "xx", Role: "unknown"}})
+	cases := []struct {
+		key  string
+		path string
+		code int
+	}{
+		{"ro", "/read", http.StatusOK},
+		{"ro", "/write", http.StatusForbidden},
+		{"ro", "/admin", http.StatusForbidden},
+		{"rw", "/read", http.StatusOK},
+		{"rw", "/write", http.StatusOK},
+		{"rw", "/admin", http.StatusForbidden},
+		{"ad", "/read", http.StatusOK},
+		{"ad", "/write", http.StatusOK},
+		{"ad", "/admin", http.StatusOK},
+		{"xx", "/read", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if code := authStatus(router, c.path, APIKeyHeader, c.key); code != c.code {
+			t.Fatalf("key %s on %s, status %d expected %d", c.key, c.path, code, c.code)
+		}
+	}
+}
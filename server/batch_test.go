@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/inmemory"
+	"github.com/maxzerbini/ovo/server/model"
+	"github.com/maxzerbini/ovo/storage"
+	"github.com/maxzerbini/ovo/transport"
+)
+
+// Create a node of the cluster that owns the slots, its inner server listens on a local port.
+func startTestServer(t *testing.T, name string, slots []int, topology *cluster.ClusterTopology) (*Server, *inmemory.InMemoryStorage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	node := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: name, HashRange: slots, APIHost: "127.0.0.1", APIPort: listener.Addr().(*net.TCPAddr).Port, State: cluster.Active}}
+	topology.Nodes = append(topology.Nodes, node)
+	conf := &ServerConf{ServerNode: node, Topology: *topology, RoutingMode: RoutingModeProxy, HashMode: HashModeServer, TxLogDir: t.TempDir()}
+	ks := inmemory.NewInMemoryStorage()
+	srv := NewServer(conf, ks)
+	server := rpc.NewServer()
+	server.RegisterName("InnerServer", srv.innerServer)
+	go transport.Serve(listener, server, server)
+	return srv, ks
+}
+
+// Send a batch request to the node and return the results.
+func sendBatch(t *testing.T, handler gin.HandlerFunc, kvs []model.OvoKVRequest) []model.OvoKVResult {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/batch", handler)
+	body, _ := json.Marshal(kvs)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/batch", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch status %d", w.Code)
+	}
+	var res struct{ Data []model.OvoKVResult }
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Data
+}
+
+func TestDispatchBatch(t *testing.T) {
+	local, remote, dead := cluster.HashKey("local"), cluster.HashKey("remote"), cluster.HashKey("dead")
+	if local == remote || local == dead || remote == dead {
+		t.Skip("the hashtags have the same slot")
+	}
+	topology := &cluster.ClusterTopology{}
+	// the topology of the remote node is complete when the local one is started
+	srvRemote, ksRemote := startTestServer(t, "remote", []int{remote}, topology)
+	srv, ks := startTestServer(t, "local", []int{local}, topology)
+	srvRemote.config.Topology = *topology
+	// a node that does not respond
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	srv.config.Topology.Nodes = append(srv.config.Topology.Nodes, &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "dead", HashRange: []int{dead}, APIHost: "127.0.0.1", APIPort: port, State: cluster.Active}})
+
+	keys := []string{"{remote}1", "{local}1", "{dead}1", "{remote}2", "{local}2", "{dead}2", "{remote}3"}
+	kvs := make([]model.OvoKVRequest, len(keys))
+	for i, key := range keys {
+		kvs[i] = model.OvoKVRequest{Key: key, Data: []byte("v-" + key)}
+	}
+	results := sendBatch(t, srv.mput, kvs)
+	if len(results) != len(keys) {
+		t.Fatalf("%d results for %d keys", len(results), len(keys))
+	}
+	for i, res := range results {
+		if res.Key != keys[i] {
+			t.Fatalf("result %d has key %s expected %s", i, res.Key, keys[i])
+		}
+		expected := "0"
+		if cluster.HashKey(keys[i]) == dead {
+			expected = "108"
+		}
+		if res.Code != expected {
+			t.Fatalf("put of %s has code %s expected %s", keys[i], res.Code, expected)
+		}
+	}
+	// every key is stored only by its owner
+	for _, key := range keys {
+		_, errLocal := ks.Get(key)
+		_, errRemote := ksRemote.Get(key)
+		switch cluster.HashKey(key) {
+		case local:
+			if errLocal != nil || errRemote == nil {
+				t.Fatalf("key %s not stored by the local node only", key)
+			}
+		case remote:
+			if errRemote != nil || errLocal == nil {
+				t.Fatalf("key %s not stored by the remote node only", key)
+			}
+		default:
+			if errLocal == nil || errRemote == nil {
+				t.Fatalf("key %s of the unreachable node stored", key)
+			}
+		}
+	}
+	results = sendBatch(t, srv.mget, kvs)
+	for i, res := range results {
+		if res.Key != keys[i] {
+			t.Fatalf("result %d has key %s expected %s", i, res.Key, keys[i])
+		}
+		if cluster.HashKey(keys[i]) == dead {
+			if res.Code != "108" {
+				t.Fatalf("get of %s has code %s expected 108", keys[i], res.Code)
+			}
+		} else if res.Code != "0" || string(res.Data) != "v-"+keys[i] {
+			t.Fatalf("get of %s has code %s and data %s", keys[i], res.Code, res.Data)
+		}
+	}
+}
+
+func TestExecuteBatchResults(t *testing.T) {
+	srv, ks := startTestServer(t, "local", []int{}, &cluster.ClusterTopology{})
+	ks.Put(&storage.MetaDataObj{Key: "private1", Collection: "private", Data: []byte("v")})
+	acls := []command.ACL{{Collection: "public", Rights: []string{command.RightRead, command.RightWrite, command.RightDelete}}}
+	req := &command.RpcBatchRequest{OpCode: "put", ACLs: acls, Objs: []*storage.MetaDataUpdObj{
+		{Key: "public1", Collection: "public", Data: []byte("v")},
+		{Key: "private1", Collection: "public", Data: []byte("v")},
+		{Key: "private2", Collection: "private", Data: []byte("v")},
+		{Key: "public2", Collection: "public", Data: []byte("v")},
+	}}
+	codes := []string{"0", "114", "114", "0"}
+	res := srv.executor.ExecuteBatch(req)
+	for i, r := range res.Results {
+		if r.Code != codes[i] {
+			t.Fatalf("put of %s has code %s expected %s", req.Objs[i].Key, r.Code, codes[i])
+		}
+	}
+	if obj, _ := ks.Get("private1"); obj.Collection != "private" {
+		t.Fatal("a denied object has been overwritten")
+	}
+	// only the first object fits in the memory
+	ks.SetMemoryLimit(ks.UsedMemory()+300, inmemory.NoEviction)
+	req = &command.RpcBatchRequest{OpCode: "put", Objs: []*storage.MetaDataUpdObj{
+		{Key: "small", Data: make([]byte, 10)},
+		{Key: "large", Data: make([]byte, 1000)},
+	}}
+	res = srv.executor.ExecuteBatch(req)
+	if res.Results[0].Code != "0" || res.Results[1].Code != "107" || res.Results[1].HttpStatus != http.StatusInsufficientStorage {
+		t.Fatalf("put in a full storage has results %v, %v", res.Results[0], res.Results[1])
+	}
+	if _, err := ks.Get("large"); err == nil {
+		t.Fatal("the object that does not fit has been stored")
+	}
+}
@@ -1,21 +1,50 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/transport"
 )
 
 const (
-	DefaultConfPath string = "./conf/severconf.json"
+	DefaultConfPath     string = "./conf/severconf.json"
+	HashModeClient      string = "client"
+	HashModeServer      string = "server"
+	HashModeValidate    string = "validate"
+	RoutingModeLocal    string = "local"
+	RoutingModeProxy    string = "proxy"
+	RoutingModeRedirect string = "redirect"
+	ConsistencyLocal    string = "local"
+	ConsistencyOneTwin  string = "one-twin"
+	ConsistencyAllTwins string = "all-twins"
+	ConsistencyQuorum   string = "quorum"
+	RoleReadOnly        string = "read-only"
+	RoleReadWrite       string = "read-write"
+	RoleAdmin           string = "admin"
+	TxLogExt            string = ".txlog"
+
+	DefaultWriteTimeout      = 1000 // millisecs
+	DefaultReadTimeout       = 1000 // millisecs
+	DefaultAntiEntropyPeriod = 60   // secs
+	DefaultScanCount         = 100
+	MaxScanCount             = 10000
+	DefaultRangeLimit        = 100
+	MaxRangeLimit            = 10000
+	MaxBatchSize             = 1000 // keys of a batch request
+	DefaultTxTimeout         = 5000 // millisecs
+	BootstrapRetryDelay      = 5    // secs
 )
 
 var (
@@ -36,12 +65,54 @@ var (
 )
 
 type ServerConf struct {
-	ServerNode  *cluster.ClusterTopologyNode
-	Topology    cluster.ClusterTopology
-	Debug       bool
-	tmpPath     string
-	HttpBindAll bool
-	TcpBindAll  bool
+	ServerNode        *cluster.ClusterTopologyNode
+	Topology          cluster.ClusterTopology
+	Debug             bool
+	tmpPath           string
+	HttpBindAll       bool
+	TcpBindAll        bool
+	CommandLogPath    string
+	CommandLogSync    string
+	SnapshotPath      string
+	SnapshotPeriod    int
+	MaxMemoryBytes    int64
+	EvictionPolicy    string
+	HashMode          string
+	RoutingMode       string
+	Slots             int
+	VirtualNodes      int
+	ReplicationFactor int
+	WriteConsistency  string
+	WriteTimeout      int
+	ReadConsistency   string
+	ReadTimeout       int
+	AntiEntropyPeriod int
+	MaxHints          int
+	HintsMaxAge       int
+	HintsPath         string
+	BatchSize         int
+	InnerProtocol     string
+	InnerCallTimeout  int
+	InnerPoolSize     int
+	InnerTLSCert      string
+	InnerTLSKey       string
+	InnerTLSCA        string
+	ClusterSecret     string
+	TLSCert           string
+	TLSKey            string
+	APIKeys           []APIKey
+	OrderedIndex      bool
+	TxTimeout         int
+	TxLogDir          string
+	randomName        bool // the name of the node is not configured and changes at every start
+}
+
+// An API key of the RESTful API and its role: read-only, read-write or admin.
+// If the access control lists are not empty the key can access only the objects and counters they grant.
+type APIKey struct {
+	Key  string
+	Role string
+	ACLs []command.ACL
 }
 
 func (cnf *ServerConf) Init(tmpPath string) {
@@ -55,6 +126,7 @@ func (cnf *ServerConf) Init(tmpPath string) {
 	}
 	if cnf.ServerNode.Node.Name == "" {
 		cnf.ServerNode.Node.Name = GetRandomName()
+		cnf.randomName = true
 	}
 	ip := GetServerIP()
 	if cnf.ServerNode.Node.Host == "" {
@@ -68,12 +140,33 @@ func (cnf *ServerConf) Init(tmpPath string) {
 		log.Printf("Setting APIHost %s", ip)
 	}
 	cnf.ServerNode.UpdateDate = time.Now()
+	cluster.Configure(cnf.Slots, cnf.VirtualNodes)
+	cluster.SetReplicationFactor(cnf.ReplicationFactor)
 	cluster.SetCurrentNode(cnf.ServerNode, &cnf.Topology)
 	cnf.tmpPath = tmpPath
 }
 
+// Get the path of the decision log of the distributed transactions, a file named after the node in the directory TxLogDir.
+// The prepare log of the transactions prepared by the node has the same path with the suffix .prepared.
+// It returns an empty path if the directory is not configured.
+func (cnf *ServerConf) TxLog() string {
+	if cnf.TxLogDir == "" {
+		return ""
+	}
+	return filepath.Join(cnf.TxLogDir, cnf.ServerNode.Node.Name+TxLogExt)
+}
+
+// Load the TLS configuration of the inner connections.
+func (cnf *ServerConf) InnerTLSConfig() (*tls.Config, error) {
+	return transport.LoadTLSConfig(cnf.InnerTLSCert, cnf.InnerTLSKey, cnf.InnerTLSCA)
+}
+
+// Write the temporary configuration file, without the cluster secret and the API keys.
 func (cnf *ServerConf) WriteTmp() {
-	WriteConfiguration(cnf.tmpPath, cnf)
+	tmp := *cnf
+	tmp.ClusterSecret = ""
+	tmp.APIKeys = nil
+	WriteConfiguration(cnf.tmpPath, &tmp)
 }
 
 func LoadConfiguration(path string) ServerConf {
@@ -89,7 +182,11 @@ func LoadConfiguration(path string) ServerConf {
 
 func WriteConfiguration(path string, conf *ServerConf) {
 	data, _ := json.Marshal(conf)
-	e := ioutil.WriteFile(path, data, 0x666)
+	e := ioutil.WriteFile(path, data, 0600)
+	if e == nil {
+		// the file may have been created readable by everyone
+		e = os.Chmod(path, 0600)
+	}
 	if e != nil {
 		log.Printf("Configuration file write error at %s\r\n", path)
 	}
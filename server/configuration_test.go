@@ -2,6 +2,10 @@ package server
 
 import (
 	//"github.com/maxzerbini/ovo/cluster"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -25,6 +29,34 @@ func TestConfigurationWrite(t *testing.T) {
 func TestConfigurationLoad(t *testing.T) {
 	t.Log("TestConfigurationLoad started")
 	var conf = LoadConfiguration("../conf/serverconf.json")
-	t.Logf("conf = %s", conf)
-	conf.Init()
+	t.Logf("conf = %v", conf)
+	conf.Init(filepath.Join(t.TempDir(), "serverconf.tmp.json"))
+}
+
+func TestConfigurationWriteTmp(t *testing.T) {
+	var conf = LoadConfiguration("../conf/serverconf.json")
+	path := filepath.Join(t.TempDir(), "serverconf.json.temp")
+	// a file left readable by everyone is restricted
+	ioutil.WriteFile(path, nil, 0666)
+	conf.Init(path)
+	conf.ClusterSecret = "cluster-secret"
+	conf.APIKeys = []APIKey{{Key: "api-key", Role: RoleAdmin}}
+	conf.WriteTmp()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("temporary configuration file with mode %v", info.Mode().Perm())
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "cluster-secret") {
+		t.Fatal("cluster secret written in the temporary configuration file")
+	}
+	if strings.Contains(string(data), "api-key") {
+		t.Fatal("API key written in the temporary configuration file")
+	}
+	if conf.ClusterSecret != "cluster-secret" || len(conf.APIKeys) != 1 {
+		t.Fatal("secrets removed from the configuration")
+	}
 }
@@ -0,0 +1,532 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/processor"
+	"github.com/maxzerbini/ovo/storage"
+	"github.com/maxzerbini/ovo/util"
+)
+
+// The executor applies the client requests on the node storage and replicates the changes on the twins.
+// It is used by the HTTP handlers and by the inner server for the forwarded requests.
+type Executor struct {
+	keystorage  storage.OvoStorage
+	outcmdproc  *processor.OutCommandQueue
+	config      *ServerConf
+	participant *TxParticipant // the distributed transactions prepared on the node
+	coordinator *TxCoordinator // the distributed transactions coordinated by the node, nil if the node does not coordinate
+}
+
+// Create the executor.
+func NewExecutor(ks storage.OvoStorage, out *processor.OutCommandQueue, conf *ServerConf) *Executor {
+	ex := &Executor{keystorage: ks, outcmdproc: out, config: conf}
+	ex.participant = NewTxParticipant(ex)
+	return ex
+}
+
+// Check the consistency level.
+func validConsistency(level string) bool {
+	switch level {
+	case "", ConsistencyLocal, ConsistencyOneTwin, ConsistencyAllTwins, ConsistencyQuorum:
+		return true
+	}
+	return false
+}
+
+// Get the number of twins that must answer to reach the consistency level.
+// The requirement never exceeds the twins of the node, so a node without twins answers all the levels by itself.
+func (ex *Executor) requiredTwins(level string) int {
+	twins := len(ex.config.ServerNode.Replicas())
+	switch level {
+	case ConsistencyOneTwin:
+		if twins == 0 {
+			return 0
+		}
+		return 1
+	case ConsistencyAllTwins:
+		return twins
+	case ConsistencyQuorum:
+		// majority of the copies, the current node included
+		return (twins + 1) / 2
+	}
+	return 0
+}
+
+// Get the number of twins that must acknowledge a write.
+func (ex *Executor) requiredAcks(level string) int {
+	if level == "" {
+		level = ex.config.WriteConsistency
+	}
+	return ex.requiredTwins(level)
+}
+
+// Replicate the command on the twins according to the write consistency of the request.
+func (ex *Executor) replicate(req *command.RpcRequest, cmd *command.Command, obj *storage.MetaDataUpdObj) *command.RpcResponse {
+	required := ex.requiredAcks(req.Consistency)
+	if required == 0 {
+		ex.outcmdproc.Enqueu(cmd)
+		return command.NewRpcResponse(http.StatusOK, "done", "0", obj)
+	}
+	timeout := time.Duration(ex.config.WriteTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DefaultWriteTimeout * time.Millisecond
+	}
+	if acks := ex.outcmdproc.ExecuteSync(cmd, required, timeout); acks < required {
+		return command.NewRpcResponse(http.StatusGatewayTimeout, "error", "109", obj)
+	}
+	return command.NewRpcResponse(http.StatusOK, "done", "0", obj)
+}
+
+// Read the object from the node and from the twins, return the newest copy and repair the stale copies in background.
+func (ex *Executor) read(key string, required int) *command.RpcResponse {
+	timeout := time.Duration(ex.config.ReadTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DefaultReadTimeout * time.Millisecond
+	}
+	reads := ex.outcmdproc.ReadSync(key, required, timeout)
+	if len(reads) < required {
+		return command.NewRpcResponse(http.StatusGatewayTimeout, "error", "110", nil)
+	}
+	var newest *storage.MetaDataObj
+	local, err := ex.keystorage.Get(key)
+	if err == nil {
+		newest = local
+	}
+	for _, read := range reads {
+		if read.Obj != nil {
+			obj := read.Obj.MetaDataObj()
+			obj.CreationDate = read.Obj.CreationDate
+			if newest == nil || newest.IsOutdatedBy(obj) {
+				newest = obj
+			}
+		}
+	}
+	if newest == nil {
+		return command.NewRpcResponse(http.StatusNotFound, "error", "101", nil)
+	}
+	// the copies missing the object are not repaired because a deletion leaves no trace
+	// the repairs are applied only if the copies are still older, so a write received in the meantime is not overwritten
+	go func() {
+		if local != nil && local.IsOutdatedBy(newest) {
+			repair := newest.MetaDataUpdObj().MetaDataObj()
+			repair.CreationDate = newest.CreationDate
+			ex.keystorage.PutIfOutdated(repair)
+		}
+		for _, read := range reads {
+			if read.Obj != nil && read.Obj.MetaDataObj().IsOutdatedBy(newest) {
+				ex.outcmdproc.Repair(newest.MetaDataUpdObj(), read.Node)
+			}
+		}
+	}()
+	return command.NewRpcResponse(http.StatusOK, "done", "0", newest.MetaDataUpdObj())
+}
+
+// Get the command that replicates the current state of an object on the twins, the twins apply it only if their copy is older.
+// If the object has already been removed the response is final, the removal is replicated too.
+func (ex *Executor) stored(key string) (*command.Command, *storage.MetaDataUpdObj, *command.RpcResponse) {
+	res, err := ex.keystorage.Get(key)
+	if err != nil {
+		return nil, nil, command.NewRpcResponse(http.StatusOK, "done", "0", nil)
+	}
+	obj := res.MetaDataUpdObj()
+	return &command.Command{OpCode: "put", Obj: obj}, obj, nil
+}
+
+// Get the command that replicates a renamed object with its old key and its current state, the twins store it
+// with its version and remove the old key only if their copy is older. If the object has already been removed
+// only the removal of the old key is replicated.
+func (ex *Executor) renamed(opcode string, obj *storage.MetaDataUpdObj) (*command.Command, *storage.MetaDataUpdObj, *command.RpcResponse) {
+	res, err := ex.keystorage.Get(obj.NewKey)
+	if err != nil {
+		return &command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: obj.Key}}, nil, nil
+	}
+	ret := res.MetaDataUpdObj()
+	ret.Key, ret.Hash, ret.NewKey, ret.NewHash = obj.Key, obj.Hash, res.Key, res.Hash
+	return &command.Command{OpCode: opcode, Obj: ret}, nil, nil
+}
+
+// Check the right on a stored object. An object that does not exist is allowed only by the entries that match every collection,
+// so a denied request has the same answer whether the object exists or not.
+func (ex *Executor) allowedOn(acls []command.ACL, key string, rights ...string) bool {
+	collection := command.AnyItem
+	if res, err := ex.keystorage.Get(key); err == nil {
+		collection = res.Collection
+	}
+	for _, right := range rights {
+		if !command.Allowed(acls, collection, key, right) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the right on the object that is overwritten, a new object is checked on the collection of the request.
+func (ex *Executor) allowedOver(acls []command.ACL, key string, right string) bool {
+	res, err := ex.keystorage.Get(key)
+	return err != nil || command.Allowed(acls, res.Collection, key, right)
+}
+
+// Check the access control lists of the request on the objects that are read or changed.
+// The counters have no collection, they are checked only on the prefix of the entries.
+func (ex *Executor) allowed(req *command.RpcRequest) bool {
+	if len(req.ACLs) == 0 {
+		return true
+	}
+	obj := req.Obj
+	switch req.OpCode {
+	case "get":
+		return ex.allowedOn(req.ACLs, obj.Key, command.RightRead)
+	case "put":
+		collection := obj.Collection
+		if collection == "" {
+			collection = storage.DefaultCollection
+		}
+		return command.Allowed(req.ACLs, collection, obj.Key, command.RightWrite) && ex.allowedOver(req.ACLs, obj.Key, command.RightWrite)
+	case "getandremove":
+		return ex.allowedOn(req.ACLs, obj.Key, command.RightRead, command.RightDelete)
+	case "updatevalue", "updatevalueifversion":
+		return ex.allowedOn(req.ACLs, obj.Key, command.RightWrite)
+	case "updatekeyvalue", "updatekey":
+		// the object keeps its collection under the new key
+		if res, err := ex.keystorage.Get(obj.Key); err == nil && !command.Allowed(req.ACLs, res.Collection, obj.NewKey, command.RightWrite) {
+			return false
+		}
+		return ex.allowedOn(req.ACLs, obj.Key, command.RightWrite, command.RightDelete) && ex.allowedOver(req.ACLs, obj.NewKey, command.RightWrite)
+	case "delete", "deletevalueifequal", "deletevalueifversion":
+		return ex.allowedOn(req.ACLs, obj.Key, command.RightDelete)
+	case "getcounter":
+		return command.AllowedCounter(req.ACLs, obj.Key, command.RightRead)
+	case "increment", "setcounter":
+		return command.AllowedCounter(req.ACLs, obj.Key, command.RightWrite)
+	case "deletecounter":
+		return command.AllowedCounter(req.ACLs, obj.Key, command.RightDelete)
+	}
+	return true
+}
+
+// Execute a client request.
+func (ex *Executor) Execute(req *command.RpcRequest) *command.RpcResponse {
+	obj := req.Obj
+	if !validConsistency(req.Consistency) {
+		return command.NewRpcResponse(http.StatusBadRequest, "error", "12", nil)
+	}
+	if !ex.allowed(req) {
+		return command.NewRpcResponse(http.StatusForbidden, "error", "114", nil)
+	}
+	switch req.OpCode {
+	case "get":
+		if level := req.Consistency; level != "" || ex.config.ReadConsistency != "" {
+			if level == "" {
+				level = ex.config.ReadConsistency
+			}
+			if required := ex.requiredTwins(level); required > 0 {
+				return ex.read(obj.Key, required)
+			}
+		}
+		if res, err := ex.keystorage.Get(obj.Key); err == nil {
+			return command.NewRpcResponse(http.StatusOK, "done", "0", res.MetaDataUpdObj())
+		}
+		return command.NewRpcResponse(http.StatusNotFound, "error", "101", nil)
+	case "getcounter":
+		if res, err := ex.keystorage.GetCounter(obj.Key); err == nil {
+			return command.NewRpcResponse(http.StatusOK, "done", "0", res.MetaDataUpdObj())
+		}
+		return command.NewRpcResponse(http.StatusNotFound, "error", "101", nil)
+	}
+	// the keys locked by a prepared transaction can't be changed until the transaction ends,
+	// the lock of the participant is held only while the storage is changed
+	ex.participant.enter()
+	if ex.participant.locked(obj.Key, obj.NewKey) {
+		ex.participant.exit()
+		return command.NewRpcResponse(http.StatusConflict, "error", "118", nil)
+	}
+	cmd, ret, res := ex.apply(req)
+	ex.participant.exit()
+	if res != nil {
+		return res
+	}
+	return ex.replicate(req, cmd, ret)
+}
+
+// Apply a change request on the storage. It returns the command that replicates the change and the object of the response,
+// or the final response if there is nothing to replicate.
+func (ex *Executor) apply(req *command.RpcRequest) (*command.Command, *storage.MetaDataUpdObj, *command.RpcResponse) {
+	obj := req.Obj
+	switch req.OpCode {
+	case "put":
+		item := obj.MetaDataObj()
+		if err := ex.keystorage.Put(item); err == storage.ErrOutOfMemory {
+			return nil, nil, command.NewRpcResponse(http.StatusInsufficientStorage, "error", "107", nil)
+		} else if err != nil {
+			return nil, nil, command.NewRpcResponse(http.StatusBadRequest, "error", "10", nil)
+		}
+		return &command.Command{OpCode: "put", Obj: item.MetaDataUpdObj()}, nil, nil
+	case "delete":
+		ex.keystorage.Delete(obj.Key)
+		return &command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: obj.Key}}, nil, nil
+	case "getandremove":
+		if res, err := ex.keystorage.GetAndRemove(obj.Key); err == nil {
+			return &command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: obj.Key}}, res.MetaDataUpdObj(), nil
+		}
+		return nil, nil, command.NewRpcResponse(http.StatusNotFound, "error", "101", nil)
+	case "updatevalue":
+		if err := ex.keystorage.UpdateValueIfEqual(obj); err == nil {
+			return ex.stored(obj.Key)
+		} else if err == storage.ErrOutOfMemory {
+			return nil, nil, command.NewRpcResponse(http.StatusInsufficientStorage, "error", "107", nil)
+		}
+		return nil, nil, command.NewRpcResponse(http.StatusForbidden, "error", "103", nil)
+	case "updatevalueifversion":
+		if err := ex.keystorage.UpdateValueIfVersion(obj); err == nil {
+			return ex.stored(obj.Key)
+		} else if err == storage.ErrOutOfMemory {
+			return nil, nil, command.NewRpcResponse(http.StatusInsufficientStorage, "error", "107", nil)
+		}
+		return nil, nil, command.NewRpcResponse(http.StatusForbidden, "error", "111", nil)
+	case "updatekeyvalue":
+		if err := ex.keystorage.UpdateKeyAndValueIfEqual(obj); err == nil {
+			return ex.renamed(req.OpCode, obj)
+		} else if err == storage.ErrOutOfMemory {
+			return nil, nil, command.NewRpcResponse(http.StatusInsufficientStorage, "error", "107", nil)
+		}
+		return nil, nil, command.NewRpcResponse(http.StatusForbidden, "error", "104", nil)
+	case "updatekey":
+		if err := ex.keystorage.UpdateKey(obj); err == nil {
+			return ex.renamed(req.OpCode, obj)
+		}
+		return nil, nil, command.NewRpcResponse(http.StatusForbidden, "error", "105", nil)
+	case "increment":
+		cnt := ex.keystorage.Increment(obj.MetaDataCounter())
+		return &command.Command{OpCode: "setcounter", Obj: cnt.MetaDataUpdObj()}, cnt.MetaDataUpdObj(), nil
+	case "setcounter":
+		cnt := ex.keystorage.SetCounter(obj.MetaDataCounter())
+		return &command.Command{OpCode: "setcounter", Obj: cnt.MetaDataUpdObj()}, cnt.MetaDataUpdObj(), nil
+	case "deletecounter":
+		ex.keystorage.DeleteCounter(obj.Key)
+		return &command.Command{OpCode: "deletecounter", Obj: &storage.MetaDataUpdObj{Key: obj.Key}}, nil, nil
+	case "deletevalueifequal":
+		item := obj.MetaDataObj()
+		if err := ex.keystorage.DeleteValueIfEqual(item); err == nil {
+			return &command.Command{OpCode: "delete", Obj: item.MetaDataUpdObj()}, nil, nil
+		}
+		return nil, nil, command.NewRpcResponse(http.StatusForbidden, "error", "103", nil)
+	case "deletevalueifversion":
+		if err := ex.keystorage.DeleteValueIfVersion(obj.Key, obj.Version); err == nil {
+			return &command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: obj.Key}}, nil, nil
+		}
+		return nil, nil, command.NewRpcResponse(http.StatusForbidden, "error", "111", nil)
+	}
+	return nil, nil, command.NewRpcResponse(http.StatusBadRequest, "error", "10", nil)
+}
+
+// Execute a batch of client requests. The reads use the read consistency of the single requests,
+// the changes are applied in order and replicated on the twins as a single command.
+func (ex *Executor) ExecuteBatch(req *command.RpcBatchRequest) *command.RpcBatchResponse {
+	res := &command.RpcBatchResponse{Results: make([]*command.RpcResponse, len(req.Objs))}
+	if !validConsistency(req.Consistency) {
+		for i := range res.Results {
+			res.Results[i] = command.NewRpcResponse(http.StatusBadRequest, "error", "12", nil)
+		}
+		return res
+	}
+	cmds := make([]*command.Command, 0, len(req.Objs))
+	changed := make([]int, 0, len(req.Objs))
+	if req.OpCode != "get" {
+		ex.participant.enter()
+	}
+	for i, obj := range req.Objs {
+		item := &command.RpcRequest{OpCode: req.OpCode, Obj: obj, Consistency: req.Consistency, ACLs: req.ACLs}
+		if !ex.allowed(item) {
+			res.Results[i] = command.NewRpcResponse(http.StatusForbidden, "error", "114", nil)
+			continue
+		}
+		if req.OpCode != "get" && ex.participant.locked(obj.Key) {
+			res.Results[i] = command.NewRpcResponse(http.StatusConflict, "error", "118", nil)
+			continue
+		}
+		switch req.OpCode {
+		case "get":
+			res.Results[i] = ex.Execute(item)
+			continue
+		case "put":
+			stored := obj.MetaDataObj()
+			if err := ex.keystorage.Put(stored); err == storage.ErrOutOfMemory {
+				res.Results[i] = command.NewRpcResponse(http.StatusInsufficientStorage, "error", "107", nil)
+				continue
+			} else if err != nil {
+				res.Results[i] = command.NewRpcResponse(http.StatusBadRequest, "error", "10", nil)
+				continue
+			}
+			cmds = append(cmds, &command.Command{OpCode: "put", Obj: stored.MetaDataUpdObj()})
+		case "delete":
+			ex.keystorage.Delete(obj.Key)
+			cmds = append(cmds, &command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: obj.Key}})
+		default:
+			res.Results[i] = command.NewRpcResponse(http.StatusBadRequest, "error", "10", nil)
+			continue
+		}
+		changed = append(changed, i)
+	}
+	if req.OpCode != "get" {
+		ex.participant.exit()
+	}
+	if len(cmds) > 0 {
+		rsp := ex.replicate(&command.RpcRequest{Consistency: req.Consistency}, &command.Command{OpCode: "batch", Batch: cmds}, nil)
+		for _, i := range changed {
+			res.Results[i] = command.NewRpcResponse(rsp.HttpStatus, rsp.Status, rsp.Code, nil)
+		}
+	}
+	return res
+}
+
+// Check the access control lists of a transaction: the checked objects are read, the mutations are changes.
+func (ex *Executor) allowedTx(req *command.RpcTxRequest) bool {
+	if len(req.ACLs) == 0 {
+		return true
+	}
+	for _, check := range req.Checks {
+		if !ex.allowed(&command.RpcRequest{OpCode: "get", Obj: &storage.MetaDataUpdObj{Key: check.Key}, ACLs: req.ACLs}) {
+			return false
+		}
+	}
+	for _, m := range req.Mutations {
+		if !ex.allowed(&command.RpcRequest{OpCode: m.Op, Obj: m.Obj, ACLs: req.ACLs}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that all the keys of a transaction belong to the hash slots of the node.
+func (ex *Executor) ownsTx(req *command.RpcTxRequest) bool {
+	for _, check := range req.Checks {
+		if !util.Contains(ex.config.ServerNode.Node.HashRange, check.Hash) {
+			return false
+		}
+	}
+	for _, m := range req.Mutations {
+		if !util.Contains(ex.config.ServerNode.Node.HashRange, m.Obj.Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check a transaction before executing or preparing it, it returns nil if the transaction is valid.
+func (ex *Executor) validateTx(req *command.RpcTxRequest) *command.RpcTxResponse {
+	if !validConsistency(req.Consistency) {
+		return &command.RpcTxResponse{HttpStatus: http.StatusBadRequest, Status: "error", Code: "12"}
+	}
+	for _, m := range req.Mutations {
+		if m.Obj == nil || (m.Op != storage.TxPut && m.Op != storage.TxDelete && m.Op != storage.TxIncrement) {
+			return &command.RpcTxResponse{HttpStatus: http.StatusBadRequest, Status: "error", Code: "10"}
+		}
+	}
+	if !ex.ownsTx(req) {
+		return &command.RpcTxResponse{HttpStatus: http.StatusBadRequest, Status: "error", Code: "116"}
+	}
+	if !ex.allowedTx(req) {
+		return &command.RpcTxResponse{HttpStatus: http.StatusForbidden, Status: "error", Code: "114"}
+	}
+	return nil
+}
+
+// Apply the mutations of a transaction on the storage if the checks are satisfied, using the memory reserved by a prepared transaction.
+// It returns the error response if the transaction is not applied.
+func (ex *Executor) storeTx(checks []storage.TxCheck, mutations []storage.TxMutation, reservation *storage.TxReservation) ([]*storage.MetaDataUpdObj, *command.RpcTxResponse) {
+	results, err := ex.keystorage.Transaction(checks, mutations, reservation)
+	switch err {
+	case nil:
+		return results, nil
+	case storage.ErrTxCheckFailed:
+		return nil, &command.RpcTxResponse{HttpStatus: http.StatusConflict, Status: "error", Code: "117"}
+	case storage.ErrOutOfMemory:
+		return nil, &command.RpcTxResponse{HttpStatus: http.StatusInsufficientStorage, Status: "error", Code: "107"}
+	}
+	return nil, &command.RpcTxResponse{HttpStatus: http.StatusBadRequest, Status: "error", Code: "10"}
+}
+
+// Replicate the applied mutations of a transaction on the twins as a single command.
+func (ex *Executor) replicateTx(req *command.RpcTxRequest, results []*storage.MetaDataUpdObj) *command.RpcTxResponse {
+	batch := make([]*command.Command, len(results))
+	for i, m := range req.Mutations {
+		switch m.Op {
+		case storage.TxPut:
+			batch[i] = &command.Command{OpCode: "put", Obj: results[i]}
+		case storage.TxDelete:
+			batch[i] = &command.Command{OpCode: "delete", Obj: results[i]}
+		case storage.TxIncrement:
+			batch[i] = &command.Command{OpCode: "setcounter", Obj: results[i]}
+		}
+	}
+	res := &command.RpcTxResponse{Results: results}
+	if len(batch) > 0 {
+		rsp := ex.replicate(&command.RpcRequest{Consistency: req.Consistency}, &command.Command{OpCode: "batch", Batch: batch}, nil)
+		res.HttpStatus, res.Status, res.Code = rsp.HttpStatus, rsp.Status, rsp.Code
+	} else {
+		res.HttpStatus, res.Status, res.Code = http.StatusOK, "done", "0"
+	}
+	return res
+}
+
+// Execute a transaction on the node: the mutations are applied all together only if all the checks are satisfied,
+// then they are replicated on the twins as a single command. The keys must belong to the node.
+func (ex *Executor) ExecuteTx(req *command.RpcTxRequest) *command.RpcTxResponse {
+	if res := ex.validateTx(req); res != nil {
+		return res
+	}
+	ex.participant.enter()
+	if ex.participant.locked(txKeys(req)...) {
+		ex.participant.exit()
+		return &command.RpcTxResponse{HttpStatus: http.StatusConflict, Status: "error", Code: "118"}
+	}
+	results, res := ex.storeTx(req.Checks, req.Mutations, nil)
+	ex.participant.exit()
+	if res != nil {
+		return res
+	}
+	return ex.replicateTx(req, results)
+}
+
+// Get the slots owned by the node.
+func (ex *Executor) ownedSlots() []int {
+	if slots := ex.config.ServerNode.Node.HashRange; slots != nil {
+		return slots
+	}
+	return []int{}
+}
+
+// Get the statistics of the collections counting only the objects of the slots owned by the node,
+// so the statistics of all the nodes add up to the ones of the cluster. If name is not empty only that collection is returned.
+func (ex *Executor) OwnedCollections(name string) []storage.CollectionStats {
+	list := make([]storage.CollectionStats, 0)
+	for _, stats := range ex.keystorage.Collections(ex.ownedSlots()) {
+		if name == "" || stats.Name == name {
+			list = append(list, stats)
+		}
+	}
+	return list
+}
+
+// List the keys of a collection in the slots owned by the node.
+func (ex *Executor) OwnedCollectionKeys(name string) []string {
+	return ex.keystorage.CollectionKeys(name, ex.ownedSlots())
+}
+
+// Scan a page of the keys of the node that can be read by the client.
+func (ex *Executor) Scan(req *command.ScanRequest) *command.ScanPage {
+	cursor, objs := ex.keystorage.Scan(req.Cursor, req.Count, req.Match)
+	page := &command.ScanPage{Cursor: cursor, Keys: make([]string, 0, len(objs))}
+	for _, obj := range objs {
+		if req.Owned && !util.Contains(ex.config.ServerNode.Node.HashRange, obj.Hash) {
+			continue
+		}
+		if command.Allowed(req.ACLs, obj.Collection, obj.Key, command.RightRead) {
+			page.Keys = append(page.Keys, obj.Key)
+		}
+	}
+	return page
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/inmemory"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+func TestACLSameStatusForMissingKeys(t *testing.T) {
+	ks := inmemory.NewInMemoryStorage()
+	ks.Put(&storage.MetaDataObj{Key: "secret", Collection: "private", Data: []byte("v")})
+	ks.Put(&storage.MetaDataObj{Key: "shared", Collection: "public", Data: []byte("v")})
+	ex := NewExecutor(ks, nil, new(ServerConf))
+	acls := []command.ACL{{Collection: "public", Rights: []string{command.RightRead, command.RightWrite, command.RightDelete}}}
+	for _, op := range []string{"get", "getandremove", "updatevalue", "delete"} {
+		denied := ex.Execute(&command.RpcRequest{OpCode: op, Obj: &storage.MetaDataUpdObj{Key: "secret"}, ACLs: acls})
+		missing := ex.Execute(&command.RpcRequest{OpCode: op, Obj: &storage.MetaDataUpdObj{Key: "missing"}, ACLs: acls})
+		if denied.HttpStatus != http.StatusForbidden || missing.HttpStatus != denied.HttpStatus {
+			t.Fatalf("%s: denied key status %d, missing key status %d", op, denied.HttpStatus, missing.HttpStatus)
+		}
+	}
+	if res := ex.Execute(&command.RpcRequest{OpCode: "get", Obj: &storage.MetaDataUpdObj{Key: "shared"}, ACLs: acls}); res.HttpStatus != http.StatusOK {
+		t.Fatalf("allowed key status %d", res.HttpStatus)
+	}
+	if !ex.allowed(&command.RpcRequest{OpCode: "put", Obj: &storage.MetaDataUpdObj{Key: "new", Collection: "public"}, ACLs: acls}) {
+		t.Fatal("a new object can be put in an allowed collection")
+	}
+	if ex.allowed(&command.RpcRequest{OpCode: "put", Obj: &storage.MetaDataUpdObj{Key: "secret", Collection: "public"}, ACLs: acls}) {
+		t.Fatal("an object of a denied collection can't be overwritten")
+	}
+}
+
+func TestACLCounters(t *testing.T) {
+	ks := inmemory.NewInMemoryStorage()
+	ex := NewExecutor(ks, nil, new(ServerConf))
+	acls := []command.ACL{{Collection: "users", Prefix: "team-a:", Rights: []string{command.RightRead, command.RightWrite}}}
+	counter := func(op string, key string) *command.RpcRequest {
+		return &command.RpcRequest{OpCode: op, Obj: &storage.MetaDataUpdObj{Key: key, Data: []byte("1")}, ACLs: acls}
+	}
+	// a key limited to a collection reaches the counters of its prefix
+	for _, op := range []string{"increment", "setcounter", "getcounter"} {
+		if !ex.allowed(counter(op, "team-a:visits")) {
+			t.Fatalf("%s denied on a counter of the prefix", op)
+		}
+		if ex.allowed(counter(op, "team-b:visits")) {
+			t.Fatalf("%s allowed on a counter of another prefix", op)
+		}
+	}
+	if ex.allowed(counter("deletecounter", "team-a:visits")) {
+		t.Fatal("deletecounter allowed without the delete right")
+	}
+}
+
+func TestRequiredTwins(t *testing.T) {
+	srv, _ := startTestServer(t, "local", []int{}, &cluster.ClusterTopology{})
+	for _, level := range []string{ConsistencyLocal, ConsistencyOneTwin, ConsistencyAllTwins, ConsistencyQuorum} {
+		if required := srv.executor.requiredTwins(level); required != 0 {
+			t.Fatalf("%s requires %d twins on a node without twins", level, required)
+		}
+		req := &command.RpcRequest{OpCode: "put", Consistency: level, Obj: &storage.MetaDataUpdObj{Key: "key", Data: []byte("v")}}
+		if res := srv.executor.Execute(req); res.HttpStatus != http.StatusOK {
+			t.Fatalf("%s write on a node without twins has status %d", level, res.HttpStatus)
+		}
+	}
+	srv.config.ServerNode.Twins = []string{"a", "b", "c"}
+	expected := map[string]int{ConsistencyLocal: 0, ConsistencyOneTwin: 1, ConsistencyAllTwins: 3, ConsistencyQuorum: 2}
+	for level, required := range expected {
+		if srv.executor.requiredTwins(level) != required {
+			t.Fatalf("%s requires %d twins expected %d", level, srv.executor.requiredTwins(level), required)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package server
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"errors"
 	"github.com/maxzerbini/ovo/cluster"
 	"github.com/maxzerbini/ovo/command"
 	"github.com/maxzerbini/ovo/processor"
 	"github.com/maxzerbini/ovo/storage"
+	"github.com/maxzerbini/ovo/transport"
 	"log"
 	"net"
 	"net/http"
@@ -20,14 +23,15 @@ type InnerServer struct {
 	outcmdproc  *processor.OutCommandQueue
 	config      *ServerConf
 	partitioner *processor.Partitioner
+	executor    *Executor
 }
 
 // Creata a new inner server.
-func NewInnerServer(conf *ServerConf, ks storage.OvoStorage, in *processor.InCommandQueue, out *processor.OutCommandQueue, partitioner *processor.Partitioner) *InnerServer {
-	return &InnerServer{keystorage: ks, incmdproc: in, config: conf, partitioner: partitioner, outcmdproc: out}
+func NewInnerServer(conf *ServerConf, ks storage.OvoStorage, in *processor.InCommandQueue, out *processor.OutCommandQueue, partitioner *processor.Partitioner, executor *Executor) *InnerServer {
+	return &InnerServer{keystorage: ks, incmdproc: in, config: conf, partitioner: partitioner, outcmdproc: out, executor: executor}
 }
 
-// Start listening commands.
+// Start listening commands, the binary protocol and the RPC over HTTP are served on the same port.
 func (srv *InnerServer) Do() {
 	rpc.Register(srv)
 	rpc.HandleHTTP()
@@ -41,7 +45,22 @@ func (srv *InnerServer) Do() {
 	if e != nil {
 		log.Fatal("Starting RPC-server -listen error:", e)
 	}
-	http.Serve(listener, nil)
+	if srv.config.InnerTLSCert != "" {
+		tlsConfig, err := srv.config.InnerTLSConfig()
+		if err != nil {
+			log.Fatal("Starting RPC-server -TLS error:", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	transport.Serve(listener, rpc.DefaultServer, http.DefaultServeMux)
+}
+
+// Check the cluster secret of a registration request.
+func (srv *InnerServer) authorize(secret string) error {
+	if srv.config.ClusterSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(srv.config.ClusterSecret)) != 1 {
+		return errors.New("Unauthorized node.")
+	}
+	return nil
 }
 
 // Enqueue a remote command.
@@ -49,11 +68,34 @@ func (srv *InnerServer) ExecuteCommand(rpccmd command.RpcCommand, reply *int) (e
 	defer func() {
 		// Executes normally even if there is a panic
 		if e := recover(); e != nil {
-			log.Println("Run time panic: %v", e)
+			log.Printf("Run time panic: %v\r\n", e)
+			*reply = -1
+			err = errors.New("Runtime error.")
+		}
+	}()
+	srv.enqueue(&rpccmd)
+	*reply = 0
+	return nil
+}
+
+// Enqueue a batch of remote commands keeping their order.
+func (srv *InnerServer) ExecuteCommands(rpccmds []command.RpcCommand, reply *int) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
 			*reply = -1
 			err = errors.New("Runtime error.")
 		}
 	}()
+	for i := range rpccmds {
+		srv.enqueue(&rpccmds[i])
+	}
+	*reply = 0
+	return nil
+}
+
+func (srv *InnerServer) enqueue(rpccmd *command.RpcCommand) {
 	cmd := rpccmd.Command()
 	if rpccmd.OpCode == "move" {
 		cmd.OpCode = "put"
@@ -63,20 +105,212 @@ func (srv *InnerServer) ExecuteCommand(rpccmd command.RpcCommand, reply *int) (e
 	} else {
 		srv.incmdproc.Enqueu(cmd)
 	}
+}
+
+// Execute a client request forwarded by another node.
+func (srv *InnerServer) ForwardRequest(req command.RpcRequest, reply *command.RpcResponse) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = *srv.executor.Execute(&req)
+	return nil
+}
+
+// Execute a batch of client requests forwarded by another node.
+func (srv *InnerServer) ForwardBatch(req command.RpcBatchRequest, reply *command.RpcBatchResponse) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = *srv.executor.ExecuteBatch(&req)
+	return nil
+}
+
+// Execute a transaction forwarded by another node.
+func (srv *InnerServer) ForwardTransaction(req command.RpcTxRequest, reply *command.RpcTxResponse) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = *srv.executor.ExecuteTx(&req)
+	return nil
+}
+
+// Prepare the part of a distributed transaction on the keys of the node.
+func (srv *InnerServer) PrepareTx(req command.RpcTxRequest, reply *command.RpcTxResponse) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = *srv.executor.participant.Prepare(&req)
+	return nil
+}
+
+// Commit a transaction prepared on the node.
+func (srv *InnerServer) CommitTx(id string, reply *command.RpcTxResponse) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = *srv.executor.participant.Commit(id)
+	return nil
+}
+
+// Abort a transaction prepared on the node.
+func (srv *InnerServer) AbortTx(id string, reply *int) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	srv.executor.participant.Abort(id)
 	*reply = 0
 	return nil
 }
 
+// Get the state of a transaction coordinated by the node, it is aborted if the transaction is unknown.
+func (srv *InnerServer) TxStatus(id string, reply *string) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	if srv.executor.coordinator != nil {
+		*reply = srv.executor.coordinator.Status(id)
+	} else {
+		*reply = command.TxAborted
+	}
+	return nil
+}
+
+// Read an object stored on the node, the reply is empty if the object is not found.
+func (srv *InnerServer) ReadObject(key *string, reply *storage.MetaDataUpdObj) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	if res, e := srv.keystorage.Get(*key); e == nil {
+		*reply = *res.MetaDataUpdObj()
+	}
+	return nil
+}
+
+// Scan a page of the keys of the node.
+func (srv *InnerServer) Scan(req command.ScanRequest, reply *command.ScanPage) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = *srv.executor.Scan(&req)
+	return nil
+}
+
+// Get the statistics of the collections in the slots owned by the node, of all the collections if name is empty.
+func (srv *InnerServer) Collections(name string, reply *[]storage.CollectionStats) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = srv.executor.OwnedCollections(name)
+	return nil
+}
+
+// List the keys of a collection in the slots owned by the node.
+func (srv *InnerServer) CollectionKeys(name string, reply *[]string) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = srv.executor.OwnedCollectionKeys(name)
+	return nil
+}
+
+// Get the digests of the hash slots stored on the node.
+func (srv *InnerServer) GetSlotDigests(slots []int, reply *map[int]uint64) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = processor.SlotDigests(srv.keystorage, slots)
+	return nil
+}
+
+// Get the keys and counters of the hash slots stored on the node.
+func (srv *InnerServer) GetSlotEntries(slots []int, reply *[]command.SlotEntry) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = processor.SlotEntries(srv.keystorage, slots)
+	return nil
+}
+
+// Get a page of the data owned by the node for a twin that is bootstrapping.
+func (srv *InnerServer) SyncData(req command.SyncRequest, reply *command.SyncPage) (err error) {
+	defer func() {
+		// Executes normally even if there is a panic
+		if e := recover(); e != nil {
+			log.Printf("Run time panic: %v\r\n", e)
+			err = errors.New("Runtime error.")
+		}
+	}()
+	*reply = *srv.partitioner.SyncPage(&req)
+	return nil
+}
+
 // Register a new node in the cluster.
 func (srv *InnerServer) RegisterNode(node *cluster.ClusterTopologyNode, reply *cluster.ClusterTopology) (err error) {
 	defer func() {
 		// Executes normally even if there is a panic
 		if e := recover(); e != nil {
-			log.Println("Run time panic: %v", e)
+			log.Printf("Run time panic: %v\r\n", e)
 			*reply = srv.config.Topology
 			err = errors.New("Runtime error.")
 		}
 	}()
+	if err = srv.authorize(node.Secret); err != nil {
+		log.Printf("Rejected request from an unauthorized node\r\n")
+		return err
+	}
+	node.Secret = ""
 	log.Printf("Node %s registration or update state %s\r\n", node.Node.Name, node.Node.State)
 	srv.config.Topology.AddNode(node)
 	srv.config.WriteTmp()
@@ -94,11 +328,16 @@ func (srv *InnerServer) RegisterTwin(node *cluster.ClusterTopologyNode, reply *c
 	defer func() {
 		// Executes normally even if there is a panic
 		if e := recover(); e != nil {
-			log.Println("Run time panic: %v", e)
+			log.Printf("Run time panic: %v\r\n", e)
 			*reply = srv.config.Topology
 			err = errors.New("Runtime error.")
 		}
 	}()
+	if err = srv.authorize(node.Secret); err != nil {
+		log.Printf("Rejected request from an unauthorized node\r\n")
+		return err
+	}
+	node.Secret = ""
 	log.Printf("Node %s ask registration as twin\r\n", node.Node.Name)
 	srv.config.Topology.AddTwin(node)
 	srv.config.WriteTmp()
@@ -114,11 +353,16 @@ func (srv *InnerServer) RegisterStepbrother(node *cluster.ClusterTopologyNode, r
 	defer func() {
 		// Executes normally even if there is a panic
 		if e := recover(); e != nil {
-			log.Println("Run time panic: %v", e)
+			log.Printf("Run time panic: %v\r\n", e)
 			*reply = srv.config.Topology
 			err = errors.New("Runtime error.")
 		}
 	}()
+	if err = srv.authorize(node.Secret); err != nil {
+		log.Printf("Rejected request from an unauthorized node\r\n")
+		return err
+	}
+	node.Secret = ""
 	log.Printf("Node %s ask registration as stepbrother\r\n", node.Node.Name)
 	srv.config.Topology.AddStepbrother(node)
 	srv.config.WriteTmp()
@@ -134,11 +378,16 @@ func (srv *InnerServer) RegisterTwinAndStepbrother(node *cluster.ClusterTopology
 	defer func() {
 		// Executes normally even if there is a panic
 		if e := recover(); e != nil {
-			log.Println("Run time panic: %v", e)
+			log.Printf("Run time panic: %v\r\n", e)
 			*reply = srv.config.Topology
 			err = errors.New("Runtime error.")
 		}
 	}()
+	if err = srv.authorize(node.Secret); err != nil {
+		log.Printf("Rejected request from an unauthorized node\r\n")
+		return err
+	}
+	node.Secret = ""
 	log.Printf("Node %s ask registration as stepbrother\r\n", node.Node.Name)
 	srv.config.Topology.AddTwinAndStepbrother(node)
 	srv.config.WriteTmp()
@@ -154,11 +403,16 @@ func (srv *InnerServer) UpdateTopology(topology *cluster.ClusterTopology, reply
 	defer func() {
 		// Executes normally even if there is a panic
 		if e := recover(); e != nil {
-			log.Println("Run time panic: %v", e)
+			log.Printf("Run time panic: %v\r\n", e)
 			*reply = srv.config.Topology
 			err = errors.New("Runtime error.")
 		}
 	}()
+	if err = srv.authorize(topology.Secret); err != nil {
+		log.Printf("Rejected request from an unauthorized node\r\n")
+		return err
+	}
+	topology.Secret = ""
 	srv.config.Topology.Merge(topology)
 	srv.config.WriteTmp()
 	reply.Nodes = srv.config.Topology.Nodes
@@ -172,11 +426,16 @@ func (srv *InnerServer) UpdateNode(node *cluster.ClusterTopologyNode, reply *clu
 	defer func() {
 		// Executes normally even if there is a panic
 		if e := recover(); e != nil {
-			log.Println("Run time panic: %v", e)
+			log.Printf("Run time panic: %v\r\n", e)
 			*reply = srv.config.Topology
 			err = errors.New("Runtime error.")
 		}
 	}()
+	if err = srv.authorize(node.Secret); err != nil {
+		log.Printf("Rejected request from an unauthorized node\r\n")
+		return err
+	}
+	node.Secret = ""
 	log.Printf("Node %s update state %s\r\n", node.Node.Name, node.Node.State)
 	srv.config.Topology.AddNode(node)
 	srv.config.WriteTmp()
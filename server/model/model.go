@@ -1,12 +1,18 @@
 package model
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/maxzerbini/ovo/cluster"
 	"github.com/maxzerbini/ovo/storage"
 )
 
 type Any interface{}
 
+// The hashcode of a request that does not send it, the server computes the hashcode of the key.
+const NoHash = -1
+
 type OvoResponse struct {
 	Status string
 	Code   string
@@ -19,6 +25,7 @@ type OvoKVRequest struct {
 	Collection string
 	TTL        int
 	Hash       int
+	Version    uint64
 }
 
 type OvoKVUpdateRequest struct {
@@ -31,14 +38,69 @@ type OvoKVUpdateRequest struct {
 }
 
 type OvoKVResponse struct {
-	Key  string
-	Data []byte
+	Key     string
+	Data    []byte
+	Version uint64
+}
+
+type OvoKVResult struct {
+	Key     string
+	Status  string
+	Code    string
+	Data    []byte
+	Version uint64
+}
+
+type OvoTxCheck struct {
+	Op      string
+	Key     string
+	Hash    int
+	Version uint64
+	Data    []byte
+}
+
+type OvoTxMutation struct {
+	Op         string
+	Key        string
+	Data       []byte
+	Collection string
+	TTL        int
+	Hash       int
+	Value      int64
+}
+
+type OvoTxRequest struct {
+	Checks    []OvoTxCheck
+	Mutations []OvoTxMutation
+}
+
+type OvoTxResult struct {
+	Op      string
+	Key     string
+	Version uint64
+	Value   int64
 }
 
 type OvoKVKeys struct {
 	Keys []string
 }
 
+type OvoRange struct {
+	Items []*OvoKVResponse
+	Next  string
+}
+
+type OvoScan struct {
+	Cursor string
+	Keys   []string
+}
+
+type OvoCollection struct {
+	Name      string
+	Count     int
+	UsedBytes int64
+}
+
 type OvoTopologyNode struct {
 	Name      string
 	HashRange []int
@@ -49,6 +111,7 @@ type OvoTopologyNode struct {
 }
 
 type OvoTopology struct {
+	Slots int
 	Nodes []*OvoTopologyNode
 }
 
@@ -64,12 +127,99 @@ type OvoCounterResponse struct {
 	Value int64
 }
 
+type OvoAntiEntropyStats struct {
+	Rounds         int64
+	DivergentSlots int64
+	PushedKeys     int64
+	PulledKeys     int64
+	DeletedKeys    int64
+	LastRound      time.Time
+}
+
+type OvoHintsStats struct {
+	Pending  map[string]int
+	Queued   int64
+	Dropped  int64
+	Replayed int64
+}
+
+type OvoReplicationStats struct {
+	Queued    int
+	LagMillis int64
+	Sent      int64
+	Batches   int64
+}
+
+type OvoStats struct {
+	Node        string
+	Keys        int
+	Counters    int
+	AntiEntropy *OvoAntiEntropyStats
+	Hints       *OvoHintsStats
+	Replication map[string]*OvoReplicationStats
+}
+
+// Decode the request, the omitted hashcode is NoHash.
+func (req *OvoKVRequest) UnmarshalJSON(data []byte) error {
+	type plain OvoKVRequest
+	ret := plain{Hash: NoHash}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return err
+	}
+	*req = OvoKVRequest(ret)
+	return nil
+}
+
+// Decode the request, the omitted hashcodes are NoHash.
+func (req *OvoKVUpdateRequest) UnmarshalJSON(data []byte) error {
+	type plain OvoKVUpdateRequest
+	ret := plain{Hash: NoHash, NewHash: NoHash}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return err
+	}
+	*req = OvoKVUpdateRequest(ret)
+	return nil
+}
+
+// Decode the check, the omitted hashcode is NoHash.
+func (check *OvoTxCheck) UnmarshalJSON(data []byte) error {
+	type plain OvoTxCheck
+	ret := plain{Hash: NoHash}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return err
+	}
+	*check = OvoTxCheck(ret)
+	return nil
+}
+
+// Decode the mutation, the omitted hashcode is NoHash.
+func (mutation *OvoTxMutation) UnmarshalJSON(data []byte) error {
+	type plain OvoTxMutation
+	ret := plain{Hash: NoHash}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return err
+	}
+	*mutation = OvoTxMutation(ret)
+	return nil
+}
+
+// Decode the counter, the omitted hashcode is NoHash.
+func (counter *OvoCounter) UnmarshalJSON(data []byte) error {
+	type plain OvoCounter
+	ret := plain{Hash: NoHash}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return err
+	}
+	*counter = OvoCounter(ret)
+	return nil
+}
+
 func NewOvoResponse(status string, code string, data Any) *OvoResponse {
 	return &OvoResponse{Status: status, Code: code, Data: data}
 }
 
 func NewOvoKVResponse(obj *storage.MetaDataObj) *OvoKVResponse {
-	var rsp = &OvoKVResponse{Key: obj.Key, Data: obj.Data}
+	var rsp = &OvoKVResponse{Key: obj.Key, Data: obj.Data, Version: obj.Version}
 	return rsp
 }
 
@@ -94,12 +244,33 @@ func NewMetaDataUpdObj(req *OvoKVUpdateRequest) *storage.MetaDataUpdObj {
 	return obj
 }
 
+func NewTxCheck(check *OvoTxCheck) storage.TxCheck {
+	return storage.TxCheck{Op: check.Op, Key: check.Key, Hash: check.Hash, Version: check.Version, Data: check.Data}
+}
+
+func NewTxMutation(mutation *OvoTxMutation) storage.TxMutation {
+	obj := &storage.MetaDataUpdObj{Key: mutation.Key, Data: mutation.Data, Collection: mutation.Collection, TTL: mutation.TTL, Hash: mutation.Hash, Value: mutation.Value}
+	return storage.TxMutation{Op: mutation.Op, Obj: obj}
+}
+
+func NewOvoTxResults(mutations []storage.TxMutation, results []*storage.MetaDataUpdObj) []*OvoTxResult {
+	ret := make([]*OvoTxResult, len(results))
+	for i, obj := range results {
+		ret[i] = &OvoTxResult{Op: mutations[i].Op, Key: obj.Key, Version: obj.Version, Value: obj.Value}
+	}
+	return ret
+}
+
+func NewOvoCollection(stats storage.CollectionStats) *OvoCollection {
+	return &OvoCollection{Name: stats.Name, Count: stats.Count, UsedBytes: stats.UsedBytes}
+}
+
 func NewOvoTopologyNode(node *cluster.ClusterTopologyNode) *OvoTopologyNode {
-	return &OvoTopologyNode{Name: node.Node.Name, HashRange: node.Node.HashRange, Host: node.Node.Host, Port: node.Node.Port, State: node.Node.State, Twins: node.Twins}
+	return &OvoTopologyNode{Name: node.Node.Name, HashRange: node.Node.HashRange, Host: node.Node.Host, Port: node.Node.Port, State: node.Node.State, Twins: node.Replicas()}
 }
 
 func NewOvoTopology(topology *cluster.ClusterTopology) *OvoTopology {
-	ret := &OvoTopology{Nodes: make([]*OvoTopologyNode, 0)}
+	ret := &OvoTopology{Slots: cluster.SlotCount(), Nodes: make([]*OvoTopologyNode, 0)}
 	for _, node := range topology.Nodes {
 		ret.Nodes = append(ret.Nodes, NewOvoTopologyNode(node))
 	}
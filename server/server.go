@@ -5,8 +5,13 @@ import (
 )
 
 import (
+	"errors"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/maxzerbini/ovo/cluster"
@@ -25,48 +30,77 @@ type Server struct {
 	partitioner *processor.Partitioner
 	innerServer *InnerServer
 	nodeChecker *Checker
+	executor    *Executor
+	antiEntropy *processor.AntiEntropy
+	apiKeys     map[string]*APIKey
 }
 
 func NewServer(conf *ServerConf, ks storage.OvoStorage) *Server {
-	srv := &Server{keystorage: ks, config: conf}
+	srv := &Server{keystorage: ks, config: conf, apiKeys: indexAPIKeys(conf.APIKeys)}
 	srv.incmdproc = processor.NewCommandQueue(ks)
-	srv.outcmdproc = processor.NewOutCommandQueue(conf.ServerNode, &conf.Topology, srv.incmdproc)
+	srv.outcmdproc = processor.NewOutCommandQueue(conf.ServerNode, &conf.Topology, srv.incmdproc, conf.BatchSize, conf.MaxHints, time.Second*time.Duration(conf.HintsMaxAge), conf.HintsPath)
+	if conf.InnerProtocol != "" {
+		srv.outcmdproc.Caller.Protocol = conf.InnerProtocol
+	}
+	if conf.InnerCallTimeout > 0 {
+		srv.outcmdproc.Caller.Timeout = time.Duration(conf.InnerCallTimeout) * time.Millisecond
+	}
+	if conf.InnerPoolSize > 0 {
+		srv.outcmdproc.Caller.PoolSize = conf.InnerPoolSize
+	}
+	if conf.InnerTLSCert != "" {
+		tlsConfig, err := conf.InnerTLSConfig()
+		if err != nil {
+			log.Fatalf("Inner TLS configuration error: %v", err)
+		}
+		srv.outcmdproc.Caller.TLSConfig = tlsConfig
+	}
+	srv.outcmdproc.Caller.Secret = conf.ClusterSecret
 	srv.partitioner = processor.NewPartitioner(ks, conf.ServerNode, srv.outcmdproc)
-	srv.innerServer = NewInnerServer(conf, ks, srv.incmdproc, srv.outcmdproc, srv.partitioner)
+	srv.executor = NewExecutor(ks, srv.outcmdproc, conf)
+	if conf.TxLog() == "" {
+		log.Printf("Distributed transactions disabled, TxLogDir is not configured\r\n")
+	} else {
+		// the logs are found again after a restart only if the node always has the same name
+		if conf.randomName {
+			log.Fatalf("Distributed transactions require a configured node name, TxLogDir is set but the node name is random")
+		}
+		if err := srv.executor.participant.openLog(conf.TxLog() + ".prepared"); err != nil {
+			log.Fatalf("Prepare log error: %v", err)
+		}
+		coordinator, err := NewTxCoordinator(srv.executor)
+		if err != nil {
+			log.Fatalf("Transaction log error: %v", err)
+		}
+		srv.executor.coordinator = coordinator
+	}
+	srv.innerServer = NewInnerServer(conf, ks, srv.incmdproc, srv.outcmdproc, srv.partitioner, srv.executor)
 	srv.nodeChecker = NewChecker(conf, srv.outcmdproc, srv.partitioner)
+	period := conf.AntiEntropyPeriod
+	if period == 0 {
+		period = DefaultAntiEntropyPeriod
+	}
+	srv.antiEntropy = processor.NewAntiEntropy(ks, conf.ServerNode, srv.outcmdproc, time.Second*time.Duration(period))
+	if notifier, ok := ks.(storage.OvoEvictionNotifier); ok {
+		notifier.SetEvictionListener(srv.replicateEvictions)
+	}
 	return srv
 }
 
+// Replicate the evicted items on the twins. Only the items owned by the node are deleted on the twins,
+// the copies of the items of other nodes are evicted locally without touching the owner.
+func (srv *Server) replicateEvictions(objs []*storage.MetaDataObj) {
+	for _, obj := range objs {
+		if util.Contains(srv.config.ServerNode.Node.HashRange, obj.Hash) {
+			srv.outcmdproc.Enqueu(&command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: obj.Key, Hash: obj.Hash}})
+		}
+	}
+}
+
 func (srv *Server) Do() {
 	log.Printf("Staring node %s ...\r\n", srv.config.ServerNode.Node.Name)
 	go srv.innerServer.Do()
-	// Creates a router without any middleware by default
-	router := gin.New()
-	// Global middleware
-	if srv.config.Debug {
-		router.Use(gin.Logger())
-	}
-	router.Use(gin.Recovery())
-	router.GET("/ovo/keystorage", srv.count)
-	router.GET("/ovo/keys", srv.keys)
-	router.GET("/ovo/keystorage/:key", srv.get)
-	router.POST("/ovo/keystorage", srv.post)
-	router.PUT("/ovo/keystorage", srv.post)
-	router.DELETE("/ovo/keystorage/:key", srv.delete)
-	router.GET("/ovo/keystorage/:key/getandremove", srv.getAndRemove)
-	router.POST("/ovo/keystorage/:key/updatevalueifequal", srv.updateValueIfEqual)
-	router.PUT("/ovo/keystorage/:key/updatevalueifequal", srv.updateValueIfEqual)
-	router.POST("/ovo/keystorage/:key/updatekeyvalueifequal", srv.updateKeyAndValueIfEqual)
-	router.PUT("/ovo/keystorage/:key/updatekeyvalueifequal", srv.updateKeyAndValueIfEqual)
-	router.POST("/ovo/keystorage/:key/updatekey", srv.updateKey)
-	router.PUT("/ovo/keystorage/:key/updatekey", srv.updateKey)
-	router.GET("/ovo/cluster", srv.getTopology)
-	router.GET("/ovo/cluster/me", srv.getCurrentNode)
-	router.POST("/ovo/counters", srv.setcounter)
-	router.PUT("/ovo/counters", srv.increment)
-	router.GET("/ovo/counters/:key", srv.getcounter)
-	router.DELETE("/ovo/counters/:key", srv.deletecounter)
-	router.POST("/ovo/keystorage/:key/deletevalueifequal", srv.deleteValueIfEqual)
+	router := srv.router()
 	if srv.config.Debug {
 		gin.SetMode(gin.DebugMode)
 	} else {
@@ -76,16 +110,86 @@ func (srv *Server) Do() {
 	srv.registerServer()
 	// start node checker
 	go srv.nodeChecker.Do()
+	// start anti-entropy synchronization
+	if srv.config.AntiEntropyPeriod >= 0 {
+		go srv.antiEntropy.Do()
+	}
+	// start snapshot scheduler
+	if srv.config.SnapshotPeriod > 0 {
+		go srv.scheduleSnapshots()
+	}
 	log.Printf("Node %s started\r\n", srv.config.ServerNode.Node.Name)
 	// Listen and server on Host:Port
+	address := srv.config.ServerNode.Node.Host + ":" + strconv.Itoa(srv.config.ServerNode.Node.Port)
 	if srv.config.HttpBindAll {
-		router.Run("0.0.0.0:" + strconv.Itoa(srv.config.ServerNode.Node.Port))
+		address = "0.0.0.0:" + strconv.Itoa(srv.config.ServerNode.Node.Port)
+	}
+	if srv.config.TLSCert != "" {
+		router.RunTLS(address, srv.config.TLSCert, srv.config.TLSKey)
 	} else {
-		router.Run(srv.config.ServerNode.Node.Host + ":" + strconv.Itoa(srv.config.ServerNode.Node.Port))
+		router.Run(address)
 	}
 }
 
+// Create the router of the RESTful API.
+func (srv *Server) router() *gin.Engine {
+	// Creates a router without any middleware by default
+	router := gin.New()
+	// Global middleware
+	if srv.config.Debug {
+		router.Use(gin.Logger())
+	}
+	router.Use(gin.Recovery())
+	// the routes are grouped by the role required to the API keys
+	read := router.Group("/ovo", srv.authorize(RoleReadOnly))
+	write := router.Group("/ovo", srv.authorize(RoleReadWrite))
+	admin := router.Group("/ovo", srv.authorize(RoleAdmin))
+	read.GET("/keystorage", srv.count)
+	read.GET("/keys", srv.keys)
+	read.GET("/keystorage/:key", srv.get)
+	write.POST("/keystorage", srv.post)
+	read.POST("/keystorage/mget", srv.mget)
+	write.POST("/keystorage/mput", srv.mput)
+	write.POST("/keystorage/mdelete", srv.mdelete)
+	write.PUT("/keystorage", srv.post)
+	write.DELETE("/keystorage/:key", srv.delete)
+	write.POST("/transaction", srv.transaction)
+	write.GET("/keystorage/:key/getandremove", srv.getAndRemove)
+	write.POST("/keystorage/:key/updatevalueifequal", srv.updateValueIfEqual)
+	write.PUT("/keystorage/:key/updatevalueifequal", srv.updateValueIfEqual)
+	write.POST("/keystorage/:key/updatekeyvalueifequal", srv.updateKeyAndValueIfEqual)
+	write.PUT("/keystorage/:key/updatekeyvalueifequal", srv.updateKeyAndValueIfEqual)
+	write.POST("/keystorage/:key/updatekey", srv.updateKey)
+	write.PUT("/keystorage/:key/updatekey", srv.updateKey)
+	admin.GET("/cluster", srv.getTopology)
+	admin.GET("/cluster/me", srv.getCurrentNode)
+	write.POST("/counters", srv.setcounter)
+	write.PUT("/counters", srv.increment)
+	read.GET("/counters/:key", srv.getcounter)
+	write.DELETE("/counters/:key", srv.deletecounter)
+	write.POST("/keystorage/:key/deletevalueifequal", srv.deleteValueIfEqual)
+	write.POST("/keystorage/:key/updatevalueifversion", srv.updateValueIfVersion)
+	write.PUT("/keystorage/:key/updatevalueifversion", srv.updateValueIfVersion)
+	write.POST("/keystorage/:key/deletevalueifversion", srv.deleteValueIfVersion)
+	read.GET("/scan", srv.scan)
+	read.GET("/range", srv.keyRange)
+	read.GET("/collections", srv.collections)
+	read.GET("/collections/:name", srv.getCollection)
+	read.GET("/collections/:name/keys", srv.collectionKeys)
+	write.DELETE("/collections/:name", srv.dropCollection)
+	admin.POST("/admin/snapshot", srv.snapshot)
+	admin.GET("/stats", srv.stats)
+	return router
+}
+
 func (srv *Server) registerServer() {
+	// a node that replicates its stepbrothers copies their data before becoming active
+	bootstrap := len(srv.config.ServerNode.Stepbrothers) > 0 && len(srv.config.Topology.Nodes) > 1
+	if bootstrap {
+		srv.config.ServerNode.Node.State = cluster.Syncing
+		srv.config.ServerNode.UpdateDate = time.Now()
+		srv.config.Topology.AddNode(srv.config.ServerNode)
+	}
 	// update topology
 	if len(srv.config.Topology.Nodes) > 0 {
 		// connect first node
@@ -150,16 +254,173 @@ func (srv *Server) registerServer() {
 		}
 	}
 	srv.config.WriteTmp()
+	if bootstrap {
+		go srv.bootstrap()
+	}
+}
+
+// Copy the data of the nodes replicated by this node, then mark the node as active and notify the cluster.
+// The node stays syncing and the failed copies are retried until all the data are copied.
+func (srv *Server) bootstrap() {
+	name := srv.config.ServerNode.Node.Name
+	copied := make([]string, 0)
+	for {
+		failed := false
+		for _, node := range srv.config.Topology.GetClusterNodes() {
+			if cluster.Active == node.Node.State && util.ContainsString(node.Replicas(), name) && !util.ContainsString(copied, node.Node.Name) {
+				if err := srv.partitioner.PullFrom(node.Node); err != nil {
+					failed = true
+				} else {
+					copied = append(copied, node.Node.Name)
+				}
+			}
+		}
+		if !failed {
+			break
+		}
+		log.Printf("Node %s is still syncing, the copy is retried in %d seconds\r\n", name, BootstrapRetryDelay)
+		time.Sleep(BootstrapRetryDelay * time.Second)
+	}
+	log.Printf("Node %s is in sync\r\n", name)
+	srv.config.ServerNode.Node.State = cluster.Active
+	srv.config.ServerNode.UpdateDate = time.Now()
+	srv.config.Topology.AddNode(srv.config.ServerNode)
+	srv.config.WriteTmp()
+	for _, node := range srv.config.Topology.GetClusterNodes() {
+		srv.outcmdproc.Caller.RegisterNode(srv.config.ServerNode, node.Node)
+	}
+	go srv.partitioner.MoveData()
+}
+
+// Write a snapshot of the storage periodically.
+func (srv *Server) scheduleSnapshots() {
+	snapshotter, ok := srv.keystorage.(storage.OvoSnapshotter)
+	if !ok {
+		log.Println("The storage does not support snapshots.")
+		return
+	}
+	tickChan := time.NewTicker(time.Second * time.Duration(srv.config.SnapshotPeriod)).C
+	for range tickChan {
+		snapshotter.Snapshot()
+	}
+}
+
+// Compute or validate the hashcode of the key according to the configured hash mode.
+// A hashcode that is not sent by the client (model.NoHash) is always computed, so every endpoint routes a key to the same node.
+func (srv *Server) resolveHash(key string, hash *int) bool {
+	switch srv.config.HashMode {
+	case HashModeServer:
+		*hash = cluster.HashKey(key)
+	case HashModeValidate:
+		if *hash != model.NoHash {
+			return *hash == cluster.HashKey(key)
+		}
+	}
+	if *hash == model.NoHash {
+		*hash = cluster.HashKey(key)
+	}
+	return true
+}
+
+// Get the hashcode of a key passed in the URL: the hash query parameter is used if present and valid.
+func (srv *Server) keyHash(c *gin.Context, key string) int {
+	hash, err := strconv.Atoi(c.Query("hash"))
+	if err != nil {
+		hash = model.NoHash
+	}
+	if !srv.resolveHash(key, &hash) {
+		hash = cluster.HashKey(key)
+	}
+	return hash
+}
+
+// Get the node that owns the hashcode when the requests must be routed to the owner nodes.
+// It returns nil if the request must be executed by the current node.
+func (srv *Server) owner(hash int) *cluster.ClusterTopologyNode {
+	if srv.config.RoutingMode != RoutingModeProxy && srv.config.RoutingMode != RoutingModeRedirect {
+		return nil
+	}
+	if util.Contains(srv.config.ServerNode.Node.HashRange, hash) {
+		return nil
+	}
+	if node := srv.config.Topology.GetNodeByHash(hash); node != nil && node.Node.Name != srv.config.ServerNode.Node.Name {
+		return node
+	}
+	return nil
+}
+
+// Execute the request on the current node or route it to the owner node.
+func (srv *Server) dispatch(c *gin.Context, req *command.RpcRequest) {
+	var res *command.RpcResponse
+	req.Consistency = c.Query("consistency")
+	req.ACLs = requestACLs(c)
+	if node := srv.owner(req.Obj.Hash); node == nil {
+		res = srv.executor.Execute(req)
+	} else if srv.config.RoutingMode == RoutingModeRedirect {
+		srv.redirect(c, node)
+		return
+	} else {
+		req.Source = srv.config.ServerNode.Node.Name
+		var err error
+		if res, err = srv.outcmdproc.Caller.ForwardRequest(req, node.Node); err != nil {
+			res = command.NewRpcResponse(http.StatusBadGateway, "error", "108", nil)
+		}
+	}
+	srv.reply(c, req.OpCode, res)
+}
+
+// Redirect the request to the same URL on the node.
+func (srv *Server) redirect(c *gin.Context, node *cluster.ClusterTopologyNode) {
+	scheme := "http://"
+	if srv.config.TLSCert != "" {
+		scheme = "https://"
+	}
+	location := scheme + node.Node.Host + ":" + strconv.Itoa(node.Node.Port) + c.Request.URL.RequestURI()
+	c.Redirect(http.StatusTemporaryRedirect, location)
+}
+
+// Write the response of a request.
+func (srv *Server) reply(c *gin.Context, opcode string, res *command.RpcResponse) {
+	var data model.Any
+	if res.Obj != nil {
+		switch opcode {
+		case "get", "getandremove", "updatevalueifversion":
+			data = model.NewOvoKVResponse(res.Obj.MetaDataObj())
+		case "increment", "setcounter", "getcounter":
+			data = model.NewOvoCounterResponse(res.Obj.MetaDataCounter())
+		}
+	}
+	c.JSON(res.HttpStatus, model.NewOvoResponse(res.Status, res.Code, data))
+}
+
+// List the keys that the API key of the request can read.
+func (srv *Server) readableKeys(c *gin.Context) []string {
+	acls := requestACLs(c)
+	if len(acls) == 0 {
+		return srv.keystorage.Keys()
+	}
+	keys := make([]string, 0)
+	for _, obj := range srv.keystorage.List() {
+		if command.Allowed(acls, obj.Collection, obj.Key, command.RightRead) {
+			keys = append(keys, obj.Key)
+		}
+	}
+	return keys
 }
 
 func (srv *Server) count(c *gin.Context) {
-	res := srv.keystorage.Count()
+	var res int
+	if len(requestACLs(c)) == 0 {
+		res = srv.keystorage.Count()
+	} else {
+		res = len(srv.readableKeys(c))
+	}
 	result := model.NewOvoResponse("done", "0", res)
 	c.JSON(http.StatusOK, result)
 }
 
 func (srv *Server) keys(c *gin.Context) {
-	keys := srv.keystorage.Keys()
+	keys := srv.readableKeys(c)
 	res := &model.OvoKVKeys{Keys: keys}
 	result := model.NewOvoResponse("done", "0", res)
 	c.JSON(http.StatusOK, result)
@@ -167,59 +428,136 @@ func (srv *Server) keys(c *gin.Context) {
 
 func (srv *Server) get(c *gin.Context) {
 	key := c.Param("key")
-	if res, err := srv.keystorage.Get(key); err == nil {
-		obj := model.NewOvoKVResponse(res)
-		result := model.NewOvoResponse("done", "0", obj)
-		c.JSON(http.StatusOK, result)
-	} else {
-		c.JSON(http.StatusNotFound, model.NewOvoResponse("error", "101", nil))
-	}
+	srv.dispatch(c, &command.RpcRequest{OpCode: "get", Obj: &storage.MetaDataUpdObj{Key: key, Hash: srv.keyHash(c, key)}})
 }
 
 func (srv *Server) post(c *gin.Context) {
 	var kv model.OvoKVRequest
 	if c.BindJSON(&kv) == nil {
+		if !srv.resolveHash(kv.Key, &kv.Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
 		obj := model.NewMetaDataObj(&kv)
-		srv.keystorage.Put(obj)
-		srv.outcmdproc.Enqueu(&command.Command{OpCode: "put", Obj: obj.MetaDataUpdObj()})
-		c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", nil))
+		srv.dispatch(c, &command.RpcRequest{OpCode: "put", Obj: obj.MetaDataUpdObj()})
 	} else {
 		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
 	}
 }
 
+// Read the keys of a batch request, the hashcodes are computed or validated as for the single requests.
+func (srv *Server) bindBatch(c *gin.Context) ([]*storage.MetaDataUpdObj, bool) {
+	var kvs []model.OvoKVRequest
+	if c.BindJSON(&kvs) != nil || len(kvs) > MaxBatchSize {
+		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+		return nil, false
+	}
+	objs := make([]*storage.MetaDataUpdObj, len(kvs))
+	for i := range kvs {
+		if !srv.resolveHash(kvs[i].Key, &kvs[i].Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return nil, false
+		}
+		objs[i] = model.NewMetaDataObj(&kvs[i]).MetaDataUpdObj()
+	}
+	return objs, true
+}
+
+// Execute a batch request: the keys are split by owner node, the parts are executed in parallel
+// on the current node and on the owner nodes, then the results are gathered in the order of the keys.
+// In redirect mode the batch is forwarded as in proxy mode.
+func (srv *Server) dispatchBatch(c *gin.Context, opcode string, objs []*storage.MetaDataUpdObj) {
+	consistency := c.Query("consistency")
+	acls := requestACLs(c)
+	parts := make(map[string][]int)
+	owners := make(map[string]*cluster.ClusterTopologyNode)
+	for i, obj := range objs {
+		name := ""
+		if node := srv.owner(obj.Hash); node != nil {
+			name = node.Node.Name
+			owners[name] = node
+		}
+		parts[name] = append(parts[name], i)
+	}
+	results := make([]*command.RpcResponse, len(objs))
+	var wg sync.WaitGroup
+	for name, indexes := range parts {
+		req := &command.RpcBatchRequest{Source: srv.config.ServerNode.Node.Name, OpCode: opcode, Objs: make([]*storage.MetaDataUpdObj, len(indexes)), Consistency: consistency, ACLs: acls}
+		for j, i := range indexes {
+			req.Objs[j] = objs[i]
+		}
+		wg.Add(1)
+		go func(node *cluster.ClusterTopologyNode, indexes []int) {
+			defer wg.Done()
+			var res *command.RpcBatchResponse
+			if node == nil {
+				res = srv.executor.ExecuteBatch(req)
+			} else {
+				var err error
+				if res, err = srv.outcmdproc.Caller.ForwardBatch(req, node.Node); err != nil || len(res.Results) != len(indexes) {
+					res = &command.RpcBatchResponse{Results: make([]*command.RpcResponse, len(indexes))}
+					for j := range res.Results {
+						res.Results[j] = command.NewRpcResponse(http.StatusBadGateway, "error", "108", nil)
+					}
+				}
+			}
+			for j, i := range indexes {
+				results[i] = res.Results[j]
+			}
+		}(owners[name], indexes)
+	}
+	wg.Wait()
+	items := make([]*model.OvoKVResult, len(objs))
+	for i, res := range results {
+		item := &model.OvoKVResult{Key: objs[i].Key, Status: res.Status, Code: res.Code}
+		if res.Obj != nil && opcode == "get" {
+			item.Data = res.Obj.Data
+			item.Version = res.Obj.Version
+		}
+		items[i] = item
+	}
+	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", items))
+}
+
+func (srv *Server) mget(c *gin.Context) {
+	if objs, ok := srv.bindBatch(c); ok {
+		srv.dispatchBatch(c, "get", objs)
+	}
+}
+
+func (srv *Server) mput(c *gin.Context) {
+	if objs, ok := srv.bindBatch(c); ok {
+		srv.dispatchBatch(c, "put", objs)
+	}
+}
+
+func (srv *Server) mdelete(c *gin.Context) {
+	if objs, ok := srv.bindBatch(c); ok {
+		srv.dispatchBatch(c, "delete", objs)
+	}
+}
+
 func (srv *Server) delete(c *gin.Context) {
 	key := c.Param("key")
-	srv.keystorage.Delete(key)
-	srv.outcmdproc.Enqueu(&command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: key}})
-	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", nil))
+	srv.dispatch(c, &command.RpcRequest{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: key, Hash: srv.keyHash(c, key)}})
 }
 
 func (srv *Server) getAndRemove(c *gin.Context) {
 	key := c.Param("key")
-	if res, err := srv.keystorage.GetAndRemove(key); err == nil {
-		obj := model.NewOvoKVResponse(res)
-		srv.outcmdproc.Enqueu(&command.Command{OpCode: "delete", Obj: &storage.MetaDataUpdObj{Key: key}})
-		result := model.NewOvoResponse("done", "0", obj)
-		c.JSON(http.StatusOK, result)
-	} else {
-		c.JSON(http.StatusNotFound, model.NewOvoResponse("error", "101", nil))
-	}
+	srv.dispatch(c, &command.RpcRequest{OpCode: "getandremove", Obj: &storage.MetaDataUpdObj{Key: key, Hash: srv.keyHash(c, key)}})
 }
 
 func (srv *Server) updateValueIfEqual(c *gin.Context) {
 	key := c.Param("key")
 	var kv model.OvoKVUpdateRequest
 	if c.BindJSON(&kv) == nil {
+		if !srv.resolveHash(key, &kv.Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
 		obj := model.NewMetaDataUpdObj(&kv)
 		obj.Key = key
-		err := srv.keystorage.UpdateValueIfEqual(obj)
-		if err == nil {
-			srv.outcmdproc.Enqueu(&command.Command{OpCode: "updatevalue", Obj: obj})
-			c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", nil))
-		} else {
-			c.JSON(http.StatusForbidden, model.NewOvoResponse("error", "103", nil))
-		}
+		srv.dispatch(c, &command.RpcRequest{OpCode: "updatevalue", Obj: obj})
 	} else {
 		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
 	}
@@ -229,15 +567,13 @@ func (srv *Server) updateKeyAndValueIfEqual(c *gin.Context) {
 	key := c.Param("key")
 	var kv model.OvoKVUpdateRequest
 	if c.BindJSON(&kv) == nil {
+		if !srv.resolveHash(key, &kv.Hash) || !srv.resolveHash(kv.NewKey, &kv.NewHash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
 		obj := model.NewMetaDataUpdObj(&kv)
 		obj.Key = key
-		err := srv.keystorage.UpdateKeyAndValueIfEqual(obj)
-		if err == nil {
-			srv.outcmdproc.Enqueu(&command.Command{OpCode: "updatekeyvalue", Obj: obj})
-			c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", nil))
-		} else {
-			c.JSON(http.StatusForbidden, model.NewOvoResponse("error", "104", nil))
-		}
+		srv.dispatch(c, &command.RpcRequest{OpCode: "updatekeyvalue", Obj: obj})
 	} else {
 		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
 	}
@@ -247,20 +583,122 @@ func (srv *Server) updateKey(c *gin.Context) {
 	key := c.Param("key")
 	var kv model.OvoKVUpdateRequest
 	if c.BindJSON(&kv) == nil {
+		if !srv.resolveHash(key, &kv.Hash) || !srv.resolveHash(kv.NewKey, &kv.NewHash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
 		obj := model.NewMetaDataUpdObj(&kv)
 		obj.Key = key
-		err := srv.keystorage.UpdateKey(obj)
-		if err == nil {
-			srv.outcmdproc.Enqueu(&command.Command{OpCode: "updatekey", Obj: obj})
-			c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", nil))
-		} else {
-			c.JSON(http.StatusForbidden, model.NewOvoResponse("error", "105", nil))
-		}
+		srv.dispatch(c, &command.RpcRequest{OpCode: "updatekey", Obj: obj})
 	} else {
 		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
 	}
 }
 
+// Get the node that owns all the keys of a transaction when the requests must be routed to the owner nodes.
+// It returns nil if the transaction must be executed by the current node, that rejects it if it does not own all the keys.
+func (srv *Server) txOwner(req *command.RpcTxRequest) *cluster.ClusterTopologyNode {
+	hashes := make([]int, 0, len(req.Checks)+len(req.Mutations))
+	for _, check := range req.Checks {
+		hashes = append(hashes, check.Hash)
+	}
+	for _, m := range req.Mutations {
+		hashes = append(hashes, m.Obj.Hash)
+	}
+	var owner *cluster.ClusterTopologyNode
+	for i, hash := range hashes {
+		node := srv.owner(hash)
+		if node == nil || (i > 0 && (owner == nil || owner.Node.Name != node.Node.Name)) {
+			return nil
+		}
+		owner = node
+	}
+	return owner
+}
+
+// Split a transaction by the nodes that own its keys. It returns nil if a key has no owner.
+func (srv *Server) txParts(req *command.RpcTxRequest) []*txPart {
+	parts := make([]*txPart, 0)
+	part := func(hash int) *txPart {
+		node := srv.config.Topology.GetNodeByHash(hash)
+		if node == nil {
+			return nil
+		}
+		for _, p := range parts {
+			if p.node.Node.Name == node.Node.Name {
+				return p
+			}
+		}
+		p := &txPart{node: node, req: &command.RpcTxRequest{Consistency: req.Consistency, ACLs: req.ACLs}}
+		parts = append(parts, p)
+		return p
+	}
+	for _, check := range req.Checks {
+		p := part(check.Hash)
+		if p == nil {
+			return nil
+		}
+		p.req.Checks = append(p.req.Checks, check)
+	}
+	for i, m := range req.Mutations {
+		p := part(m.Obj.Hash)
+		if p == nil {
+			return nil
+		}
+		p.req.Mutations = append(p.req.Mutations, m)
+		p.indexes = append(p.indexes, i)
+	}
+	return parts
+}
+
+// Execute a transaction of checks and mutations. The transaction on the keys of a single node is executed by the owner node,
+// the transaction on the keys of different nodes is coordinated by the current node with a two-phase commit.
+func (srv *Server) transaction(c *gin.Context) {
+	var tx model.OvoTxRequest
+	if c.BindJSON(&tx) != nil || len(tx.Mutations) == 0 || len(tx.Checks)+len(tx.Mutations) > MaxBatchSize {
+		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+		return
+	}
+	req := &command.RpcTxRequest{Checks: make([]storage.TxCheck, len(tx.Checks)), Mutations: make([]storage.TxMutation, len(tx.Mutations)), Consistency: c.Query("consistency"), ACLs: requestACLs(c)}
+	for i := range tx.Checks {
+		if !srv.resolveHash(tx.Checks[i].Key, &tx.Checks[i].Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
+		req.Checks[i] = model.NewTxCheck(&tx.Checks[i])
+	}
+	for i := range tx.Mutations {
+		if !srv.resolveHash(tx.Mutations[i].Key, &tx.Mutations[i].Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
+		req.Mutations[i] = model.NewTxMutation(&tx.Mutations[i])
+	}
+	var res *command.RpcTxResponse
+	if parts := srv.txParts(req); len(parts) > 1 && srv.executor.coordinator == nil {
+		res = &command.RpcTxResponse{HttpStatus: http.StatusNotImplemented, Status: "error", Code: "121"}
+	} else if len(parts) > 1 {
+		// the keys belong to different nodes, the current node coordinates the transaction
+		res = srv.executor.coordinator.Execute(parts, len(req.Mutations))
+	} else if node := srv.txOwner(req); node == nil {
+		res = srv.executor.ExecuteTx(req)
+	} else if srv.config.RoutingMode == RoutingModeRedirect {
+		srv.redirect(c, node)
+		return
+	} else {
+		req.Source = srv.config.ServerNode.Node.Name
+		var err error
+		if res, err = srv.outcmdproc.Caller.ForwardTransaction(req, node.Node); err != nil {
+			res = &command.RpcTxResponse{HttpStatus: http.StatusBadGateway, Status: "error", Code: "108"}
+		}
+	}
+	var data model.Any
+	if res.Results != nil {
+		data = model.NewOvoTxResults(req.Mutations, res.Results)
+	}
+	c.JSON(res.HttpStatus, model.NewOvoResponse(res.Status, res.Code, data))
+}
+
 func (srv *Server) getTopology(c *gin.Context) {
 	res := model.NewOvoTopology(&srv.config.Topology)
 	result := model.NewOvoResponse("done", "0", res)
@@ -276,10 +714,12 @@ func (srv *Server) getCurrentNode(c *gin.Context) {
 func (srv *Server) increment(c *gin.Context) {
 	var counter model.OvoCounter
 	if c.BindJSON(&counter) == nil {
+		if !srv.resolveHash(counter.Key, &counter.Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
 		obj := model.NewMetaDataCounter(&counter)
-		cnt := srv.keystorage.Increment(obj)
-		srv.outcmdproc.Enqueu(&command.Command{OpCode: "setcounter", Obj: cnt.MetaDataUpdObj()})
-		c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", model.NewOvoCounterResponse(cnt)))
+		srv.dispatch(c, &command.RpcRequest{OpCode: "increment", Obj: obj.MetaDataUpdObj()})
 	} else {
 		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
 	}
@@ -288,10 +728,12 @@ func (srv *Server) increment(c *gin.Context) {
 func (srv *Server) setcounter(c *gin.Context) {
 	var counter model.OvoCounter
 	if c.BindJSON(&counter) == nil {
+		if !srv.resolveHash(counter.Key, &counter.Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
 		obj := model.NewMetaDataCounter(&counter)
-		cnt := srv.keystorage.SetCounter(obj)
-		srv.outcmdproc.Enqueu(&command.Command{OpCode: "setcounter", Obj: cnt.MetaDataUpdObj()})
-		c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", model.NewOvoCounterResponse(cnt)))
+		srv.dispatch(c, &command.RpcRequest{OpCode: "setcounter", Obj: obj.MetaDataUpdObj()})
 	} else {
 		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
 	}
@@ -299,36 +741,340 @@ func (srv *Server) setcounter(c *gin.Context) {
 
 func (srv *Server) getcounter(c *gin.Context) {
 	key := c.Param("key")
-	if res, err := srv.keystorage.GetCounter(key); err == nil {
-		obj := model.NewOvoCounterResponse(res)
-		result := model.NewOvoResponse("done", "0", obj)
-		c.JSON(http.StatusOK, result)
-	} else {
-		c.JSON(http.StatusNotFound, model.NewOvoResponse("error", "101", nil))
-	}
+	srv.dispatch(c, &command.RpcRequest{OpCode: "getcounter", Obj: &storage.MetaDataUpdObj{Key: key, Hash: srv.keyHash(c, key)}})
 }
 
 func (srv *Server) deletecounter(c *gin.Context) {
 	key := c.Param("key")
-	srv.keystorage.DeleteCounter(key)
-	srv.outcmdproc.Enqueu(&command.Command{OpCode: "deletecounter", Obj: &storage.MetaDataUpdObj{Key: key}})
-	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", nil))
+	srv.dispatch(c, &command.RpcRequest{OpCode: "deletecounter", Obj: &storage.MetaDataUpdObj{Key: key, Hash: srv.keyHash(c, key)}})
 }
 
 func (srv *Server) deleteValueIfEqual(c *gin.Context) {
 	key := c.Param("key")
 	var kv model.OvoKVRequest
 	if c.BindJSON(&kv) == nil {
+		if !srv.resolveHash(key, &kv.Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
 		obj := model.NewMetaDataObj(&kv)
 		obj.Key = key
-		err := srv.keystorage.DeleteValueIfEqual(obj)
-		if err == nil {
-			srv.outcmdproc.Enqueu(&command.Command{OpCode: "delete", Obj: obj.MetaDataUpdObj()})
-			c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", nil))
+		srv.dispatch(c, &command.RpcRequest{OpCode: "deletevalueifequal", Obj: obj.MetaDataUpdObj()})
+	} else {
+		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+	}
+}
+
+func (srv *Server) updateValueIfVersion(c *gin.Context) {
+	key := c.Param("key")
+	var kv model.OvoKVRequest
+	if c.BindJSON(&kv) == nil {
+		if !srv.resolveHash(key, &kv.Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
+		obj := &storage.MetaDataUpdObj{Key: key, NewData: kv.Data, Hash: kv.Hash, Version: kv.Version}
+		srv.dispatch(c, &command.RpcRequest{OpCode: "updatevalueifversion", Obj: obj})
+	} else {
+		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+	}
+}
+
+func (srv *Server) deleteValueIfVersion(c *gin.Context) {
+	key := c.Param("key")
+	var kv model.OvoKVRequest
+	if c.BindJSON(&kv) == nil {
+		if !srv.resolveHash(key, &kv.Hash) {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "11", nil))
+			return
+		}
+		obj := &storage.MetaDataUpdObj{Key: key, Hash: kv.Hash, Version: kv.Version}
+		srv.dispatch(c, &command.RpcRequest{OpCode: "deletevalueifversion", Obj: obj})
+	} else {
+		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+	}
+}
+
+// Scan a page of the keys of the node, or of the whole cluster if the cluster parameter is true.
+// The cursor of a cluster scan is the name of the node and the cursor on the node.
+func (srv *Server) scan(c *gin.Context) {
+	req := &command.ScanRequest{Count: DefaultScanCount, Match: c.Query("match"), ACLs: requestACLs(c)}
+	if count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(DefaultScanCount))); err != nil || count <= 0 {
+		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+		return
+	} else if count > MaxScanCount {
+		req.Count = MaxScanCount
+	} else {
+		req.Count = count
+	}
+	cursor := c.DefaultQuery("cursor", "0")
+	if c.Query("cluster") != "true" {
+		var err error
+		if req.Cursor, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+			return
+		}
+		page := srv.executor.Scan(req)
+		c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", &model.OvoScan{Cursor: strconv.FormatUint(page.Cursor, 10), Keys: page.Keys}))
+		return
+	}
+	nodes := srv.config.Topology.GetNodes()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node.Name < nodes[j].Node.Name })
+	name := ""
+	if cursor != "0" {
+		pos := strings.LastIndex(cursor, ":")
+		var err error
+		if pos < 0 {
+			err = errors.New("Invalid cursor.")
 		} else {
-			c.JSON(http.StatusForbidden, model.NewOvoResponse("error", "103", nil))
+			req.Cursor, err = strconv.ParseUint(cursor[pos+1:], 10, 64)
 		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+			return
+		}
+		name = cursor[:pos]
+	}
+	// the scan continues from the node of the cursor or from the following one if it has left the cluster
+	var node *cluster.ClusterTopologyNode
+	for i, nd := range nodes {
+		if nd.Node.Name >= name {
+			node = nodes[i]
+			break
+		}
+	}
+	res := &model.OvoScan{Cursor: "0", Keys: make([]string, 0)}
+	if node == nil {
+		c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", res))
+		return
+	}
+	if node.Node.Name != name {
+		req.Cursor = 0
+	}
+	req.Owned = true
+	var page *command.ScanPage
+	if node.Node.Name == srv.config.ServerNode.Node.Name {
+		page = srv.executor.Scan(req)
+	} else {
+		var err error
+		if page, err = srv.outcmdproc.Caller.Scan(req, node.Node); err != nil {
+			c.JSON(http.StatusBadGateway, model.NewOvoResponse("error", "108", nil))
+			return
+		}
+	}
+	res.Keys = page.Keys
+	if page.Cursor != 0 {
+		res.Cursor = node.Node.Name + ":" + strconv.FormatUint(page.Cursor, 10)
 	} else {
+		for _, nd := range nodes {
+			if nd.Node.Name > node.Node.Name {
+				res.Cursor = nd.Node.Name + ":0"
+				break
+			}
+		}
+	}
+	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", res))
+}
+
+// Get a page of the objects of the node with key in a range or with a prefix, in lexicographic or reverse order.
+func (srv *Server) keyRange(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DefaultRangeLimit)))
+	if err != nil || limit <= 0 {
 		c.JSON(http.StatusBadRequest, model.NewOvoResponse("error", "10", nil))
+		return
+	}
+	if limit > MaxRangeLimit {
+		limit = MaxRangeLimit
+	}
+	start, end := c.Query("start"), c.Query("end")
+	if prefix := c.Query("prefix"); prefix != "" {
+		start, end = prefix, util.PrefixEnd(prefix)
+	}
+	objs, next, err := srv.keystorage.Range(start, end, c.Query("after"), limit, c.Query("reverse") == "true")
+	if err != nil {
+		c.JSON(http.StatusNotImplemented, model.NewOvoResponse("error", "115", nil))
+		return
+	}
+	values := c.Query("values") == "true"
+	acls := requestACLs(c)
+	res := &model.OvoRange{Items: make([]*model.OvoKVResponse, 0, len(objs)), Next: next}
+	for _, obj := range objs {
+		if !command.Allowed(acls, obj.Collection, obj.Key, command.RightRead) {
+			continue
+		}
+		item := &model.OvoKVResponse{Key: obj.Key, Version: obj.Version}
+		if values {
+			item.Data = obj.Data
+		}
+		res.Items = append(res.Items, item)
+	}
+	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", res))
+}
+
+// Call the function on every active node of the cluster in parallel, it returns false if a node does not answer.
+func (srv *Server) eachNode(call func(node *cluster.ClusterTopologyNode) error) bool {
+	nodes := srv.config.Topology.GetNodes()
+	errs := make(chan error, len(nodes))
+	for _, node := range nodes {
+		go func(node *cluster.ClusterTopologyNode) {
+			errs <- call(node)
+		}(node)
+	}
+	ok := true
+	for range nodes {
+		if <-errs != nil {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Gather the statistics of the collections from all the nodes of the cluster, ordered by name. Every node counts only the objects
+// of the slots it owns, so the copies kept for the twins are not counted twice. If name is not empty only that collection is gathered.
+// It returns false if a node does not answer.
+func (srv *Server) clusterCollections(name string) ([]storage.CollectionStats, bool) {
+	totals := make(map[string]*storage.CollectionStats)
+	mux := new(sync.Mutex)
+	ok := srv.eachNode(func(node *cluster.ClusterTopologyNode) error {
+		var list []storage.CollectionStats
+		if node.Node.Name == srv.config.ServerNode.Node.Name {
+			list = srv.executor.OwnedCollections(name)
+		} else {
+			var err error
+			if list, err = srv.outcmdproc.Caller.Collections(name, node.Node); err != nil {
+				return err
+			}
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		for _, stats := range list {
+			if total, ok := totals[stats.Name]; ok {
+				total.Count += stats.Count
+				total.UsedBytes += stats.UsedBytes
+			} else {
+				total := stats
+				totals[stats.Name] = &total
+			}
+		}
+		return nil
+	})
+	list := make([]storage.CollectionStats, 0, len(totals))
+	for _, total := range totals {
+		list = append(list, *total)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, ok
+}
+
+// List the collections of the cluster that the API key of the request can read, with the number of their objects and their memory usage.
+func (srv *Server) collections(c *gin.Context) {
+	list, ok := srv.clusterCollections("")
+	if !ok {
+		c.JSON(http.StatusBadGateway, model.NewOvoResponse("error", "108", nil))
+		return
+	}
+	acls := requestACLs(c)
+	res := make([]*model.OvoCollection, 0)
+	for _, stats := range list {
+		if command.Allowed(acls, stats.Name, "", command.RightRead) {
+			res = append(res, model.NewOvoCollection(stats))
+		}
+	}
+	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", res))
+}
+
+// Get the number of objects and the memory usage of a collection in the cluster.
+func (srv *Server) getCollection(c *gin.Context) {
+	name := c.Param("name")
+	if !command.Allowed(requestACLs(c), name, "", command.RightRead) {
+		c.JSON(http.StatusForbidden, model.NewOvoResponse("error", "114", nil))
+		return
+	}
+	list, ok := srv.clusterCollections(name)
+	if !ok {
+		c.JSON(http.StatusBadGateway, model.NewOvoResponse("error", "108", nil))
+		return
+	}
+	if len(list) == 0 {
+		c.JSON(http.StatusNotFound, model.NewOvoResponse("error", "101", nil))
+		return
+	}
+	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", model.NewOvoCollection(list[0])))
+}
+
+// List the keys of a collection in the cluster that the API key of the request can read, in lexicographic order.
+// Every node lists the keys of the slots it owns.
+func (srv *Server) collectionKeys(c *gin.Context) {
+	name := c.Param("name")
+	acls := requestACLs(c)
+	keys := make([]string, 0)
+	mux := new(sync.Mutex)
+	ok := srv.eachNode(func(node *cluster.ClusterTopologyNode) error {
+		var list []string
+		if node.Node.Name == srv.config.ServerNode.Node.Name {
+			list = srv.executor.OwnedCollectionKeys(name)
+		} else {
+			var err error
+			if list, err = srv.outcmdproc.Caller.CollectionKeys(name, node.Node); err != nil {
+				return err
+			}
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		for _, key := range list {
+			if command.Allowed(acls, name, key, command.RightRead) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if !ok {
+		c.JSON(http.StatusBadGateway, model.NewOvoResponse("error", "108", nil))
+		return
+	}
+	sort.Strings(keys)
+	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", &model.OvoKVKeys{Keys: keys}))
+}
+
+// Drop the collection on the node and on all the other nodes of the cluster.
+func (srv *Server) dropCollection(c *gin.Context) {
+	name := c.Param("name")
+	if !command.Allowed(requestACLs(c), name, "", command.RightDelete) {
+		c.JSON(http.StatusForbidden, model.NewOvoResponse("error", "114", nil))
+		return
+	}
+	// the objects locked by a prepared transaction can't be removed until the transaction ends
+	srv.executor.participant.enter()
+	if srv.executor.participant.lockedIn(name) {
+		srv.executor.participant.exit()
+		c.JSON(http.StatusConflict, model.NewOvoResponse("error", "118", nil))
+		return
+	}
+	count := srv.keystorage.DropCollection(name)
+	srv.executor.participant.exit()
+	srv.outcmdproc.Enqueu(&command.Command{OpCode: "dropcollection", Obj: &storage.MetaDataUpdObj{Collection: name}})
+	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", &model.OvoCollection{Name: name, Count: count}))
+}
+
+func (srv *Server) stats(c *gin.Context) {
+	stats := &model.OvoStats{Node: srv.config.ServerNode.Node.Name, Keys: srv.keystorage.Count(), Counters: len(srv.keystorage.ListCounters())}
+	ae := srv.antiEntropy.Stats()
+	stats.AntiEntropy = &model.OvoAntiEntropyStats{Rounds: ae.Rounds, DivergentSlots: ae.DivergentSlots, PushedKeys: ae.PushedKeys, PulledKeys: ae.PulledKeys, DeletedKeys: ae.DeletedKeys, LastRound: ae.LastRound}
+	hints := srv.outcmdproc.HintsStats()
+	stats.Hints = &model.OvoHintsStats{Pending: hints.Pending, Queued: hints.Queued, Dropped: hints.Dropped, Replayed: hints.Replayed}
+	stats.Replication = make(map[string]*model.OvoReplicationStats)
+	for name, pl := range srv.outcmdproc.ReplicationStats() {
+		stats.Replication[name] = &model.OvoReplicationStats{Queued: pl.Queued, LagMillis: pl.LagMillis, Sent: pl.Sent, Batches: pl.Batches}
+	}
+	c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", stats))
+}
+
+func (srv *Server) snapshot(c *gin.Context) {
+	if snapshotter, ok := srv.keystorage.(storage.OvoSnapshotter); ok {
+		if err := snapshotter.Snapshot(); err == nil {
+			c.JSON(http.StatusOK, model.NewOvoResponse("done", "0", nil))
+			return
+		}
 	}
+	c.JSON(http.StatusInternalServerError, model.NewOvoResponse("error", "106", nil))
 }
@@ -0,0 +1,631 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/inmemory"
+	"github.com/maxzerbini/ovo/processor"
+	"github.com/maxzerbini/ovo/server/model"
+	"github.com/maxzerbini/ovo/storage"
+	"github.com/maxzerbini/ovo/transport"
+)
+
+// Wait until the condition is true or fail the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Start two nodes that own the keys with the hashtags {local} and {remote} and that are each other's twins.
+func startTwinNodes(t *testing.T) (*Server, *inmemory.InMemoryStorage, *Server, *inmemory.InMemoryStorage) {
+	if cluster.HashKey("local") == cluster.HashKey("remote") {
+		t.Skip("the hashtags have the same slot")
+	}
+	topology := &cluster.ClusterTopology{}
+	remote, ksRemote := startTestServer(t, "remote", []int{cluster.HashKey("remote")}, topology)
+	local, ksLocal := startTestServer(t, "local", []int{cluster.HashKey("local")}, topology)
+	remote.config.Topology = *topology
+	local.config.ServerNode.Twins = []string{"remote"}
+	remote.config.ServerNode.Twins = []string{"local"}
+	return local, ksLocal, remote, ksRemote
+}
+
+// The body of the responses of the RESTful API.
+type apiResponse struct {
+	Status string
+	Code   string
+	Data   json.RawMessage
+}
+
+// Send a request to the RESTful API of the node, the body is encoded in JSON if not nil.
+// It returns the HTTP status and the response, with the Location header in the Status of the redirects.
+func call(t *testing.T, srv *Server, method string, path string, body interface{}) (int, *apiResponse) {
+	gin.SetMode(gin.TestMode)
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	w := httptest.NewRecorder()
+	srv.router().ServeHTTP(w, httptest.NewRequest(method, path, reader))
+	res := new(apiResponse)
+	if w.Code == http.StatusTemporaryRedirect {
+		res.Status = w.Header().Get("Location")
+	} else if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return w.Code, res
+}
+
+// Decode the data of a response.
+func decode(t *testing.T, res *apiResponse, data interface{}) {
+	if err := json.Unmarshal(res.Data, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Add to the topology of the node an active node that does not answer, owning the slots.
+// The slots of the other nodes are not partitioned again.
+func addUnreachableNode(srv *Server, name string, slots []int) {
+	node := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: name, HashRange: slots, APIHost: "127.0.0.1", APIPort: 1, State: cluster.Active}}
+	srv.config.Topology.Nodes = append(srv.config.Topology.Nodes, node)
+}
+
+// Put an object on the node.
+func putOn(t *testing.T, srv *Server, key string, size int) {
+	obj := &storage.MetaDataUpdObj{Key: key, Hash: cluster.HashKey(key), Data: make([]byte, size)}
+	if res := srv.executor.Execute(&command.RpcRequest{OpCode: "put", Obj: obj}); res.Code != "0" {
+		t.Fatalf("put of %s has code %s", key, res.Code)
+	}
+}
+
+func TestEvictionOfReplicas(t *testing.T) {
+	local, ksLocal, remote, ksRemote := startTwinNodes(t)
+	putOn(t, local, "{local}1", 100)
+	waitFor(t, "the replica on the twin", func() bool { _, err := ksRemote.Get("{local}1"); return err == nil })
+	// the eviction of an owned item deletes its replicas
+	ksLocal.SetMemoryLimit(ksLocal.UsedMemory()+50, inmemory.AllKeysLRU)
+	putOn(t, local, "{local}2", 100)
+	if _, err := ksLocal.Get("{local}1"); err == nil {
+		t.Fatal("the owned item has not been evicted")
+	}
+	waitFor(t, "the eviction on the twin", func() bool { _, err := ksRemote.Get("{local}1"); return err != nil })
+	// the eviction of a replica does not delete the owned copy
+	ksLocal.SetMemoryLimit(0, inmemory.NoEviction)
+	ksRemote.SetMemoryLimit(ksRemote.UsedMemory()+50, inmemory.AllKeysLRU)
+	putOn(t, remote, "{remote}1", 100)
+	if _, err := ksRemote.Get("{local}2"); err == nil {
+		t.Fatal("the replica has not been evicted")
+	}
+	waitFor(t, "the replica of the twin", func() bool { _, err := ksLocal.Get("{remote}1"); return err == nil })
+	if _, err := ksLocal.Get("{local}2"); err != nil {
+		t.Fatal("the eviction of a replica deleted the owned copy")
+	}
+}
+
+func TestResolveHash(t *testing.T) {
+	key := "key"
+	if cluster.HashKey(key) == 0 {
+		t.Skip("the key is in the slot 0")
+	}
+	srv := &Server{config: &ServerConf{HashMode: HashModeClient}}
+	var kv model.OvoKVRequest
+	json.Unmarshal([]byte(`{"Key":"key"}`), &kv)
+	if !srv.resolveHash(kv.Key, &kv.Hash) || kv.Hash != cluster.HashKey(key) {
+		t.Fatalf("omitted hashcode resolved to %d", kv.Hash)
+	}
+	json.Unmarshal([]byte(`{"Key":"key","Hash":0}`), &kv)
+	if !srv.resolveHash(kv.Key, &kv.Hash) || kv.Hash != 0 {
+		t.Fatalf("hashcode 0 sent by the client resolved to %d", kv.Hash)
+	}
+	var upd model.OvoKVUpdateRequest
+	json.Unmarshal([]byte(`{"Key":"key","NewKey":"key","Hash":0}`), &upd)
+	if upd.Hash != 0 || upd.NewHash != model.NoHash {
+		t.Fatalf("update request decoded with hashcodes %d and %d", upd.Hash, upd.NewHash)
+	}
+	gin.SetMode(gin.TestMode)
+	for query, expected := range map[string]int{"": cluster.HashKey(key), "?hash=0": 0, "?hash=x": cluster.HashKey(key)} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/ovo/keystorage/key"+query, nil)
+		if hash := srv.keyHash(c, key); hash != expected {
+			t.Fatalf("query %q resolved to %d expected %d", query, hash, expected)
+		}
+	}
+	srv.config.HashMode = HashModeValidate
+	hash := 0
+	if srv.resolveHash(key, &hash) {
+		t.Fatal("wrong hashcode 0 accepted")
+	}
+}
+
+func TestClusterCollections(t *testing.T) {
+	local, ksLocal, remote, ksRemote := startTwinNodes(t)
+	for _, key := range []string{"{local}1", "{local}2", "{remote}1"} {
+		kv := &model.OvoKVRequest{Key: key, Data: []byte("v"), Collection: "users"}
+		if status, res := call(t, local, "POST", "/ovo/keystorage", kv); status != http.StatusOK {
+			t.Fatalf("put of %s has status %d code %s", key, status, res.Code)
+		}
+	}
+	kv := &model.OvoKVRequest{Key: "{remote}2", Data: []byte("v"), Collection: "orders"}
+	call(t, remote, "POST", "/ovo/keystorage", kv)
+	// every node keeps the copies of its twin, the objects are counted once
+	waitFor(t, "the replicas", func() bool { return ksLocal.Count() == 4 && ksRemote.Count() == 4 })
+	for _, srv := range []*Server{local, remote} {
+		_, res := call(t, srv, "GET", "/ovo/collections", nil)
+		var list []model.OvoCollection
+		decode(t, res, &list)
+		if len(list) != 2 || list[0].Name != "orders" || list[0].Count != 1 || list[1].Name != "users" || list[1].Count != 3 {
+			t.Fatalf("collections of the cluster %v", list)
+		}
+		_, res = call(t, srv, "GET", "/ovo/collections/users", nil)
+		var users model.OvoCollection
+		decode(t, res, &users)
+		if users.Count != 3 || users.UsedBytes != list[1].UsedBytes {
+			t.Fatalf("collection of the cluster %v", users)
+		}
+		_, res = call(t, srv, "GET", "/ovo/collections/users/keys", nil)
+		var keys model.OvoKVKeys
+		decode(t, res, &keys)
+		if len(keys.Keys) != 3 || keys.Keys[0] != "{local}1" || keys.Keys[1] != "{local}2" || keys.Keys[2] != "{remote}1" {
+			t.Fatalf("keys of the collection %v", keys.Keys)
+		}
+		if status, res := call(t, srv, "GET", "/ovo/collections/unknown", nil); status != http.StatusNotFound || res.Code != "101" {
+			t.Fatalf("unknown collection has status %d code %s", status, res.Code)
+		}
+	}
+	// a node that does not answer fails the request
+	addUnreachableNode(local, "down", []int{})
+	if status, res := call(t, local, "GET", "/ovo/collections", nil); status != http.StatusBadGateway || res.Code != "108" {
+		t.Fatalf("collections with an unreachable node have status %d code %s", status, res.Code)
+	}
+}
+
+func TestRoutingModes(t *testing.T) {
+	local, ksLocal, remote, ksRemote := startTxNodes(t)
+	if slot := cluster.HashKey("down"); slot == cluster.HashKey("local") || slot == cluster.HashKey("remote") {
+		t.Skip("the hashtags have the same slot")
+	}
+	// in proxy mode the requests for the keys of another node are executed by the owner
+	kv := &model.OvoKVRequest{Key: "{remote}1", Data: []byte("v")}
+	if status, res := call(t, local, "POST", "/ovo/keystorage", kv); status != http.StatusOK || res.Code != "0" {
+		t.Fatalf("forwarded put has status %d code %s", status, res.Code)
+	}
+	if _, err := ksRemote.Get("{remote}1"); err != nil {
+		t.Fatal("forwarded put not stored on the owner")
+	}
+	if _, err := ksLocal.Get("{remote}1"); err == nil {
+		t.Fatal("forwarded put stored on the node that received it")
+	}
+	status, res := call(t, local, "GET", "/ovo/keystorage/{remote}1", nil)
+	var obj model.OvoKVResponse
+	decode(t, res, &obj)
+	if status != http.StatusOK || string(obj.Data) != "v" {
+		t.Fatalf("forwarded get has status %d data %q", status, obj.Data)
+	}
+	call(t, local, "PUT", "/ovo/counters", &model.OvoCounter{Key: "{remote}c", Value: 2})
+	if cnt, err := ksRemote.GetCounter("{remote}c"); err != nil || cnt.Value != 2 {
+		t.Fatal("forwarded increment not applied on the owner")
+	}
+	// the keys of the node are not routed
+	if status, res := call(t, local, "GET", "/ovo/keystorage/{local}1", nil); status != http.StatusNotFound || res.Code != "101" {
+		t.Fatalf("get of a missing local key has status %d code %s", status, res.Code)
+	}
+	// an owner that does not answer
+	addUnreachableNode(local, "down", []int{cluster.HashKey("down")})
+	if status, res := call(t, local, "GET", "/ovo/keystorage/{down}1", nil); status != http.StatusBadGateway || res.Code != "108" {
+		t.Fatalf("get forwarded to an unreachable owner has status %d code %s", status, res.Code)
+	}
+	// in redirect mode the client is sent to the owner
+	local.config.RoutingMode = RoutingModeRedirect
+	remote.config.ServerNode.Node.Host, remote.config.ServerNode.Node.Port = "owner.example", 8080
+	status, res = call(t, local, "GET", "/ovo/keystorage/{remote}1?consistency=local", nil)
+	if status != http.StatusTemporaryRedirect || !strings.HasPrefix(res.Status, "http://owner.example:8080/ovo/keystorage/") || !strings.HasSuffix(res.Status, "1?consistency=local") {
+		t.Fatalf("redirect has status %d location %s", status, res.Status)
+	}
+	if status, _ := call(t, local, "POST", "/ovo/keystorage", &model.OvoKVRequest{Key: "{local}1", Data: []byte("v")}); status != http.StatusOK {
+		t.Fatalf("put of a local key has status %d", status)
+	}
+}
+
+func TestWriteConsistency(t *testing.T) {
+	local, ksLocal, _, ksRemote := startTwinNodes(t)
+	// a write acknowledged by the twins is already stored on them
+	for i, level := range []string{ConsistencyOneTwin, ConsistencyAllTwins, ConsistencyQuorum} {
+		key := "{local}" + strconv.Itoa(i)
+		if status, res := call(t, local, "POST", "/ovo/keystorage?consistency="+level, &model.OvoKVRequest{Key: key, Data: []byte("v")}); status != http.StatusOK || res.Code != "0" {
+			t.Fatalf("%s write has status %d code %s", level, status, res.Code)
+		}
+		if _, err := ksRemote.Get(key); err != nil {
+			t.Fatalf("%s write not stored on the twin", level)
+		}
+	}
+	if status, res := call(t, local, "POST", "/ovo/keystorage?consistency=all", &model.OvoKVRequest{Key: "{local}x", Data: []byte("v")}); status != http.StatusBadRequest || res.Code != "12" {
+		t.Fatalf("unknown level has status %d code %s", status, res.Code)
+	}
+	// a twin that does not answer fails the levels that require it, the write is kept on the node
+	addUnreachableNode(local, "down", []int{})
+	local.config.ServerNode.Twins = append(local.config.ServerNode.Twins, "down")
+	local.config.WriteTimeout = 200
+	if status, res := call(t, local, "POST", "/ovo/keystorage?consistency=all-twins", &model.OvoKVRequest{Key: "{local}4", Data: []byte("v")}); status != http.StatusGatewayTimeout || res.Code != "109" {
+		t.Fatalf("all-twins write with a twin down has status %d code %s", status, res.Code)
+	}
+	if _, err := ksLocal.Get("{local}4"); err != nil {
+		t.Fatal("write not stored on the node")
+	}
+	for _, level := range []string{ConsistencyOneTwin, ConsistencyQuorum} {
+		if status, res := call(t, local, "POST", "/ovo/keystorage?consistency="+level, &model.OvoKVRequest{Key: "{local}5", Data: []byte("v")}); status != http.StatusOK {
+			t.Fatalf("%s write with a twin down has status %d code %s", level, status, res.Code)
+		}
+	}
+	// the default level of the node applies to the requests without level
+	local.config.WriteConsistency = ConsistencyAllTwins
+	if status, res := call(t, local, "DELETE", "/ovo/keystorage/{local}5", nil); status != http.StatusGatewayTimeout || res.Code != "109" {
+		t.Fatalf("delete with the default level has status %d code %s", status, res.Code)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	local, ksLocal, _, ksRemote := startTwinNodes(t)
+	putOn(t, local, "{local}1", 10)
+	waitFor(t, "the replica on the twin", func() bool { _, err := ksRemote.Get("{local}1"); return err == nil })
+	version := func(ks *inmemory.InMemoryStorage) uint64 {
+		if obj, err := ks.Get("{local}1"); err == nil {
+			return obj.Version
+		}
+		return 0
+	}
+	get := func(level string) (int, *apiResponse, *model.OvoKVResponse) {
+		status, res := call(t, local, "GET", "/ovo/keystorage/{local}1?consistency="+level, nil)
+		obj := new(model.OvoKVResponse)
+		if status == http.StatusOK {
+			decode(t, res, obj)
+		}
+		return status, res, obj
+	}
+	// the twin has a newer copy: it is returned and the node is repaired
+	ksRemote.Put(&storage.MetaDataObj{Key: "{local}1", Hash: cluster.HashKey("{local}1"), Data: []byte("twin"), Version: 5})
+	if status, _, obj := get(ConsistencyOneTwin); status != http.StatusOK || string(obj.Data) != "twin" || obj.Version != 5 {
+		t.Fatalf("read has status %d data %q version %d", status, obj.Data, obj.Version)
+	}
+	waitFor(t, "the repair of the node", func() bool { return version(ksLocal) == 5 })
+	// the node has a newer copy: the stale twin is repaired
+	ksLocal.Put(&storage.MetaDataObj{Key: "{local}1", Hash: cluster.HashKey("{local}1"), Data: []byte("node"), Version: 9})
+	if status, _, obj := get(ConsistencyAllTwins); status != http.StatusOK || string(obj.Data) != "node" {
+		t.Fatalf("read has status %d data %q", status, obj.Data)
+	}
+	waitFor(t, "the repair of the twin", func() bool { return version(ksRemote) == 9 })
+	// a twin that does not answer fails the levels that require it
+	addUnreachableNode(local, "down", []int{})
+	local.config.ServerNode.Twins = append(local.config.ServerNode.Twins, "down")
+	local.config.ReadTimeout = 200
+	if status, res, _ := get(ConsistencyAllTwins); status != http.StatusGatewayTimeout || res.Code != "110" {
+		t.Fatalf("all-twins read with a twin down has status %d code %s", status, res.Code)
+	}
+	if status, _, _ := get(ConsistencyQuorum); status != http.StatusOK {
+		t.Fatalf("quorum read with a twin down has status %d", status)
+	}
+	local.config.ReadConsistency = ConsistencyAllTwins
+	if status, res, _ := get(""); status != http.StatusGatewayTimeout || res.Code != "110" {
+		t.Fatalf("read with the default level has status %d code %s", status, res.Code)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	local, ksLocal, _, ksRemote := startTwinNodes(t)
+	call(t, local, "POST", "/ovo/keystorage", &model.OvoKVRequest{Key: "{local}1", Data: []byte("v1")})
+	_, res := call(t, local, "GET", "/ovo/keystorage/{local}1", nil)
+	obj := new(model.OvoKVResponse)
+	decode(t, res, obj)
+	if obj.Version != 1 {
+		t.Fatalf("new object with version %d", obj.Version)
+	}
+	// the value is changed only if the version matches, the twin gets the new version
+	status, res := call(t, local, "PUT", "/ovo/keystorage/{local}1/updatevalueifversion?consistency=all-twins", &model.OvoKVRequest{Data: []byte("v2"), Version: 1})
+	decode(t, res, obj)
+	if status != http.StatusOK || obj.Version != 2 || string(obj.Data) != "v2" {
+		t.Fatalf("update has status %d version %d data %q", status, obj.Version, obj.Data)
+	}
+	if replica, err := ksRemote.Get("{local}1"); err != nil || replica.Version != 2 || string(replica.Data) != "v2" {
+		t.Fatal("update not replicated with its version")
+	}
+	if _, res := call(t, local, "PUT", "/ovo/keystorage/{local}1/updatevalueifversion", &model.OvoKVRequest{Data: []byte("v3"), Version: 1}); res.Code != "111" {
+		t.Fatalf("update of a changed object has code %s", res.Code)
+	}
+	if _, res := call(t, local, "POST", "/ovo/keystorage/{local}1/deletevalueifversion", &model.OvoKVRequest{Version: 1}); res.Code != "111" {
+		t.Fatalf("delete of a changed object has code %s", res.Code)
+	}
+	// a renamed object keeps its version on the twin
+	upd := &model.OvoKVUpdateRequest{NewKey: "{local}2"}
+	if status, res := call(t, local, "PUT", "/ovo/keystorage/{local}1/updatekey?consistency=all-twins", upd); status != http.StatusOK {
+		t.Fatalf("rename has status %d code %s", status, res.Code)
+	}
+	renamed, err := ksLocal.Get("{local}2")
+	if err != nil {
+		t.Fatal("object not renamed")
+	}
+	if replica, err := ksRemote.Get("{local}2"); err != nil || replica.Version != renamed.Version {
+		t.Fatal("rename not replicated with its version")
+	}
+	if _, err := ksRemote.Get("{local}1"); err == nil {
+		t.Fatal("old key not removed from the twin")
+	}
+	// the object is removed only if the version matches
+	path := "/ovo/keystorage/{local}2/deletevalueifversion?consistency=all-twins"
+	if status, res := call(t, local, "POST", path, &model.OvoKVRequest{Version: renamed.Version}); status != http.StatusOK {
+		t.Fatalf("delete has status %d code %s", status, res.Code)
+	}
+	if _, err := ksRemote.Get("{local}2"); err == nil {
+		t.Fatal("delete not replicated")
+	}
+	if _, res := call(t, local, "POST", path, &model.OvoKVRequest{Version: renamed.Version}); res.Code != "111" {
+		t.Fatalf("delete of a removed object has code %s", res.Code)
+	}
+}
+
+// Create a certificate signed by the CA, or a CA certificate if ca is nil, and write it with its key in the directory.
+// It returns the certificate, its key and the paths of the files.
+func writeCert(t *testing.T, dir string, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		ca, caKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+func TestInnerTLSAndSecret(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, nodeCert, nodeKey := writeCert(t, dir, "node", ca, caKey)
+	rogueCA, rogueCAKey, _, _ := writeCert(t, dir, "rogue-ca", nil, nil)
+	_, _, rogueCert, rogueKey := writeCert(t, dir, "rogue", rogueCA, rogueCAKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	node := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "secure", HashRange: []int{}, APIHost: "127.0.0.1", APIPort: listener.Addr().(*net.TCPAddr).Port, State: cluster.Active}}
+	conf := &ServerConf{ServerNode: node, InnerTLSCert: nodeCert, InnerTLSKey: nodeKey, InnerTLSCA: caFile, ClusterSecret: "secret"}
+	conf.Topology.Nodes = []*cluster.ClusterTopologyNode{node}
+	srv := NewServer(conf, inmemory.NewInMemoryStorage())
+	tlsConfig, err := conf.InnerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	server.RegisterName("InnerServer", srv.innerServer)
+	go transport.Serve(tls.NewListener(listener, tlsConfig), server, server)
+	caller := func(cert string, key string) *processor.NodeCaller {
+		nc := processor.NewNodeCaller("client")
+		nc.Timeout = time.Second
+		if cert != "" {
+			if nc.TLSConfig, err = transport.LoadTLSConfig(cert, key, caFile); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nc
+	}
+	// only the nodes with a certificate of the cluster CA can connect
+	trusted := caller(nodeCert, nodeKey)
+	if err := trusted.Ping("client", node.Node); err != nil {
+		t.Fatalf("node with a certificate of the cluster CA rejected: %v", err)
+	}
+	if err := caller(rogueCert, rogueKey).Ping("client", node.Node); err == nil {
+		t.Fatal("node with a certificate of another CA accepted")
+	}
+	if err := caller("", "").Ping("client", node.Node); err == nil {
+		t.Fatal("node without TLS accepted")
+	}
+	// the registration requires the cluster secret
+	joining := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "joining", HashRange: []int{}, State: cluster.Active}}
+	if _, err := trusted.RegisterNode(joining, node.Node); err == nil {
+		t.Fatal("registration without the cluster secret accepted")
+	}
+	if found, _ := srv.config.Topology.GetNodeByName("joining"); found != nil {
+		t.Fatal("node registered without the cluster secret")
+	}
+	trusted.Secret = "secret"
+	if _, err := trusted.RegisterNode(joining, node.Node); err != nil {
+		t.Fatalf("registration with the cluster secret rejected: %v", err)
+	}
+	if found, _ := srv.config.Topology.GetNodeByName("joining"); found == nil {
+		t.Fatal("node not registered")
+	}
+}
+
+// Scan all the pages of the keys with the parameters of the query, it fails if a key is returned more than once.
+func scanAll(t *testing.T, srv *Server, query string) map[string]bool {
+	keys := make(map[string]bool)
+	cursor := "0"
+	for pages := 0; pages == 0 || cursor != "0"; pages++ {
+		if pages > 100 {
+			t.Fatal("scan not completed")
+		}
+		status, res := call(t, srv, "GET", "/ovo/scan?count=3&cursor="+cursor+query, nil)
+		if status != http.StatusOK {
+			t.Fatalf("scan has status %d code %s", status, res.Code)
+		}
+		var page model.OvoScan
+		decode(t, res, &page)
+		for _, key := range page.Keys {
+			if keys[key] {
+				t.Fatalf("key %s returned twice", key)
+			}
+			keys[key] = true
+		}
+		cursor = page.Cursor
+	}
+	return keys
+}
+
+func TestScan(t *testing.T) {
+	local, ksLocal, remote, ksRemote := startTwinNodes(t)
+	for i := 0; i < 10; i++ {
+		putOn(t, local, "{local}"+strconv.Itoa(i), 1)
+		putOn(t, local, "{remote}"+strconv.Itoa(i), 1)
+	}
+	waitFor(t, "the replicas", func() bool { return ksLocal.Count() == 20 && ksRemote.Count() == 20 })
+	// the scan of a node returns all its keys, the replicas too
+	if keys := scanAll(t, local, ""); len(keys) != 20 {
+		t.Fatalf("scan of the node returned %d keys", len(keys))
+	}
+	if keys := scanAll(t, local, "&match=*2"); len(keys) != 2 || !keys["{local}2"] || !keys["{remote}2"] {
+		t.Fatalf("scan with a pattern returned %v", keys)
+	}
+	// the scan of the cluster returns every key once from its owner
+	for _, srv := range []*Server{local, remote} {
+		if keys := scanAll(t, srv, "&cluster=true"); len(keys) != 20 {
+			t.Fatalf("scan of the cluster returned %d keys", len(keys))
+		}
+	}
+	_, res := call(t, local, "GET", "/ovo/scan?cluster=true&count=100", nil)
+	var page model.OvoScan
+	decode(t, res, &page)
+	if page.Cursor != "remote:0" || len(page.Keys) != 10 || !strings.HasPrefix(page.Keys[0], "{local}") {
+		t.Fatalf("first page of the cluster scan %v", page)
+	}
+	for _, query := range []string{"cursor=abc", "count=0", "cluster=true&cursor=remote", "cluster=true&cursor=remote:x"} {
+		if status, res := call(t, local, "GET", "/ovo/scan?"+query, nil); status != http.StatusBadRequest || res.Code != "10" {
+			t.Fatalf("scan with %s has status %d code %s", query, status, res.Code)
+		}
+	}
+	// a node that does not answer fails the scan of its keys
+	addUnreachableNode(local, "down", []int{})
+	if status, res := call(t, local, "GET", "/ovo/scan?cluster=true&cursor=down:0", nil); status != http.StatusBadGateway || res.Code != "108" {
+		t.Fatalf("scan of an unreachable node has status %d code %s", status, res.Code)
+	}
+}
+
+// Get the page of the range query, it returns the keys of the items and the key of the next page.
+func rangePage(t *testing.T, srv *Server, query string) ([]string, string) {
+	status, res := call(t, srv, "GET", "/ovo/range?"+query, nil)
+	if status != http.StatusOK {
+		t.Fatalf("range %s has status %d code %s", query, status, res.Code)
+	}
+	var page model.OvoRange
+	decode(t, res, &page)
+	keys := make([]string, 0, len(page.Items))
+	for _, item := range page.Items {
+		keys = append(keys, item.Key)
+	}
+	return keys, page.Next
+}
+
+func TestRange(t *testing.T) {
+	topology := &cluster.ClusterTopology{}
+	srv, ks := startTestServer(t, "single", []int{}, topology)
+	// a node without the ordered index does not support the range queries
+	if status, res := call(t, srv, "GET", "/ovo/range?prefix=user", nil); status != http.StatusNotImplemented || res.Code != "115" {
+		t.Fatalf("range without the ordered index has status %d code %s", status, res.Code)
+	}
+	ks.EnableOrderedIndex()
+	for _, key := range []string{"user:3", "order:1", "user:1", "user:2", "userx", "user:4"} {
+		putOn(t, srv, key, 1)
+	}
+	if keys, next := rangePage(t, srv, "prefix=user:"); strings.Join(keys, ",") != "user:1,user:2,user:3,user:4" || next != "" {
+		t.Fatalf("range with a prefix returned %v next %q", keys, next)
+	}
+	if keys, _ := rangePage(t, srv, "start=user:2&end=user:4"); strings.Join(keys, ",") != "user:2,user:3" {
+		t.Fatalf("range between two keys returned %v", keys)
+	}
+	// the pages continue after the key of the previous page
+	keys, next := rangePage(t, srv, "prefix=user:&limit=3")
+	if strings.Join(keys, ",") != "user:1,user:2,user:3" || next != "user:3" {
+		t.Fatalf("first page returned %v next %q", keys, next)
+	}
+	if keys, next = rangePage(t, srv, "prefix=user:&limit=3&after="+next); strings.Join(keys, ",") != "user:4" || next != "" {
+		t.Fatalf("second page returned %v next %q", keys, next)
+	}
+	if keys, next = rangePage(t, srv, "prefix=user:&limit=2&reverse=true"); strings.Join(keys, ",") != "user:4,user:3" || next != "user:3" {
+		t.Fatalf("reverse page returned %v next %q", keys, next)
+	}
+	if keys, _ = rangePage(t, srv, "prefix=user:&limit=2&reverse=true&after="+next); strings.Join(keys, ",") != "user:2,user:1" {
+		t.Fatalf("second reverse page returned %v", keys)
+	}
+	// the values are returned only if requested
+	_, res := call(t, srv, "GET", "/ovo/range?prefix=order:&values=true", nil)
+	var page model.OvoRange
+	decode(t, res, &page)
+	if len(page.Items) != 1 || len(page.Items[0].Data) != 1 {
+		t.Fatalf("range with the values returned %v", page.Items)
+	}
+	_, res = call(t, srv, "GET", "/ovo/range?prefix=order:", nil)
+	var keysOnly model.OvoRange
+	decode(t, res, &keysOnly)
+	if len(keysOnly.Items) != 1 || keysOnly.Items[0].Data != nil {
+		t.Fatalf("range without the values returned %v", keysOnly.Items)
+	}
+	if status, res := call(t, srv, "GET", "/ovo/range?limit=0", nil); status != http.StatusBadRequest || res.Code != "10" {
+		t.Fatalf("range with an invalid limit has status %d code %s", status, res.Code)
+	}
+}
+
+func TestDropCollection(t *testing.T) {
+	local, ksLocal, _, ksRemote := startTwinNodes(t)
+	for _, key := range []string{"{local}1", "{remote}1"} {
+		call(t, local, "POST", "/ovo/keystorage", &model.OvoKVRequest{Key: key, Data: []byte("v"), Collection: "users"})
+	}
+	call(t, local, "POST", "/ovo/keystorage", &model.OvoKVRequest{Key: "{local}2", Data: []byte("v"), Collection: "orders"})
+	waitFor(t, "the replicas", func() bool { return ksLocal.Count() == 3 && ksRemote.Count() == 3 })
+	status, res := call(t, local, "DELETE", "/ovo/collections/users", nil)
+	var dropped model.OvoCollection
+	decode(t, res, &dropped)
+	if status != http.StatusOK || dropped.Name != "users" || dropped.Count != 2 {
+		t.Fatalf("drop of the collection has status %d and result %v", status, dropped)
+	}
+	// the drop is replicated to the twins, the other collections are kept
+	waitFor(t, "the replicated drop", func() bool { return ksRemote.Count() == 1 })
+	if ksLocal.Count() != 1 {
+		t.Fatalf("%d objects left on the node", ksLocal.Count())
+	}
+	if status, res := call(t, local, "GET", "/ovo/collections/users", nil); status != http.StatusNotFound || res.Code != "101" {
+		t.Fatalf("dropped collection has status %d code %s", status, res.Code)
+	}
+}
@@ -0,0 +1,637 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+// List the keys read or changed by a transaction.
+func txKeys(req *command.RpcTxRequest) []string {
+	keys := make([]string, 0, len(req.Checks)+len(req.Mutations))
+	for _, check := range req.Checks {
+		keys = append(keys, check.Key)
+	}
+	for _, m := range req.Mutations {
+		keys = append(keys, m.Obj.Key)
+	}
+	return keys
+}
+
+// An append-only log of JSON records, it is rewritten with the records still needed when it's compacted.
+type txLog struct {
+	file *os.File
+}
+
+// Open the log and read its records in order.
+func openTxLog(path string, read func(data []byte)) (*txLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		read(scanner.Bytes())
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &txLog{file: file}, nil
+}
+
+// Append a record to the log, it is flushed to disk if sync is true. A nil log discards the records.
+func (l *txLog) append(record interface{}, sync bool) error {
+	if l == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if sync {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+// Rewrite the log with the records.
+func (l *txLog) rewrite(records []interface{}) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(0, 0); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := l.append(record, false); err != nil {
+			return err
+		}
+	}
+	return l.file.Sync()
+}
+
+// Close the log.
+func (l *txLog) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// A transaction prepared by the node, its keys are locked until the coordinator commits or aborts it.
+type preparedTx struct {
+	req         *command.RpcTxRequest
+	keys        []string
+	reservation *storage.TxReservation // the memory reserved for the mutations
+	deadline    time.Time
+}
+
+// A prepare record, it is written in the prepare log before the participant votes to commit.
+type txPrepare struct {
+	ID   string
+	Req  *command.RpcTxRequest `json:",omitempty"`
+	Done bool                  // the transaction has been committed or aborted
+}
+
+// The participant of the distributed transactions prepares the part of the transactions on the keys of the node.
+// The keys of a prepared transaction are locked: the writes on them are refused and when the lock times out
+// the participant asks the outcome of the transaction to the coordinator.
+type TxParticipant struct {
+	executor  *Executor
+	timeout   time.Duration
+	prepared  map[string]*preparedTx
+	locks     map[string]string    // the id of the transaction that locks the key
+	committed map[string]time.Time // the transactions committed recently, a repeated commit is acknowledged
+	log       *txLog               // the prepare log, nil if the distributed transactions are disabled
+	mux       *sync.RWMutex
+}
+
+// Create the participant and start the resolution of the in-doubt transactions.
+func NewTxParticipant(ex *Executor) *TxParticipant {
+	timeout := time.Duration(ex.config.TxTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DefaultTxTimeout * time.Millisecond
+	}
+	p := &TxParticipant{executor: ex, timeout: timeout, prepared: make(map[string]*preparedTx), locks: make(map[string]string), committed: make(map[string]time.Time), mux: new(sync.RWMutex)}
+	go p.resolver()
+	return p
+}
+
+// Open the prepare log and restore the transactions prepared before a restart: their keys are locked again
+// and their outcome is asked to the coordinator.
+func (p *TxParticipant) openLog(path string) error {
+	records := make(map[string]*txPrepare)
+	prepareLog, err := openTxLog(path, func(data []byte) {
+		record := new(txPrepare)
+		if json.Unmarshal(data, record) != nil {
+			return
+		}
+		if record.Done {
+			delete(records, record.ID)
+		} else if record.Req != nil {
+			records[record.ID] = record
+		}
+	})
+	if err != nil {
+		return err
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, record := range records {
+		keys := txKeys(record.Req)
+		reservation, err := p.executor.keystorage.Reserve(keys, record.Req.Mutations)
+		if err != nil {
+			log.Printf("Memory reservation of prepared transaction %s failed: %v\r\n", record.ID, err)
+		}
+		for _, key := range keys {
+			p.locks[key] = record.ID
+		}
+		p.prepared[record.ID] = &preparedTx{req: record.Req, keys: keys, reservation: reservation, deadline: time.Now()}
+	}
+	p.log = prepareLog
+	if err = p.compact(); err != nil {
+		prepareLog.close()
+		p.log = nil
+		return err
+	}
+	if len(p.prepared) > 0 {
+		log.Printf("Prepare log contains %d prepared transactions\r\n", len(p.prepared))
+	}
+	return nil
+}
+
+// Rewrite the prepare log with the prepared transactions. It must be called holding the lock.
+func (p *TxParticipant) compact() error {
+	records := make([]interface{}, 0, len(p.prepared))
+	for _, tx := range p.prepared {
+		records = append(records, &txPrepare{ID: tx.req.TxID, Req: tx.req})
+	}
+	return p.log.rewrite(records)
+}
+
+// Hold the read lock of the participant, the writes hold it while they check the key locks and change the storage.
+func (p *TxParticipant) enter() {
+	p.mux.RLock()
+}
+
+// Release the read lock of the participant.
+func (p *TxParticipant) exit() {
+	p.mux.RUnlock()
+}
+
+// Check if a key is locked by a prepared transaction. It must be called holding the lock.
+func (p *TxParticipant) locked(keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := p.locks[key]; ok && key != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a prepared transaction locks an object of the collection. It must be called holding the lock.
+func (p *TxParticipant) lockedIn(collection string) bool {
+	for key := range p.locks {
+		if obj, err := p.executor.keystorage.Get(key); err == nil && obj.Collection == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// Prepare the part of a distributed transaction: the checks are evaluated, the memory of the mutations is reserved
+// and the keys are locked, so the checks stay valid until the transaction ends. The transaction is written in the prepare log
+// before voting to commit, so a prepared transaction can always be committed, even after a restart.
+// A node without the prepare log refuses the transactions with error code 121.
+func (p *TxParticipant) Prepare(req *command.RpcTxRequest) *command.RpcTxResponse {
+	if res := p.executor.validateTx(req); res != nil {
+		return res
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.log == nil {
+		return &command.RpcTxResponse{HttpStatus: http.StatusNotImplemented, Status: "error", Code: "121"}
+	}
+	if _, ok := p.prepared[req.TxID]; !ok {
+		keys := txKeys(req)
+		if p.locked(keys...) {
+			return &command.RpcTxResponse{HttpStatus: http.StatusConflict, Status: "error", Code: "118"}
+		}
+		if _, res := p.executor.storeTx(req.Checks, nil, nil); res != nil {
+			return res
+		}
+		reservation, err := p.executor.keystorage.Reserve(keys, req.Mutations)
+		if err == storage.ErrOutOfMemory {
+			return &command.RpcTxResponse{HttpStatus: http.StatusInsufficientStorage, Status: "error", Code: "107"}
+		} else if err != nil {
+			return &command.RpcTxResponse{HttpStatus: http.StatusBadRequest, Status: "error", Code: "10"}
+		}
+		if err = p.log.append(&txPrepare{ID: req.TxID, Req: req}, true); err != nil {
+			log.Printf("Prepare log error: %v\r\n", err)
+			p.executor.keystorage.Release(reservation)
+			return &command.RpcTxResponse{HttpStatus: http.StatusInternalServerError, Status: "error", Code: "119"}
+		}
+		for _, key := range keys {
+			p.locks[key] = req.TxID
+		}
+		p.prepared[req.TxID] = &preparedTx{req: req, keys: keys, reservation: reservation, deadline: time.Now().Add(p.timeout)}
+	}
+	return &command.RpcTxResponse{HttpStatus: http.StatusOK, Status: "done", Code: "0"}
+}
+
+// Apply the mutations of a prepared transaction and release its keys. The commit of a transaction committed recently
+// is acknowledged again, the commit of a transaction that is not prepared has error code 120.
+// If the mutations can't be applied the transaction stays prepared, with its keys locked, until a later commit applies them.
+func (p *TxParticipant) Commit(id string) *command.RpcTxResponse {
+	p.mux.Lock()
+	tx, ok := p.prepared[id]
+	if !ok {
+		_, committed := p.committed[id]
+		p.mux.Unlock()
+		if committed {
+			return &command.RpcTxResponse{HttpStatus: http.StatusOK, Status: "done", Code: "0"}
+		}
+		log.Printf("Commit of unknown transaction %s\r\n", id)
+		return &command.RpcTxResponse{HttpStatus: http.StatusNotFound, Status: "error", Code: "120"}
+	}
+	results, res := p.executor.storeTx(nil, tx.req.Mutations, tx.reservation)
+	if res != nil {
+		// the failed apply has released the reservation, the memory is reserved again for the next commit
+		tx.reservation, _ = p.executor.keystorage.Reserve(tx.keys, tx.req.Mutations)
+		tx.deadline = time.Now().Add(p.timeout)
+		p.mux.Unlock()
+		log.Printf("Commit of transaction %s failed with error code %s\r\n", id, res.Code)
+		return res
+	}
+	p.committed[id] = time.Now()
+	p.release(tx)
+	p.mux.Unlock()
+	return p.executor.replicateTx(tx.req, results)
+}
+
+// Discard a prepared transaction and release its keys.
+func (p *TxParticipant) Abort(id string) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if tx, ok := p.prepared[id]; ok {
+		p.executor.keystorage.Release(tx.reservation)
+		p.release(tx)
+	}
+}
+
+// Remove a prepared transaction and its key locks, the end of the transaction is written in the prepare log.
+// It must be called holding the lock.
+func (p *TxParticipant) release(tx *preparedTx) {
+	for _, key := range tx.keys {
+		if p.locks[key] == tx.req.TxID {
+			delete(p.locks, key)
+		}
+	}
+	delete(p.prepared, tx.req.TxID)
+	var err error
+	if len(p.prepared) == 0 {
+		err = p.compact()
+	} else {
+		err = p.log.append(&txPrepare{ID: tx.req.TxID, Done: true}, false)
+	}
+	if err != nil {
+		log.Printf("Prepare log error: %v\r\n", err)
+	}
+}
+
+// Resolve periodically the transactions whose lock has timed out and forget the old commits.
+func (p *TxParticipant) resolver() {
+	tickChan := time.NewTicker(p.timeout / 2).C
+	for range tickChan {
+		p.resolve()
+		p.mux.Lock()
+		for id, date := range p.committed {
+			if time.Since(date) > 10*p.timeout {
+				delete(p.committed, id)
+			}
+		}
+		p.mux.Unlock()
+	}
+}
+
+// Ask the outcome of the in-doubt transactions to their coordinators. The transactions stay prepared
+// while the coordinator does not answer or has not decided yet.
+func (p *TxParticipant) resolve() {
+	now := time.Now()
+	expired := make([]*preparedTx, 0)
+	p.mux.RLock()
+	for _, tx := range p.prepared {
+		if now.After(tx.deadline) {
+			expired = append(expired, tx)
+		}
+	}
+	p.mux.RUnlock()
+	for _, tx := range expired {
+		switch p.outcome(tx.req) {
+		case command.TxCommitted:
+			log.Printf("In-doubt transaction %s committed\r\n", tx.req.TxID)
+			p.Commit(tx.req.TxID)
+		case command.TxAborted:
+			log.Printf("In-doubt transaction %s aborted\r\n", tx.req.TxID)
+			p.Abort(tx.req.TxID)
+		default:
+			p.mux.Lock()
+			tx.deadline = time.Now().Add(p.timeout)
+			p.mux.Unlock()
+		}
+	}
+}
+
+// Get the outcome of a transaction from its coordinator, it is pending if the coordinator does not answer.
+func (p *TxParticipant) outcome(req *command.RpcTxRequest) string {
+	ex := p.executor
+	if req.Coordinator == ex.config.ServerNode.Node.Name {
+		if ex.coordinator == nil {
+			return command.TxPending
+		}
+		return ex.coordinator.Status(req.TxID)
+	}
+	node, _ := ex.config.Topology.GetNodeByName(req.Coordinator)
+	if node == nil {
+		return command.TxPending
+	}
+	status, err := ex.outcmdproc.Caller.TxStatus(req.TxID, node.Node)
+	if err != nil {
+		return command.TxPending
+	}
+	return status
+}
+
+// The part of a distributed transaction on the keys of a node, indexes are the positions of its mutations in the transaction.
+type txPart struct {
+	node    *cluster.ClusterTopologyNode
+	req     *command.RpcTxRequest
+	indexes []int
+}
+
+// A commit decision, it is written in the decision log before the commit is sent to the participants.
+type txDecision struct {
+	ID           string
+	Participants []string
+	Done         bool // all the participants have committed
+}
+
+// The coordinator of the distributed transactions received by the node runs the two-phase commit on the participants.
+// Only the commit decisions are logged: a transaction that is not in the log and is not running has been aborted.
+type TxCoordinator struct {
+	executor  *Executor
+	active    map[string]bool        // the transactions not yet decided
+	committed map[string]*txDecision // the committed transactions not yet acknowledged by all the participants
+	log       *txLog                 // the decision log
+	seq       uint64
+	mux       *sync.Mutex
+}
+
+// Create the coordinator, the pending commits of the decision log are sent again.
+func NewTxCoordinator(ex *Executor) (*TxCoordinator, error) {
+	tc := &TxCoordinator{executor: ex, active: make(map[string]bool), committed: make(map[string]*txDecision), mux: new(sync.Mutex)}
+	if err := tc.openLog(ex.config.TxLog()); err != nil {
+		return nil, err
+	}
+	go tc.recovery()
+	return tc, nil
+}
+
+// Load the pending commits of the decision log and rewrite the log with them.
+func (tc *TxCoordinator) openLog(path string) error {
+	decisionLog, err := openTxLog(path, func(data []byte) {
+		decision := new(txDecision)
+		if json.Unmarshal(data, decision) != nil {
+			return
+		}
+		if decision.Done {
+			delete(tc.committed, decision.ID)
+		} else {
+			tc.committed[decision.ID] = decision
+		}
+	})
+	if err != nil {
+		return err
+	}
+	tc.log = decisionLog
+	if err = tc.compact(); err != nil {
+		decisionLog.close()
+		tc.log = nil
+		return err
+	}
+	if len(tc.committed) > 0 {
+		log.Printf("Transaction log contains %d pending commits\r\n", len(tc.committed))
+	}
+	return nil
+}
+
+// Rewrite the decision log with the pending commits. It must be called holding the lock.
+func (tc *TxCoordinator) compact() error {
+	records := make([]interface{}, 0, len(tc.committed))
+	for _, decision := range tc.committed {
+		records = append(records, decision)
+	}
+	return tc.log.rewrite(records)
+}
+
+// Get the state of a transaction coordinated by the node.
+func (tc *TxCoordinator) Status(id string) string {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if tc.active[id] {
+		return command.TxPending
+	}
+	if _, ok := tc.committed[id]; ok {
+		return command.TxCommitted
+	}
+	return command.TxAborted
+}
+
+// Run the transaction on the participants: the parts are prepared, then they are committed if all the participants
+// agree or aborted otherwise. A commit that can't be sent or applied is sent again in background until the participant applies it.
+func (tc *TxCoordinator) Execute(parts []*txPart, mutations int) *command.RpcTxResponse {
+	name := tc.executor.config.ServerNode.Node.Name
+	id := name + "-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&tc.seq, 1), 36)
+	participants := make([]string, len(parts))
+	for i, part := range parts {
+		part.req.Source = name
+		part.req.TxID = id
+		part.req.Coordinator = name
+		participants[i] = part.node.Node.Name
+	}
+	tc.mux.Lock()
+	tc.active[id] = true
+	tc.mux.Unlock()
+	// phase one: every participant votes
+	votes := tc.each(parts, func(part *txPart) *command.RpcTxResponse {
+		if part.node.Node.Name == name {
+			return tc.executor.participant.Prepare(part.req)
+		}
+		res, err := tc.executor.outcmdproc.Caller.PrepareTx(part.req, part.node.Node)
+		if err != nil {
+			return &command.RpcTxResponse{HttpStatus: http.StatusBadGateway, Status: "error", Code: "108"}
+		}
+		return res
+	})
+	var refused *command.RpcTxResponse
+	for _, vote := range votes {
+		if vote.Code != "0" {
+			refused = vote
+			break
+		}
+	}
+	decision := &txDecision{ID: id, Participants: participants}
+	tc.mux.Lock()
+	var err error
+	if refused == nil {
+		if err = tc.log.append(decision, true); err == nil {
+			tc.committed[id] = decision
+		} else {
+			log.Printf("Transaction log error: %v\r\n", err)
+		}
+	}
+	delete(tc.active, id)
+	tc.mux.Unlock()
+	if refused != nil || err != nil {
+		// the keys are released before the response, the participants that miss the abort get the outcome when their locks time out
+		tc.each(parts, func(part *txPart) *command.RpcTxResponse {
+			tc.abortOn(id, part.node)
+			return nil
+		})
+		if refused != nil {
+			return &command.RpcTxResponse{HttpStatus: refused.HttpStatus, Status: "error", Code: refused.Code}
+		}
+		return &command.RpcTxResponse{HttpStatus: http.StatusInternalServerError, Status: "error", Code: "119"}
+	}
+	// phase two: the decision is sent to the participants
+	acks := tc.each(parts, func(part *txPart) *command.RpcTxResponse {
+		return tc.commitOn(id, part.node)
+	})
+	res := &command.RpcTxResponse{HttpStatus: http.StatusOK, Status: "done", Code: "0", Results: make([]*storage.MetaDataUpdObj, mutations)}
+	delivered := true
+	for i, part := range parts {
+		ack := acks[i]
+		if !applied(ack) {
+			delivered = false
+		}
+		if ack.Code != "0" && ack.Code != "108" && res.Code == "0" {
+			res.HttpStatus, res.Status, res.Code = ack.HttpStatus, ack.Status, ack.Code
+		}
+		for j, index := range part.indexes {
+			if j < len(ack.Results) {
+				res.Results[index] = ack.Results[j]
+			} else {
+				res.Results[index] = &storage.MetaDataUpdObj{Key: part.req.Mutations[j].Obj.Key}
+			}
+		}
+	}
+	if delivered {
+		tc.done(id)
+	}
+	return res
+}
+
+// Call a phase of the transaction on all the parts in parallel, the responses are in the order of the parts.
+func (tc *TxCoordinator) each(parts []*txPart, phase func(part *txPart) *command.RpcTxResponse) []*command.RpcTxResponse {
+	responses := make([]*command.RpcTxResponse, len(parts))
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part *txPart) {
+			defer wg.Done()
+			responses[i] = phase(part)
+		}(i, part)
+	}
+	wg.Wait()
+	return responses
+}
+
+// Check if a participant has applied the commit. The commit is sent again if the participant does not answer (108)
+// or can't apply the mutations yet; a participant that does not know the transaction (120) has already ended it.
+func applied(ack *command.RpcTxResponse) bool {
+	return ack.Code == "0" || ack.Code == "120"
+}
+
+// Send the commit to a participant, the response has error code 108 if the participant does not answer.
+func (tc *TxCoordinator) commitOn(id string, node *cluster.ClusterTopologyNode) *command.RpcTxResponse {
+	if node == nil {
+		return &command.RpcTxResponse{HttpStatus: http.StatusBadGateway, Status: "error", Code: "108"}
+	}
+	if node.Node.Name == tc.executor.config.ServerNode.Node.Name {
+		return tc.executor.participant.Commit(id)
+	}
+	res, err := tc.executor.outcmdproc.Caller.CommitTx(id, node.Node)
+	if err != nil {
+		return &command.RpcTxResponse{HttpStatus: http.StatusBadGateway, Status: "error", Code: "108"}
+	}
+	return res
+}
+
+// Send the abort to a participant.
+func (tc *TxCoordinator) abortOn(id string, node *cluster.ClusterTopologyNode) {
+	if node.Node.Name == tc.executor.config.ServerNode.Node.Name {
+		tc.executor.participant.Abort(id)
+	} else {
+		tc.executor.outcmdproc.Caller.AbortTx(id, node.Node)
+	}
+}
+
+// Forget a transaction committed by all the participants.
+func (tc *TxCoordinator) done(id string) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	decision, ok := tc.committed[id]
+	if !ok {
+		return
+	}
+	delete(tc.committed, id)
+	if len(tc.committed) == 0 {
+		tc.compact()
+	} else {
+		tc.log.append(&txDecision{ID: decision.ID, Done: true}, false)
+	}
+}
+
+// Send again periodically the commits not acknowledged by all the participants.
+func (tc *TxCoordinator) recovery() {
+	tickChan := time.NewTicker(tc.executor.participant.timeout).C
+	for range tickChan {
+		tc.mux.Lock()
+		pending := make([]*txDecision, 0, len(tc.committed))
+		for _, decision := range tc.committed {
+			pending = append(pending, decision)
+		}
+		tc.mux.Unlock()
+		for _, decision := range pending {
+			delivered := true
+			for _, name := range decision.Participants {
+				node, _ := tc.executor.config.Topology.GetNodeByName(name)
+				if !applied(tc.commitOn(decision.ID, node)) {
+					delivered = false
+				}
+			}
+			if delivered {
+				log.Printf("Transaction %s committed on all the participants\r\n", decision.ID)
+				tc.done(decision.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxzerbini/ovo/cluster"
+	"github.com/maxzerbini/ovo/command"
+	"github.com/maxzerbini/ovo/inmemory"
+	"github.com/maxzerbini/ovo/server/model"
+	"github.com/maxzerbini/ovo/storage"
+)
+
+// Start two nodes that own the keys with the hashtags {local} and {remote}.
+func startTxNodes(t *testing.T) (*Server, *inmemory.InMemoryStorage, *Server, *inmemory.InMemoryStorage) {
+	if cluster.HashKey("local") == cluster.HashKey("remote") {
+		t.Skip("the hashtags have the same slot")
+	}
+	topology := &cluster.ClusterTopology{}
+	remote, ksRemote := startTestServer(t, "remote", []int{cluster.HashKey("remote")}, topology)
+	local, ksLocal := startTestServer(t, "local", []int{cluster.HashKey("local")}, topology)
+	remote.config.Topology = *topology
+	return local, ksLocal, remote, ksRemote
+}
+
+// Send a transaction to the node and return the HTTP status and the error code.
+func sendTx(t *testing.T, srv *Server, tx *model.OvoTxRequest) (int, string) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/transaction", srv.transaction)
+	body, _ := json.Marshal(tx)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/transaction", bytes.NewReader(body)))
+	var res struct{ Code string }
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, res.Code
+}
+
+// Check that the participant has no prepared transactions and no locked keys.
+func checkReleased(t *testing.T, p *TxParticipant) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	if len(p.prepared) != 0 || len(p.locks) != 0 {
+		t.Fatalf("%d transactions prepared and %d keys locked", len(p.prepared), len(p.locks))
+	}
+}
+
+// Create a prepared transaction request that puts a key, coordinated by the node.
+func preparedPut(id string, coordinator string, key string) *command.RpcTxRequest {
+	return &command.RpcTxRequest{TxID: id, Coordinator: coordinator, Mutations: []storage.TxMutation{
+		{Op: storage.TxPut, Obj: &storage.MetaDataUpdObj{Key: key, Hash: cluster.HashKey(key), Data: []byte("v")}},
+	}}
+}
+
+func TestTxCommitOnTwoNodes(t *testing.T) {
+	local, ksLocal, remote, ksRemote := startTxNodes(t)
+	tx := &model.OvoTxRequest{Mutations: []model.OvoTxMutation{
+		{Op: storage.TxPut, Key: "{local}1", Data: []byte("l")},
+		{Op: storage.TxPut, Key: "{remote}1", Data: []byte("r")},
+	}}
+	if status, code := sendTx(t, local, tx); status != http.StatusOK || code != "0" {
+		t.Fatalf("transaction status %d code %s", status, code)
+	}
+	if _, err := ksLocal.Get("{local}1"); err != nil {
+		t.Fatal("local mutation not applied")
+	}
+	if _, err := ksRemote.Get("{remote}1"); err != nil {
+		t.Fatal("remote mutation not applied")
+	}
+	checkReleased(t, local.executor.participant)
+	checkReleased(t, remote.executor.participant)
+	if res := local.executor.participant.Commit("unknown"); res.Code != "120" {
+		t.Fatalf("commit of an unknown transaction has code %s", res.Code)
+	}
+}
+
+func TestTxAbortOnNoVote(t *testing.T) {
+	local, ksLocal, remote, ksRemote := startTxNodes(t)
+	ksRemote.Put(&storage.MetaDataObj{Key: "{remote}1", Data: []byte("v")})
+	// the remote node votes no because the version does not match
+	tx := &model.OvoTxRequest{
+		Checks: []model.OvoTxCheck{{Op: storage.TxCheckVersion, Key: "{remote}1", Version: 5}},
+		Mutations: []model.OvoTxMutation{
+			{Op: storage.TxPut, Key: "{local}1", Data: []byte("l")},
+			{Op: storage.TxPut, Key: "{remote}2", Data: []byte("r")},
+		},
+	}
+	if status, code := sendTx(t, local, tx); status != http.StatusConflict || code != "117" {
+		t.Fatalf("transaction status %d code %s", status, code)
+	}
+	if _, err := ksLocal.Get("{local}1"); err == nil {
+		t.Fatal("mutation of an aborted transaction applied")
+	}
+	if _, err := ksRemote.Get("{remote}2"); err == nil {
+		t.Fatal("mutation of an aborted transaction applied")
+	}
+	// the keys of the aborted transaction can be written
+	checkReleased(t, local.executor.participant)
+	checkReleased(t, remote.executor.participant)
+	put := &command.RpcRequest{OpCode: "put", Obj: &storage.MetaDataUpdObj{Key: "{local}1", Data: []byte("w")}}
+	if res := local.executor.Execute(put); res.Code != "0" {
+		t.Fatalf("write on a released key has code %s", res.Code)
+	}
+	// the local node votes no because the mutation does not fit in memory
+	ksLocal.SetMemoryLimit(ksLocal.UsedMemory()+100, inmemory.NoEviction)
+	tx = &model.OvoTxRequest{Mutations: []model.OvoTxMutation{
+		{Op: storage.TxPut, Key: "{local}2", Data: make([]byte, 1000)},
+		{Op: storage.TxPut, Key: "{remote}3", Data: []byte("r")},
+	}}
+	if status, code := sendTx(t, local, tx); status != http.StatusInsufficientStorage || code != "107" {
+		t.Fatalf("transaction status %d code %s", status, code)
+	}
+	if _, err := ksRemote.Get("{remote}3"); err == nil {
+		t.Fatal("mutation of an aborted transaction applied")
+	}
+	checkReleased(t, local.executor.participant)
+	checkReleased(t, remote.executor.participant)
+}
+
+func TestTxLockedKeys(t *testing.T) {
+	local, ksLocal, _, _ := startTxNodes(t)
+	ksLocal.Put(&storage.MetaDataObj{Key: "{local}2", Collection: "accounts", Data: []byte("v")})
+	p := local.executor.participant
+	req := preparedPut("tx1", "nobody", "{local}1")
+	req.Checks = []storage.TxCheck{{Op: storage.TxCheckExists, Key: "{local}2", Hash: cluster.HashKey("{local}2")}}
+	if res := p.Prepare(req); res.Code != "0" {
+		t.Fatalf("prepare has code %s", res.Code)
+	}
+	put := &command.RpcRequest{OpCode: "put", Obj: &storage.MetaDataUpdObj{Key: "{local}1", Data: []byte("w")}}
+	if res := local.executor.Execute(put); res.Code != "118" {
+		t.Fatalf("write on a locked key has code %s", res.Code)
+	}
+	if ksLocal.PutIfOutdated(&storage.MetaDataObj{Key: "{local}2", Data: []byte("repair"), Version: 10}) == nil {
+		t.Fatal("read repair changed a locked key")
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.DELETE("/collections/:name", local.dropCollection)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/collections/accounts", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("drop of a collection with locked keys has status %d", w.Code)
+	}
+	if _, err := ksLocal.Get("{local}2"); err != nil {
+		t.Fatal("locked key dropped")
+	}
+	p.Abort("tx1")
+	checkReleased(t, p)
+	if res := local.executor.Execute(put); res.Code != "0" {
+		t.Fatalf("write on a released key has code %s", res.Code)
+	}
+}
+
+func TestTxFailedCommit(t *testing.T) {
+	_, _, remote, ksRemote := startTxNodes(t)
+	p := remote.executor.participant
+	req := preparedPut("tx1", "local", "{remote}1")
+	if res := p.Prepare(req); res.Code != "0" {
+		t.Fatalf("prepare has code %s", res.Code)
+	}
+	// the mutations of the prepared transaction can't be applied
+	req.Mutations[0].Op = "unsupported"
+	if res := p.Commit("tx1"); res.Code == "0" || applied(res) {
+		t.Fatalf("failed commit has code %s", res.Code)
+	}
+	p.mux.RLock()
+	_, prepared := p.prepared["tx1"]
+	locked := p.locked("{remote}1")
+	p.mux.RUnlock()
+	if !prepared || !locked {
+		t.Fatal("transaction released after a failed commit")
+	}
+	// the commit sent again applies the mutations
+	req.Mutations[0].Op = storage.TxPut
+	if res := p.Commit("tx1"); res.Code != "0" {
+		t.Fatalf("commit sent again has code %s", res.Code)
+	}
+	if _, err := ksRemote.Get("{remote}1"); err != nil {
+		t.Fatal("mutation not applied")
+	}
+	checkReleased(t, p)
+}
+
+func TestTxInDoubtResolution(t *testing.T) {
+	local, _, remote, ksRemote := startTxNodes(t)
+	p := remote.executor.participant
+	// the coordinator has decided to commit the first transaction and does not know the second one
+	tc := local.executor.coordinator
+	tc.mux.Lock()
+	tc.committed["tx1"] = &txDecision{ID: "tx1", Participants: []string{"remote"}}
+	tc.mux.Unlock()
+	if res := p.Prepare(preparedPut("tx1", "local", "{remote}1")); res.Code != "0" {
+		t.Fatalf("prepare has code %s", res.Code)
+	}
+	if res := p.Prepare(preparedPut("tx2", "local", "{remote}2")); res.Code != "0" {
+		t.Fatalf("prepare has code %s", res.Code)
+	}
+	// the locks time out and the outcome is asked to the coordinator
+	p.mux.Lock()
+	for _, tx := range p.prepared {
+		tx.deadline = time.Now().Add(-time.Second)
+	}
+	p.mux.Unlock()
+	p.resolve()
+	if _, err := ksRemote.Get("{remote}1"); err != nil {
+		t.Fatal("committed in-doubt transaction not applied")
+	}
+	if _, err := ksRemote.Get("{remote}2"); err == nil {
+		t.Fatal("aborted in-doubt transaction applied")
+	}
+	checkReleased(t, p)
+	// the commit sent again by the coordinator is acknowledged
+	if res := p.Commit("tx1"); res.Code != "0" {
+		t.Fatalf("repeated commit has code %s", res.Code)
+	}
+}
+
+func TestTxLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	node := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "node", HashRange: []int{cluster.HashKey("{node}1")}, State: cluster.Active}}
+	conf := &ServerConf{ServerNode: node, TxLogDir: dir}
+	srv := NewServer(conf, inmemory.NewInMemoryStorage())
+	if res := srv.executor.participant.Prepare(preparedPut("tx1", "node", "{node}1")); res.Code != "0" {
+		t.Fatalf("prepare has code %s", res.Code)
+	}
+	tc := srv.executor.coordinator
+	tc.mux.Lock()
+	decision := &txDecision{ID: "tx1", Participants: []string{"node"}}
+	if err := tc.log.append(decision, true); err != nil {
+		t.Fatal(err)
+	}
+	tc.committed["tx1"] = decision
+	tc.mux.Unlock()
+
+	// the node restarts before the commit
+	ks := inmemory.NewInMemoryStorage()
+	restarted := NewServer(conf, ks)
+	p := restarted.executor.participant
+	p.mux.RLock()
+	_, prepared := p.prepared["tx1"]
+	locked := p.locked("{node}1")
+	p.mux.RUnlock()
+	if !prepared || !locked {
+		t.Fatal("prepared transaction not restored")
+	}
+	if status := restarted.executor.coordinator.Status("tx1"); status != command.TxCommitted {
+		t.Fatalf("restored decision has status %s", status)
+	}
+	p.resolve()
+	if _, err := ks.Get("{node}1"); err != nil {
+		t.Fatal("restored transaction not committed")
+	}
+	checkReleased(t, p)
+}
+
+func TestTxDisabled(t *testing.T) {
+	dir := t.TempDir()
+	node := &cluster.ClusterTopologyNode{Node: &cluster.OvoNode{Name: "node", HashRange: []int{cluster.HashKey("{node}1")}, State: cluster.Active}}
+	srv := NewServer(&ServerConf{ServerNode: node}, inmemory.NewInMemoryStorage())
+	if srv.executor.coordinator != nil {
+		t.Fatal("coordinator started without the log directory")
+	}
+	if _, err := os.Stat("node" + TxLogExt); err == nil {
+		t.Fatal("transaction log created in the working directory")
+	}
+	if res := srv.executor.participant.Prepare(preparedPut("tx1", "other", "{node}1")); res.Code != "121" {
+		t.Fatalf("prepare without the log has code %s", res.Code)
+	}
+	// the logs are named after the node in the log directory
+	NewServer(&ServerConf{ServerNode: node, TxLogDir: dir}, inmemory.NewInMemoryStorage())
+	for _, name := range []string{"node" + TxLogExt, "node" + TxLogExt + ".prepared"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("log %s not created", name)
+		}
+	}
+	// the transactions on different nodes are refused
+	local, _, _, _ := startTxNodes(t)
+	local.executor.coordinator = nil
+	tx := &model.OvoTxRequest{Mutations: []model.OvoTxMutation{
+		{Op: storage.TxPut, Key: "{local}1", Data: []byte("l")},
+		{Op: storage.TxPut, Key: "{remote}1", Data: []byte("r")},
+	}}
+	if status, code := sendTx(t, local, tx); status != http.StatusNotImplemented || code != "121" {
+		t.Fatalf("transaction status %d code %s", status, code)
+	}
+}
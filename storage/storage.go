@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"time"
 )
 
@@ -11,6 +12,8 @@ type MetaDataObj struct {
 	CreationDate time.Time
 	TTL          int
 	Hash         int
+	Timestamp    int64
+	Version      uint64
 }
 
 type MetaDataUpdObj struct {
@@ -24,6 +27,8 @@ type MetaDataUpdObj struct {
 	Hash         int
 	NewHash      int
 	Value        int64
+	Timestamp    int64
+	Version      uint64
 }
 
 type MetaDataCounter struct {
@@ -39,7 +44,16 @@ func NewMetaDataObj(key string, data []byte, collection string, ttl int, hash in
 }
 
 func (obj *MetaDataObj) MetaDataUpdObj() *MetaDataUpdObj {
-	return &MetaDataUpdObj{Key: obj.Key, Data: obj.Data, Collection: obj.Collection, CreationDate: obj.CreationDate, TTL: obj.TTL, Hash: obj.Hash, NewKey: "", NewData: make([]byte, 0)}
+	return &MetaDataUpdObj{Key: obj.Key, Data: obj.Data, Collection: obj.Collection, CreationDate: obj.CreationDate, TTL: obj.TTL, Hash: obj.Hash, NewKey: "", NewData: make([]byte, 0), Timestamp: obj.Timestamp, Version: obj.Version}
+}
+
+// Check if a replicated copy of the object must replace this object: the copy has a greater version,
+// or the same version and it was written later. The order is total, so two copies are never outdated by each other.
+func (obj *MetaDataObj) IsOutdatedBy(other *MetaDataObj) bool {
+	if other.Version != obj.Version {
+		return other.Version > obj.Version
+	}
+	return other.Timestamp > obj.Timestamp
 }
 
 func (obj MetaDataObj) IsExpired() bool {
@@ -50,7 +64,7 @@ func (obj MetaDataObj) IsExpired() bool {
 }
 
 func (obj *MetaDataUpdObj) MetaDataObj() *MetaDataObj {
-	item := &MetaDataObj{Key: obj.Key, Data: obj.Data, Collection: obj.Collection, TTL: obj.TTL, Hash: obj.Hash}
+	item := &MetaDataObj{Key: obj.Key, Data: obj.Data, Collection: obj.Collection, TTL: obj.TTL, Hash: obj.Hash, Timestamp: obj.Timestamp, Version: obj.Version}
 	return item
 }
 
@@ -70,9 +84,56 @@ func (obj *MetaDataCounter) IsExpired() bool {
 	return time.Now().After(obj.CreationDate.Add(time.Duration(obj.TTL) * time.Second))
 }
 
+// The collection of the objects stored without collection.
+const DefaultCollection = "default"
+
+// The number of objects and the accounted memory of a collection.
+type CollectionStats struct {
+	Name      string
+	Count     int
+	UsedBytes int64
+}
+
+// The conditions checked by a transaction before applying its mutations.
+const (
+	TxCheckExists  = "exists"  // the key exists
+	TxCheckVersion = "version" // the object has the version Version
+	TxCheckValue   = "value"   // the object has the value Data
+)
+
+// The mutations applied by a transaction.
+const (
+	TxPut       = "put"
+	TxDelete    = "delete"
+	TxIncrement = "increment" // increment the counter Key by Value
+)
+
+// A condition on an object checked by a transaction.
+type TxCheck struct {
+	Op      string
+	Key     string
+	Hash    int
+	Version uint64
+	Data    []byte
+}
+
+// A mutation applied by a transaction.
+type TxMutation struct {
+	Op  string
+	Obj *MetaDataUpdObj
+}
+
+// The memory reserved for the mutations of a prepared transaction and the keys protected until the transaction ends.
+type TxReservation struct {
+	Keys []string
+	Size int64
+}
+
 type OvoStorage interface {
 	Get(key string) (obj *MetaDataObj, err error)
 	Put(obj *MetaDataObj) error
+	PutIfOutdated(obj *MetaDataObj) error
+	DeleteIfOutdated(obj *MetaDataObj) error
 	Delete(key string)
 	GetAndRemove(key string) (obj *MetaDataObj, err error)
 	UpdateValueIfEqual(obj *MetaDataUpdObj) error
@@ -84,8 +145,38 @@ type OvoStorage interface {
 	Keys() []string
 	Increment(c *MetaDataCounter) *MetaDataCounter
 	SetCounter(c *MetaDataCounter) *MetaDataCounter
+	SetCounterIfAbsent(c *MetaDataCounter) error
 	GetCounter(key string) (obj *MetaDataCounter, err error)
 	DeleteCounter(key string)
 	ListCounters() []*MetaDataCounter
 	DeleteValueIfEqual(obj *MetaDataObj) error
+	UpdateValueIfVersion(obj *MetaDataUpdObj) error
+	DeleteValueIfVersion(key string, version uint64) error
+	Collections(slots []int) []CollectionStats
+	CollectionKeys(name string, slots []int) []string
+	DropCollection(name string) int
+	Scan(cursor uint64, count int, match string) (next uint64, objs []*MetaDataObj)
+	Range(start string, end string, after string, limit int, reverse bool) (objs []*MetaDataObj, next string, err error)
+	Transaction(checks []TxCheck, mutations []TxMutation, reservation *TxReservation) (results []*MetaDataUpdObj, err error)
+	Reserve(keys []string, mutations []TxMutation) (reservation *TxReservation, err error)
+	Release(reservation *TxReservation)
+}
+
+// OvoSnapshotter is implemented by the storages that can write point-in-time snapshots.
+type OvoSnapshotter interface {
+	Snapshot() error
 }
+
+// OvoEvictionNotifier is implemented by the storages that evict items when a memory limit is reached.
+type OvoEvictionNotifier interface {
+	SetEvictionListener(listener func(evicted []*MetaDataObj))
+}
+
+// The error returned when the storage has reached its memory limit.
+var ErrOutOfMemory = errors.New("Memory limit reached.")
+
+// The error returned by a transaction whose conditions are not satisfied.
+var ErrTxCheckFailed = errors.New("Transaction check failed.")
+
+// The error returned by the range queries when the ordered index is not enabled.
+var ErrNoOrderedIndex = errors.New("Ordered index not enabled.")
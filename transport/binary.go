@@ -0,0 +1,278 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The binary protocol sends length prefixed frames: a fixed header with the kind, the sequence number,
+// the method and the error, followed by the gob encoded body.
+// The calls are multiplexed on the connections by sequence number.
+const (
+	ProtocolVersion byte = 1
+	frameRequest    byte = 0
+	frameResponse   byte = 1
+	maxFrameSize         = 256 * 1024 * 1024
+)
+
+var (
+	magic          = []byte("OVOB")
+	errUnsupported = errors.New("Binary protocol not supported.")
+	errFrameSize   = errors.New("Frame too large.")
+)
+
+type frameHeader struct {
+	kind   byte
+	seq    uint64
+	method string
+	err    string
+}
+
+// The framed connection shared by the client and the server codecs.
+type frameConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	body   []byte
+	wmux   *sync.Mutex
+}
+
+func newFrameConn(conn net.Conn, reader *bufio.Reader) *frameConn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &frameConn{conn: conn, reader: reader, wmux: new(sync.Mutex)}
+}
+
+func (fc *frameConn) writeFrame(header *frameHeader, body interface{}) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	buf.WriteByte(header.kind)
+	binary.Write(&buf, binary.BigEndian, header.seq)
+	writeString(&buf, header.method)
+	writeString(&buf, header.err)
+	if body != nil {
+		if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	frame := buf.Bytes()
+	if len(frame)-4 > maxFrameSize {
+		return errFrameSize
+	}
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	fc.wmux.Lock()
+	defer fc.wmux.Unlock()
+	_, err := fc.conn.Write(frame)
+	return err
+}
+
+func (fc *frameConn) readFrame(header *frameHeader) error {
+	var size uint32
+	if err := binary.Read(fc.reader, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxFrameSize {
+		return errFrameSize
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(fc.reader, frame); err != nil {
+		return err
+	}
+	buf := bytes.NewReader(frame)
+	var err error
+	if header.kind, err = buf.ReadByte(); err != nil {
+		return err
+	}
+	if err = binary.Read(buf, binary.BigEndian, &header.seq); err != nil {
+		return err
+	}
+	if header.method, err = readString(buf); err != nil {
+		return err
+	}
+	if header.err, err = readString(buf); err != nil {
+		return err
+	}
+	fc.body = frame[len(frame)-buf.Len():]
+	return nil
+}
+
+func (fc *frameConn) readBody(body interface{}) error {
+	data := fc.body
+	fc.body = nil
+	if body == nil || len(data) == 0 {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(body)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(buf *bytes.Reader) (string, error) {
+	var size uint16
+	if err := binary.Read(buf, binary.BigEndian, &size); err != nil {
+		return "", err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(buf, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// The client side of the binary protocol for net/rpc.
+type clientCodec struct {
+	*frameConn
+}
+
+func (c *clientCodec) WriteRequest(req *rpc.Request, body interface{}) error {
+	return c.writeFrame(&frameHeader{kind: frameRequest, seq: req.Seq, method: req.ServiceMethod}, body)
+}
+
+func (c *clientCodec) ReadResponseHeader(res *rpc.Response) error {
+	var header frameHeader
+	if err := c.readFrame(&header); err != nil {
+		return err
+	}
+	res.Seq = header.seq
+	res.ServiceMethod = header.method
+	res.Error = header.err
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *clientCodec) Close() error {
+	return c.conn.Close()
+}
+
+// The server side of the binary protocol for net/rpc.
+type serverCodec struct {
+	*frameConn
+}
+
+func (c *serverCodec) ReadRequestHeader(req *rpc.Request) error {
+	var header frameHeader
+	if err := c.readFrame(&header); err != nil {
+		return err
+	}
+	req.Seq = header.seq
+	req.ServiceMethod = header.method
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *serverCodec) WriteResponse(res *rpc.Response, body interface{}) error {
+	if res.Error != "" {
+		// the body of a failed call is not sent
+		body = nil
+	}
+	return c.writeFrame(&frameHeader{kind: frameResponse, seq: res.Seq, method: res.ServiceMethod, err: res.Error}, body)
+}
+
+func (c *serverCodec) Close() error {
+	return c.conn.Close()
+}
+
+// The binary transport keeps a pool of connections, every connection multiplexes the concurrent calls.
+type binaryTransport struct {
+	clients []*rpc.Client
+	next    uint32
+}
+
+// Connect the inner server at address with the binary protocol.
+func dialBinary(address string, poolSize int, timeout time.Duration, tlsConfig *tls.Config) (Transport, error) {
+	if poolSize <= 0 {
+		poolSize = DefaultPoolSize
+	}
+	tr := &binaryTransport{clients: make([]*rpc.Client, 0, poolSize)}
+	for i := 0; i < poolSize; i++ {
+		client, err := dialBinaryConn(address, timeout, tlsConfig)
+		if err != nil {
+			tr.Close()
+			return nil, err
+		}
+		tr.clients = append(tr.clients, client)
+	}
+	return tr, nil
+}
+
+// Open a connection and negotiate the protocol version: the client sends the magic and its version,
+// the server answers with the magic and the version that will be used.
+func dialBinaryConn(address string, timeout time.Duration, tlsConfig *tls.Config) (*rpc.Client, error) {
+	conn, err := dialConn(address, tlsConfig, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	// the new line makes a HTTP server answer immediately with an error
+	hello := append(append([]byte(nil), magic...), ProtocolVersion, '\n')
+	if _, err = conn.Write(hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	answer := make([]byte, len(magic)+1)
+	if _, err = io.ReadFull(reader, answer); err != nil || !bytes.Equal(answer[:len(magic)], magic) || answer[len(magic)] == 0 || answer[len(magic)] > ProtocolVersion {
+		conn.Close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, err
+		}
+		// a server of a previous version answers with a HTTP error or closes the connection
+		return nil, errUnsupported
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClientWithCodec(&clientCodec{newFrameConn(conn, reader)}), nil
+}
+
+func (tr *binaryTransport) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	client := tr.clients[atomic.AddUint32(&tr.next, 1)%uint32(len(tr.clients))]
+	return callTimeout(client, method, args, reply, timeout)
+}
+
+func (tr *binaryTransport) Close() error {
+	var err error
+	for _, client := range tr.clients {
+		if e := client.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Answer the handshake of a binary connection whose magic has already been read and serve the calls.
+func serveBinary(conn net.Conn, reader *bufio.Reader, server *rpc.Server) {
+	conn.SetDeadline(time.Now().Add(DefaultCallTimeout * time.Millisecond))
+	hello := make([]byte, 2)
+	if _, err := io.ReadFull(reader, hello); err != nil || hello[0] == 0 {
+		conn.Close()
+		return
+	}
+	version := hello[0]
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if _, err := conn.Write(append(append([]byte(nil), magic...), version)); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	server.ServeCodec(&serverCodec{newFrameConn(conn, reader)})
+}
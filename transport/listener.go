@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+var errListenerClosed = errors.New("Listener closed.")
+
+// A connection whose first bytes have already been read in the buffered reader.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (pc *peekedConn) Read(b []byte) (int, error) {
+	return pc.reader.Read(b)
+}
+
+// A listener fed with the connections accepted by another listener.
+type chanListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan bool
+	once  *sync.Once
+}
+
+func (cl *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-cl.conns:
+		return conn, nil
+	case <-cl.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (cl *chanListener) Close() error {
+	cl.once.Do(func() { close(cl.done) })
+	return nil
+}
+
+func (cl *chanListener) Addr() net.Addr {
+	return cl.addr
+}
+
+// Serve both protocols on the listener: the connections starting with the magic of the binary protocol
+// are served by the RPC server, the others are HTTP connections (the RPC protocol and the HTTP handlers).
+func Serve(listener net.Listener, server *rpc.Server, handler http.Handler) error {
+	httpListener := &chanListener{addr: listener.Addr(), conns: make(chan net.Conn), done: make(chan bool), once: new(sync.Once)}
+	defer httpListener.Close()
+	go http.Serve(httpListener, handler)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go dispatch(conn, server, httpListener)
+	}
+}
+
+func dispatch(conn net.Conn, server *rpc.Server, httpListener *chanListener) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(DefaultCallTimeout * time.Millisecond))
+	prefix, err := reader.Peek(len(magic))
+	conn.SetReadDeadline(time.Time{})
+	if err == nil && bytes.Equal(prefix, magic) {
+		reader.Discard(len(magic))
+		serveBinary(conn, reader, server)
+		return
+	}
+	if err != nil && len(prefix) == 0 {
+		log.Printf("Inner connection error from %s: %v\r\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	select {
+	case httpListener.conns <- &peekedConn{Conn: conn, reader: reader}:
+	case <-httpListener.done:
+		conn.Close()
+	}
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/rpc"
+	"time"
+)
+
+const rpcConnected = "200 Connected to Go RPC"
+
+// The RPC transport uses net/rpc with gob encoding over HTTP.
+type rpcTransport struct {
+	client *rpc.Client
+}
+
+// Connect the RPC server at address (the same handshake of rpc.DialHTTP with a timeout).
+func dialRPC(address string, timeout time.Duration, tlsConfig *tls.Config) (Transport, error) {
+	conn, err := dialConn(address, tlsConfig, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != rpcConnected {
+		err = errors.New("Unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &rpcTransport{client: rpc.NewClient(conn)}, nil
+}
+
+func (tr *rpcTransport) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	return callTimeout(tr.client, method, args, reply, timeout)
+}
+
+func (tr *rpcTransport) Close() error {
+	return tr.client.Close()
+}
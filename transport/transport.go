@@ -0,0 +1,66 @@
+// Package transport implements the connections between the inner servers of the cluster nodes.
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/rpc"
+	"time"
+)
+
+const (
+	ProtocolBinary     string = "binary"
+	ProtocolRPC        string = "rpc"
+	DefaultCallTimeout        = 5000 // millisecs
+	DefaultPoolSize           = 2
+)
+
+var ErrTimeout = errors.New("Call timeout.")
+
+// A connection to the inner server of a node.
+type Transport interface {
+	// Call a method of the inner server waiting the reply at most timeout.
+	Call(method string, args interface{}, reply interface{}, timeout time.Duration) error
+	// Close the connection.
+	Close() error
+}
+
+// Connect the inner server at address, over TLS if tlsConfig is not nil. The binary protocol falls back to the RPC protocol
+// if the server does not support it (e.g. a node of a previous version during a rolling upgrade).
+func Dial(address string, protocol string, poolSize int, timeout time.Duration, tlsConfig *tls.Config) (Transport, error) {
+	if protocol != ProtocolRPC {
+		tr, err := dialBinary(address, poolSize, timeout, tlsConfig)
+		if err == nil {
+			return tr, nil
+		}
+		if err != errUnsupported {
+			return nil, err
+		}
+		log.Printf("Node %s does not support the binary protocol, using RPC\r\n", address)
+	}
+	return dialRPC(address, timeout, tlsConfig)
+}
+
+// Call the method on the client waiting the reply at most timeout.
+func callTimeout(client *rpc.Client, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	if timeout <= 0 {
+		<-call.Done
+		return call.Error
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// Check if the error was returned by the remote method, so the connection is still usable.
+func IsRemoteError(err error) bool {
+	_, ok := err.(rpc.ServerError)
+	return ok
+}
@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The service called by the tests.
+type Echo struct{}
+
+func (e *Echo) Say(msg string, reply *string) error {
+	*reply = msg
+	return nil
+}
+
+func (e *Echo) Sleep(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	return nil
+}
+
+func (e *Echo) Fail(msg string, reply *int) error {
+	return errors.New(msg)
+}
+
+// Listen on a local port.
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// Start a server of both protocols.
+func startServer(t *testing.T) string {
+	listener := listen(t)
+	server := rpc.NewServer()
+	server.Register(new(Echo))
+	go Serve(listener, server, server)
+	return listener.Addr().String()
+}
+
+// Start a server that knows only the RPC protocol, like a node of a previous version.
+func startRPCServer(t *testing.T) string {
+	listener := listen(t)
+	server := rpc.NewServer()
+	server.Register(new(Echo))
+	go http.Serve(listener, server)
+	return listener.Addr().String()
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	t.Log("TestBinaryRoundTrip started")
+	tr, err := Dial(startServer(t), ProtocolBinary, 2, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if _, ok := tr.(*binaryTransport); !ok {
+		t.Fatal("binary protocol not negotiated")
+	}
+	// the calls are multiplexed on the pooled connections
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(msg string) {
+			defer wg.Done()
+			var reply string
+			if err := tr.Call("Echo.Say", msg, &reply, time.Second); err != nil || reply != msg {
+				t.Errorf("wrong reply %q: %v", reply, err)
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+	var reply int
+	err = tr.Call("Echo.Fail", "Remote failure.", &reply, time.Second)
+	if err == nil || err.Error() != "Remote failure." || !IsRemoteError(err) {
+		t.Fatalf("wrong remote error %v", err)
+	}
+	// the connection is still usable after a remote error
+	var msg string
+	if err := tr.Call("Echo.Say", "again", &msg, time.Second); err != nil || msg != "again" {
+		t.Fatal("connection not usable after a remote error")
+	}
+}
+
+func TestRPCServedOnTheSamePort(t *testing.T) {
+	t.Log("TestRPCServedOnTheSamePort started")
+	tr, err := Dial(startServer(t), ProtocolRPC, 2, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	var reply string
+	if err := tr.Call("Echo.Say", "rpc", &reply, time.Second); err != nil || reply != "rpc" {
+		t.Fatal("RPC call failed")
+	}
+}
+
+func TestBinaryFallbackToRPC(t *testing.T) {
+	t.Log("TestBinaryFallbackToRPC started")
+	tr, err := Dial(startRPCServer(t), ProtocolBinary, 2, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if _, ok := tr.(*rpcTransport); !ok {
+		t.Fatal("no fallback to the RPC protocol")
+	}
+	var reply string
+	if err := tr.Call("Echo.Say", "fallback", &reply, time.Second); err != nil || reply != "fallback" {
+		t.Fatal("RPC call failed")
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	t.Log("TestCallTimeout started")
+	tr, err := Dial(startServer(t), ProtocolBinary, 1, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	var reply int
+	start := time.Now()
+	if err := tr.Call("Echo.Sleep", time.Second, &reply, 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("wrong error %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("the call did not time out")
+	}
+	if IsRemoteError(ErrTimeout) {
+		t.Fatal("timeout reported as remote error")
+	}
+	if err := tr.Call("Echo.Sleep", 10*time.Millisecond, &reply, 0); err != nil {
+		t.Fatal("call without timeout failed")
+	}
+}
+
+func TestDialUnreachable(t *testing.T) {
+	t.Log("TestDialUnreachable started")
+	listener := listen(t)
+	address := listener.Addr().String()
+	listener.Close()
+	if _, err := Dial(address, ProtocolBinary, 1, time.Second, nil); err == nil {
+		t.Fatal("dial of a closed port succeeded")
+	}
+}
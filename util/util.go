@@ -9,7 +9,7 @@ func Protect(g func()) {
 	defer func() {
 		// executes normally even if there is a panic
 		if err := recover(); err != nil {
-			log.Println("run time panic: %v", err)
+			log.Printf("run time panic: %v\r\n", err)
 		}
 	}()
 	g() // possible runtime-error
@@ -51,3 +51,53 @@ func RemoveElement(s []string, element string) []string {
 	}
 	return list
 }
+
+// Check if the string matches the glob pattern: * matches any sequence of characters, ? matches one character
+// and \ escapes the next character. A pattern without wildcards matches only the same string.
+func Glob(pattern string, s string) bool {
+	p, i := []rune(pattern), []rune(s)
+	var pi, si int
+	star, mark := -1, 0
+	for si < len(i) {
+		if pi < len(p) && p[pi] == '*' {
+			star, mark = pi, si
+			pi++
+			continue
+		}
+		if pi < len(p) {
+			c, next := p[pi], pi+1
+			if c == '\\' && next < len(p) {
+				c, next = p[next], next+1
+			} else if c == '?' {
+				pi, si = next, si+1
+				continue
+			}
+			if c == i[si] {
+				pi, si = next, si+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// backtrack: the last star matches one more character
+		mark++
+		pi, si = star+1, mark
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// Get the lowest string greater than all the strings with the prefix, empty if there is no such string.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}